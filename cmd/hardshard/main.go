@@ -1,17 +1,62 @@
 package main
 
 import (
+	"flag"
+
+	"github.com/Fleurer/hardshard/pkg/config"
+	"github.com/Fleurer/hardshard/pkg/log"
+	"github.com/Fleurer/hardshard/pkg/metrics"
 	"github.com/Fleurer/hardshard/pkg/proxy"
-	"github.com/siddontang/go-log/log"
+	"github.com/Fleurer/hardshard/pkg/rotatefile"
 )
 
+var configFile = flag.String("config", "", "path of the json config file")
+
 func main() {
-	s, err := proxy.NewServer("0.0.0.0:4001")
+	flag.Parse()
+
+	cfg := config.Default()
+	if *configFile != "" {
+		var err error
+		cfg, err = config.LoadFile(*configFile)
+		if err != nil {
+			log.Fatal("load config fail: err=%s", err)
+			return
+		}
+	}
+
+	if err := setupLog(cfg.Log); err != nil {
+		log.Fatal("setup log fail: err=%s", err)
+		return
+	}
+
+	s, err := proxy.NewServer(cfg)
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Fatal("%s", err)
 		return
 	}
 
-	log.Info("Listen 0.0.0.0:4001..")
+	if cfg.MetricsAddr != "" {
+		metrics.Serve(cfg.MetricsAddr)
+	}
+
+	log.Info("Listen %s..", cfg.Addr)
 	s.Run()
 }
+
+func setupLog(cfg config.LogConfig) error {
+	level, err := log.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+
+	if cfg.File != "" {
+		w, err := rotatefile.New(cfg.File, int64(cfg.MaxSize)<<20, cfg.MaxBackups)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(w)
+	}
+	return nil
+}
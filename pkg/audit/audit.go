@@ -0,0 +1,157 @@
+package audit
+
+// The audit log records every statement as a json line, the events are queued
+// and written by a background goroutine, so a slow disk never stalls the
+// connections. When the queue is full the events are dropped and counted.
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/log"
+	"github.com/Fleurer/hardshard/pkg/rotatefile"
+)
+
+const (
+	CLASS_DDL    = "ddl"
+	CLASS_DML    = "dml"
+	CLASS_SELECT = "select"
+	CLASS_OTHER  = "other"
+)
+
+const (
+	DEFAULT_BUFFER_SIZE = 4096
+)
+
+type Event struct {
+	StartTime    time.Time         `json:"start_time"`
+	EndTime      time.Time         `json:"end_time"`
+	ConnectionId uint32            `json:"conn_id"`
+	User         string            `json:"user"`
+	Client       string            `json:"client"`
+	DB           string            `json:"db"`
+	Attrs        map[string]string `json:"attrs,omitempty"`
+	Class        string            `json:"class"`
+	Query        string            `json:"query"`
+	AffectedRows uint64            `json:"affected_rows"`
+	ErrorCode    uint16            `json:"error_code"`
+}
+
+// Filter decides which events are written, the empty lists match everything.
+type Filter struct {
+	Classes []string
+	Users   []string
+}
+
+func (f *Filter) Match(class string, user string) bool {
+	return matchAny(f.Classes, class) && matchAny(f.Users, user)
+}
+
+func matchAny(list []string, s string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type Logger struct {
+	filter  Filter
+	w       io.WriteCloser
+	events  chan *Event
+	dropped uint64
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func New(w io.WriteCloser, filter Filter, bufferSize int) *Logger {
+	if bufferSize <= 0 {
+		bufferSize = DEFAULT_BUFFER_SIZE
+	}
+	l := &Logger{
+		filter: filter,
+		w:      w,
+		events: make(chan *Event, bufferSize),
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func Open(path string, maxSize int64, maxBackups int, filter Filter, bufferSize int) (*Logger, error) {
+	w, err := rotatefile.New(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return New(w, filter, bufferSize), nil
+}
+
+// Match tells the caller whether an event is wanted before it bothers to build one.
+func (l *Logger) Match(class string, user string) bool {
+	return l.filter.Match(class, user)
+}
+
+// Log queues the event without blocking.
+func (l *Logger) Log(e *Event) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.events <- e:
+	default:
+		if n := atomic.AddUint64(&l.dropped, 1); n&(n-1) == 0 {
+			log.Warn("audit: queue is full, %d events dropped", n)
+		}
+	}
+}
+
+// Dropped returns the number of events dropped because the queue was full.
+func (l *Logger) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// Close writes the queued events and closes the file.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.events)
+	l.mu.Unlock()
+
+	<-l.done
+	return l.w.Close()
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+
+	bw := bufio.NewWriterSize(l.w, 64*1024)
+	enc := json.NewEncoder(bw)
+	for e := range l.events {
+		if err := enc.Encode(e); err != nil {
+			log.Error("audit: write event fail: err=%s", err)
+		}
+		// flush as soon as the queue is drained, the buffer only batches the bursts
+		if len(l.events) == 0 {
+			if err := bw.Flush(); err != nil {
+				log.Error("audit: flush fail: err=%s", err)
+			}
+		}
+	}
+	bw.Flush()
+}
@@ -0,0 +1,43 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	buf := &bufferCloser{}
+	l := New(buf, Filter{Classes: []string{CLASS_DDL, CLASS_DML}}, 16)
+	if l.Match(CLASS_SELECT, "root") {
+		t.Fatalf("select should be filtered")
+	}
+	l.Log(&Event{ConnectionId: 10001, User: "root", Class: CLASS_DML, Query: "delete from t", AffectedRows: 3})
+	l.Log(&Event{ConnectionId: 10001, User: "root", Class: CLASS_DDL, Query: "drop table t", ErrorCode: 1051})
+	l.Close()
+	l.Log(&Event{Class: CLASS_DDL})
+
+	dec := json.NewDecoder(&buf.Buffer)
+	events := []Event{}
+	for dec.More() {
+		e := Event{}
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("decode err: %s", err)
+		}
+		events = append(events, e)
+	}
+	if len(events) != 2 {
+		t.Fatalf("bad events count: %d", len(events))
+	}
+	if events[0].AffectedRows != 3 || events[1].ErrorCode != 1051 || events[1].Query != "drop table t" {
+		t.Fatalf("bad events: %+v", events)
+	}
+}
@@ -0,0 +1,173 @@
+package backend
+
+// A pool of the connections to each backend node.
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Fleurer/hardshard/pkg/client"
+	"github.com/Fleurer/hardshard/pkg/config"
+	"github.com/Fleurer/hardshard/pkg/mysql"
+)
+
+const (
+	DEFAULT_MAX_IDLE = 16
+)
+
+// Conn is a pooled connection, it remembers its node.
+type Conn struct {
+	*client.Conn
+	node *Node
+}
+
+func (c *Conn) Node() string {
+	return c.node.cfg.Name
+}
+
+type Node struct {
+	cfg config.NodeConfig
+
+	mu     sync.Mutex
+	idle   []*Conn
+	closed bool
+}
+
+func NewNode(cfg config.NodeConfig) *Node {
+	if cfg.MaxIdle <= 0 {
+		cfg.MaxIdle = DEFAULT_MAX_IDLE
+	}
+	return &Node{cfg: cfg}
+}
+
+// Get returns an idle connection, or a new one.
+func (n *Node) Get() (*Conn, error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("backend: node %s is closed", n.cfg.Name)
+	}
+	for len(n.idle) > 0 {
+		c := n.idle[len(n.idle)-1]
+		n.idle = n.idle[:len(n.idle)-1]
+		if !c.IsClosed() {
+			n.mu.Unlock()
+			return c, nil
+		}
+		c.Release()
+	}
+	n.mu.Unlock()
+	return n.connect()
+}
+
+func (n *Node) connect() (*Conn, error) {
+	c := &client.Conn{}
+	c.SetCompression(n.cfg.Compress)
+	c.SetZstdCompression(n.cfg.ZstdCompressionLevel)
+	if err := c.Connect(n.cfg.Addr, n.cfg.User, n.cfg.Password, ""); err != nil {
+		return nil, fmt.Errorf("backend: connect node %s fail: %s", n.cfg.Name, err)
+	}
+	return &Conn{Conn: c, node: n}, nil
+}
+
+// Put keeps the connection for reuse, unless it is broken, in the middle
+// of a transaction, or the pool is full. The pool owns the connection from
+// then on, the one discarded is released.
+func (n *Node) Put(c *Conn) {
+	if c.IsClosed() {
+		c.Release()
+		return
+	}
+	n.mu.Lock()
+	if n.closed || c.Status()&mysql.SERVER_STATUS_IN_TRANS > 0 || len(n.idle) >= n.cfg.MaxIdle {
+		n.mu.Unlock()
+		c.Close()
+		c.Release()
+		return
+	}
+	n.idle = append(n.idle, c)
+	n.mu.Unlock()
+}
+
+// Kill runs KILL on a new connection, the pool may be empty because of the
+// very statements to kill.
+func (n *Node) Kill(threadId uint32, query bool) error {
+	c, err := n.connect()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		c.Close()
+		c.Release()
+	}()
+	stmt := fmt.Sprintf("KILL CONNECTION %d", threadId)
+	if query {
+		stmt = fmt.Sprintf("KILL QUERY %d", threadId)
+	}
+	_, err = c.Execute(stmt)
+	return err
+}
+
+func (n *Node) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	for _, c := range n.idle {
+		c.Close()
+		c.Release()
+	}
+	n.idle = nil
+}
+
+// Cluster holds the nodes by name, it is the mysql.Backend of the proxy.
+type Cluster struct {
+	nodes map[string]*Node
+}
+
+func NewCluster(cfgs []config.NodeConfig) *Cluster {
+	cl := &Cluster{nodes: map[string]*Node{}}
+	for _, cfg := range cfgs {
+		cl.nodes[cfg.Name] = NewNode(cfg)
+	}
+	return cl
+}
+
+func (cl *Cluster) node(name string) (*Node, error) {
+	n, ok := cl.nodes[name]
+	if !ok {
+		return nil, fmt.Errorf("backend: unknown node %s", name)
+	}
+	return n, nil
+}
+
+func (cl *Cluster) Get(name string) (mysql.BackendConn, error) {
+	n, err := cl.node(name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := n.Get()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (cl *Cluster) Put(conn mysql.BackendConn) {
+	c := conn.(*Conn)
+	c.node.Put(c)
+}
+
+func (cl *Cluster) Kill(name string, threadId uint32, query bool) error {
+	n, err := cl.node(name)
+	if err != nil {
+		return err
+	}
+	return n.Kill(threadId, query)
+}
+
+func (cl *Cluster) Close() error {
+	for _, n := range cl.nodes {
+		n.Close()
+	}
+	return nil
+}
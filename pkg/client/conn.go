@@ -1,25 +1,939 @@
 package client
 
-import "net"
+// Conn is a connection from the proxy to a backend MySQL server.
+// Connection Phase: https://dev.mysql.com/doc/internals/en/connection-phase.html
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/mysql"
+)
+
+const (
+	DIAL_TIMEOUT = 5 * time.Second
+	// LOCAL_INFILE_CHUNK is the size of the packets of a LOAD DATA LOCAL file
+	LOCAL_INFILE_CHUNK = 64 * 1024
+
+	AUTH_NATIVE_PASSWORD       = "mysql_native_password"
+	AUTH_CACHING_SHA2_PASSWORD = "caching_sha2_password"
+)
+
+// the capabilities the proxy asks for, masked by what the server supports
+var DEFAULT_CAPABILITIES uint32 = mysql.CLIENT_LONG_PASSWORD | mysql.CLIENT_LONG_FLAG | mysql.CLIENT_PROTOCOL_41 |
+	mysql.CLIENT_TRANSACTIONS | mysql.CLIENT_SECURE_CONNECTION | mysql.CLIENT_MULTI_RESULTS | mysql.CLIENT_PS_MULTI_RESULTS |
+	mysql.CLIENT_PLUGIN_AUTH | mysql.CLIENT_LOCAL_FILES
 
 type Conn struct {
-	conn net.Conn
+	conn     net.Conn
+	pkg      *mysql.PacketIO
+	closed   int32
+	threadId uint32
 
 	addr     string
 	user     string
 	password string
 	db       string
 
-	capability uint32
-	status     uint16
-	collation  CollationId
-	salt       []byte
+	serverVersion string
+	capability    uint32
+	status        uint16
+	collation     mysql.CollationId
+	salt          []byte
+	authPlugin    string
+
+	// vars are the session variables set by SetVars
+	vars map[string]string
+
+	// compress asks for the compressed protocol, see SetCompression, and
+	// zstdLevel for zstd, see SetZstdCompression
+	compress  bool
+	zstdLevel int
+}
+
+// Connect dials the server and logs in, db may be empty.
+func Connect(addr string, user string, password string, db string) (*Conn, error) {
+	c := &Conn{}
+	if err := c.Connect(addr, user, password, db); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetCompression asks for the compressed protocol in the next Connect, it
+// is on if the server supports it.
+func (c *Conn) SetCompression(on bool) {
+	c.compress = on
+}
+
+// SetZstdCompression asks for zstd at the level in place of zlib with the
+// compressed protocol, zlib is used if the server is older than mysql
+// 8.0.18. The level goes from 1 to 22, 0 asks for zlib.
+func (c *Conn) SetZstdCompression(level int) {
+	c.zstdLevel = level
 }
 
 func (c *Conn) Connect(addr string, user string, password string, db string) error {
+	c.addr = addr
+	c.user = user
+	c.password = password
+	c.db = db
+	c.collation = mysql.DEFAULT_COLLATION_ID
+	// the session starts with the charset of the handshake
+	c.vars = map[string]string{"names": mysql.NamesValue(c.collation)}
+
+	conn, err := net.DialTimeout("tcp", addr, DIAL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.pkg = mysql.NewPacketIOByConn(conn)
+
+	if err := c.login(); err != nil {
+		// nobody else has the connection yet
+		c.Close()
+		c.Release()
+		return err
+	}
+	if c.capability&mysql.CLIENT_COMPRESS > 0 {
+		c.pkg.EnableCompression()
+	} else if c.capability&mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM > 0 {
+		c.pkg.EnableZstdCompression(c.zstdLevel)
+	}
 	return nil
 }
 
+// login runs the connection phase up to the OK of the authentication.
+func (c *Conn) login() error {
+	if err := c.readInitialHandshake(); err != nil {
+		return err
+	}
+	if err := c.writeHandshakeResponse(); err != nil {
+		return err
+	}
+	return c.readAuthResult()
+}
+
+func (c *Conn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// Release puts the buffers of a closed connection back to the pool, see
+// mysql.PacketIO.Release. Close may come from any goroutine, but Release
+// is up to the owner of the connection, once nobody else may touch it.
+func (c *Conn) Release() {
+	if c.pkg != nil {
+		c.pkg.Release()
+	}
+}
+
+// IsClosed reports whether the connection is closed, including by a broken read or write.
+func (c *Conn) IsClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// ThreadId is the connection id on the server, it is what KILL wants.
+func (c *Conn) ThreadId() uint32 {
+	return c.threadId
+}
+
+func (c *Conn) Addr() string {
+	return c.addr
+}
+
+func (c *Conn) DB() string {
+	return c.db
+}
+
+func (c *Conn) Status() uint16 {
+	return c.status
+}
+
+func (c *Conn) ServerVersion() string {
+	return c.serverVersion
+}
+
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::Handshake
 func (c *Conn) readInitialHandshake() error {
+	data, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if data[0] == mysql.ERR_HEADER {
+		return mysql.ParseError(data)
+	}
+	if data[0] < 10 {
+		return fmt.Errorf("client: unsupported protocol version %d", data[0])
+	}
+	pos := 1
+	end := bytes.IndexByte(data[pos:], 0)
+	if end < 0 {
+		return mysql.ErrMalformPacket
+	}
+	c.serverVersion = string(data[pos : pos+end])
+	pos += end + 1
+	if len(data) < pos+4+8+1+2 {
+		return mysql.ErrMalformPacket
+	}
+	c.threadId = binary.LittleEndian.Uint32(data[pos:])
+	pos += 4
+	c.salt = append([]byte{}, data[pos:pos+8]...)
+	// auth-plugin-data-part-1 and the filler
+	pos += 8 + 1
+	c.capability = uint32(binary.LittleEndian.Uint16(data[pos:]))
+	pos += 2
+	if len(data) >= pos+1+2+2+1+10 {
+		// charset, status, the upper capabilities, the length of auth-plugin-data, and reserved
+		c.status = binary.LittleEndian.Uint16(data[pos+1:])
+		c.capability |= uint32(binary.LittleEndian.Uint16(data[pos+3:])) << 16
+		saltLen := int(data[pos+5])
+		pos += 1 + 2 + 2 + 1 + 10
+		if c.capability&mysql.CLIENT_SECURE_CONNECTION > 0 {
+			n := saltLen - 8
+			if n < 13 {
+				n = 13
+			}
+			if len(data) < pos+n {
+				return mysql.ErrMalformPacket
+			}
+			// the part 2 ends with a NUL which is not a part of the salt
+			c.salt = append(c.salt, bytes.TrimRight(data[pos:pos+n], "\x00")...)
+			pos += n
+		}
+		if c.capability&mysql.CLIENT_PLUGIN_AUTH > 0 && pos < len(data) {
+			c.authPlugin = string(bytes.TrimRight(data[pos:], "\x00"))
+		}
+	}
+	if c.capability&mysql.CLIENT_PROTOCOL_41 == 0 {
+		return fmt.Errorf("client: server %s does not support the 4.1 protocol", c.addr)
+	}
+	if c.authPlugin == "" {
+		c.authPlugin = AUTH_NATIVE_PASSWORD
+	}
+	return nil
+}
+
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::HandshakeResponse41
+func (c *Conn) writeHandshakeResponse() error {
+	capability := DEFAULT_CAPABILITIES & c.capability
+	if c.db != "" {
+		capability |= mysql.CLIENT_CONNECT_WITH_DB & c.capability
+	}
+	if c.compress && c.zstdLevel > 0 && c.capability&mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM > 0 {
+		capability |= mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM
+	} else if c.compress {
+		capability |= mysql.CLIENT_COMPRESS & c.capability
+	}
+	authResp, err := c.authResponse(c.authPlugin, c.salt)
+	if err != nil {
+		return err
+	}
+	c.capability = capability
+
+	payload := make([]byte, 0, 128)
+	payload = append(payload, mysql.EncodeUint32(capability)...)
+	// max packet size, left to the server
+	payload = append(payload, 0, 0, 0, 0)
+	payload = append(payload, mysql.HandshakeCharset(c.collation))
+	payload = append(payload, make([]byte, 23)...)
+	payload = append(payload, c.user...)
+	payload = append(payload, 0)
+	payload = append(payload, byte(len(authResp)))
+	payload = append(payload, authResp...)
+	if capability&mysql.CLIENT_CONNECT_WITH_DB > 0 {
+		payload = append(payload, c.db...)
+		payload = append(payload, 0)
+	}
+	if capability&mysql.CLIENT_PLUGIN_AUTH > 0 {
+		payload = append(payload, c.authPlugin...)
+		payload = append(payload, 0)
+	}
+	if capability&mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM > 0 {
+		payload = append(payload, byte(c.zstdLevel))
+	}
+	return c.writePacket(payload)
+}
+
+func (c *Conn) authResponse(plugin string, salt []byte) ([]byte, error) {
+	switch plugin {
+	case AUTH_NATIVE_PASSWORD:
+		return mysql.ScramblePassword(salt, []byte(c.password)), nil
+	case AUTH_CACHING_SHA2_PASSWORD:
+		return scrambleSHA256Password(salt, []byte(c.password)), nil
+	}
+	return nil, fmt.Errorf("client: unsupported auth plugin %s", plugin)
+}
+
+// readAuthResult reads the packets after the handshake response until OK or ERR,
+// the server may switch the auth method, or ask for more with caching_sha2_password.
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_caching_sha2_authentication_exchanges.html
+func (c *Conn) readAuthResult() error {
+	for {
+		data, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		switch data[0] {
+		case mysql.OK_HEADER:
+			r, err := mysql.ParseOK(data)
+			if err != nil {
+				return err
+			}
+			c.status = r.Status
+			return nil
+		case mysql.ERR_HEADER:
+			return mysql.ParseError(data)
+		case mysql.EOF_HEADER:
+			// AuthSwitchRequest: plugin name, then the new salt
+			end := bytes.IndexByte(data[1:], 0)
+			if end < 0 {
+				// the old AuthSwitchRequest of 4.0 servers
+				return fmt.Errorf("client: old password auth is not supported")
+			}
+			c.authPlugin = string(data[1 : 1+end])
+			// the packets are read into the same buffer, keep a copy
+			c.salt = append([]byte{}, bytes.TrimRight(data[2+end:], "\x00")...)
+			resp, err := c.authResponse(c.authPlugin, c.salt)
+			if err != nil {
+				return err
+			}
+			if err := c.writePacket(resp); err != nil {
+				return err
+			}
+		case 0x01:
+			// AuthMoreData of caching_sha2_password
+			if len(data) < 2 || c.authPlugin != AUTH_CACHING_SHA2_PASSWORD {
+				return mysql.ErrMalformPacket
+			}
+			switch data[1] {
+			case 3:
+				// fast auth succeeded, an OK follows
+			case 4:
+				// full auth: the password is RSA encrypted with the server's public key
+				if err := c.writePacket([]byte{2}); err != nil {
+					return err
+				}
+				key, err := c.readPacket()
+				if err != nil {
+					return err
+				}
+				enc, err := encryptPassword(key[1:], c.salt, []byte(c.password))
+				if err != nil {
+					return err
+				}
+				if err := c.writePacket(enc); err != nil {
+					return err
+				}
+			default:
+				return mysql.ErrMalformPacket
+			}
+		default:
+			return mysql.ErrMalformPacket
+		}
+	}
+}
+
+// scrambleSHA256Password computes the caching_sha2_password fast auth response:
+// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + salt)
+func scrambleSHA256Password(salt []byte, password []byte) []byte {
+	if len(password) == 0 {
+		return nil
+	}
+	stage1 := sha256.Sum256(password)
+	stage2 := sha256.Sum256(stage1[:])
+
+	h := sha256.New()
+	h.Write(stage2[:])
+	h.Write(salt)
+	scramble := h.Sum(nil)
+	for i := range scramble {
+		scramble[i] ^= stage1[i]
+	}
+	return scramble
+}
+
+func encryptPassword(keyPEM []byte, salt []byte, password []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("client: bad public key from the server")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("client: public key is not RSA")
+	}
+	plain := make([]byte, len(password)+1)
+	copy(plain, password)
+	for i := range plain {
+		plain[i] ^= salt[i%len(salt)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaPub, plain, nil)
+}
+
+// writeCommand starts a new command phase with the sequence reset.
+func (c *Conn) writeCommand(cmd byte, arg []byte) error {
+	c.pkg.ResetSequence()
+	payload := make([]byte, 0, len(arg)+1)
+	payload = append(payload, cmd)
+	payload = append(payload, arg...)
+	return c.writePacket(payload)
+}
+
+// readPacket and writePacket close the connection on network errors, it
+// is not safe to reuse a connection in the middle of a response.
+func (c *Conn) readPacket() ([]byte, error) {
+	data, err := c.pkg.ReadPacket()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if len(data) == 0 {
+		c.Close()
+		return nil, mysql.ErrMalformPacket
+	}
+	return data, nil
+}
+
+func (c *Conn) writePacket(payload []byte) error {
+	if err := c.pkg.WritePacket(payload); err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// readOK reads the response of a command answered with OK or ERR.
+func (c *Conn) readOK() (*mysql.Result, error) {
+	data, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	switch data[0] {
+	case mysql.OK_HEADER:
+		r, err := mysql.ParseOK(data)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.status = r.Status
+		return r, nil
+	case mysql.ERR_HEADER:
+		return nil, mysql.ParseError(data)
+	}
+	c.Close()
+	return nil, mysql.ErrMalformPacket
+}
+
+func (c *Conn) Ping() error {
+	if err := c.writeCommand(mysql.COM_PING, nil); err != nil {
+		return err
+	}
+	_, err := c.readOK()
+	return err
+}
+
+// UseDB switches the default database, nothing is sent if it is the current one.
+// An empty db keeps the current one, mysql can't deselect the database and
+// refuses an empty COM_INIT_DB with ER_NO_DB_ERROR.
+func (c *Conn) UseDB(db string) error {
+	if db == "" || db == c.db {
+		return nil
+	}
+	if err := c.writeCommand(mysql.COM_INIT_DB, []byte(db)); err != nil {
+		return err
+	}
+	if _, err := c.readOK(); err != nil {
+		return err
+	}
+	c.db = db
+	return nil
+}
+
+// charsetVars are overridden by SET NAMES and SET CHARACTER SET
+var charsetVars = map[string]bool{
+	"names":                    true,
+	"charset":                  true,
+	"character_set_client":     true,
+	"character_set_connection": true,
+	"character_set_results":    true,
+	"collation_connection":     true,
+}
+
+// SetVars brings the session variables to vars in a single SET, see
+// setStatement. The connection is closed if the SET fails, its session is
+// unknown then.
+func (c *Conn) SetVars(vars map[string]string) error {
+	query := setStatement(c.vars, vars, c.serverVersion)
+	if query == "" {
+		return nil
+	}
+	if _, err := c.Execute(query); err != nil {
+		c.Close()
+		return err
+	}
+	c.vars = make(map[string]string, len(vars))
+	for name, value := range vars {
+		c.vars[name] = value
+	}
+	return nil
+}
+
+// setStatement returns the SET from the variables old to vars, empty if
+// nothing changed. The ones of old missing in vars are reset to DEFAULT.
+// "names" is SET NAMES and "charset" is SET CHARACTER SET, they override
+// the character_set_* variables, so they are set again as a whole after
+// them once any of them changes. The transaction variables are named for
+// the version of the server.
+func setStatement(old map[string]string, vars map[string]string, version string) string {
+	changed := map[string]bool{}
+	for name := range old {
+		if _, ok := vars[name]; !ok {
+			changed[name] = true
+		}
+	}
+	for name, value := range vars {
+		if v, ok := old[name]; !ok || v != value {
+			changed[name] = true
+		}
+	}
+	charsetChanged := false
+	for name := range changed {
+		charsetChanged = charsetChanged || charsetVars[name]
+	}
+	if charsetChanged {
+		for name := range charsetVars {
+			_, changed[name] = vars[name]
+		}
+		if !changed["charset"] {
+			changed["names"] = true
+		}
+	}
+	var names []string
+	for name, ok := range changed {
+		if ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	// NAMES, then CHARACTER SET, then the others
+	order := func(name string) int {
+		switch name {
+		case "names":
+			return 0
+		case "charset":
+			return 1
+		}
+		return 2
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if oi, oj := order(names[i]), order(names[j]); oi != oj {
+			return oi < oj
+		}
+		return names[i] < names[j]
+	})
+	assignments := make([]string, 0, len(names))
+	for _, name := range names {
+		value, ok := vars[name]
+		if !ok {
+			value = "DEFAULT"
+		}
+		switch name {
+		case "names":
+			assignments = append(assignments, "NAMES "+value)
+		case "charset":
+			assignments = append(assignments, "CHARACTER SET "+value)
+		default:
+			assignments = append(assignments, serverVarName(name, version)+" = "+value)
+		}
+	}
+	return "SET " + strings.Join(assignments, ", ")
+}
+
+// txVars are the transaction variables by their names before 5.7.20, the
+// old names are gone in 8.0 and the new ones are unknown before 5.7.20.
+var txVars = map[string]string{
+	"transaction_isolation": "tx_isolation",
+	"transaction_read_only": "tx_read_only",
+}
+
+func serverVarName(name string, version string) string {
+	if old, ok := txVars[name]; ok && !versionAtLeast(version, 5, 7, 20) {
+		return old
+	}
+	for newName, old := range txVars {
+		if name == old && versionAtLeast(version, 5, 7, 20) {
+			return newName
+		}
+	}
+	return name
+}
+
+// versionAtLeast compares the leading x.y.z of a server version like
+// 8.0.33-log.
+func versionAtLeast(version string, parts ...int) bool {
+	fields := strings.SplitN(version, ".", len(parts))
+	for i, want := range parts {
+		n := 0
+		if i < len(fields) {
+			for _, ch := range fields[i] {
+				if ch < '0' || ch > '9' {
+					break
+				}
+				n = n*10 + int(ch-'0')
+			}
+		}
+		if n != want {
+			return n > want
+		}
+	}
+	return true
+}
+
+// FieldList runs a COM_FIELD_LIST on the table of the current database,
+// wildcard filters the columns like LIKE.
+// https://dev.mysql.com/doc/internals/en/com-field-list.html
+func (c *Conn) FieldList(table string, wildcard string) ([]*mysql.Field, error) {
+	arg := make([]byte, 0, len(table)+len(wildcard)+1)
+	arg = append(arg, table...)
+	arg = append(arg, 0)
+	arg = append(arg, wildcard...)
+	if err := c.writeCommand(mysql.COM_FIELD_LIST, arg); err != nil {
+		return nil, err
+	}
+	fields := []*mysql.Field{}
+	for {
+		data, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if data[0] == mysql.ERR_HEADER {
+			return nil, mysql.ParseError(data)
+		}
+		if mysql.IsEOF(data) {
+			_, c.status = mysql.ParseEOF(data)
+			return fields, nil
+		}
+		f, err := mysql.ParseField(data)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+}
+
+// Execute runs a COM_QUERY and reads the whole response, the results of a
+// multi-resultset response are chained by Result.Next.
+func (c *Conn) Execute(query string) (*mysql.Result, error) {
+	if err := c.writeCommand(mysql.COM_QUERY, []byte(query)); err != nil {
+		return nil, err
+	}
+	result, err := c.readResult()
+	if err != nil {
+		return nil, err
+	}
+	for last := result; last.Status&mysql.SERVER_MORE_RESULTS_EXISTS > 0; last = last.Next {
+		if last.Next, err = c.readResult(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Stream runs a COM_QUERY like Execute, but hands the response to w as it
+// is read, the rows are passed on as they are. Nothing is held but a row,
+// and a slow w holds the server back. An ERR of the server is returned
+// as it is, w may have taken a part of the response then.
+func (c *Conn) Stream(query string, w mysql.ResultWriter) error {
+	if err := c.writeCommand(mysql.COM_QUERY, []byte(query)); err != nil {
+		return err
+	}
+	return c.streamResults(w)
+}
+
+// streamResults hands the results of the response to w, up to the one
+// without SERVER_MORE_RESULTS_EXISTS.
+func (c *Conn) streamResults(w mysql.ResultWriter) error {
+	for {
+		if err := c.streamResult(w); err != nil {
+			return err
+		}
+		if c.status&mysql.SERVER_MORE_RESULTS_EXISTS == 0 {
+			return nil
+		}
+	}
+}
+
+// Prepare runs a COM_STMT_PREPARE, the statement stays on the connection
+// until CloseStmt.
+// https://dev.mysql.com/doc/internals/en/com-stmt-prepare-response.html
+func (c *Conn) Prepare(query string) (*mysql.PreparedStmt, error) {
+	if err := c.writeCommand(mysql.COM_STMT_PREPARE, []byte(query)); err != nil {
+		return nil, err
+	}
+	data, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if data[0] == mysql.ERR_HEADER {
+		return nil, mysql.ParseError(data)
+	}
+	if data[0] != mysql.OK_HEADER || len(data) < 12 {
+		c.Close()
+		return nil, mysql.ErrMalformPacket
+	}
+	stmt := &mysql.PreparedStmt{
+		Id:       binary.LittleEndian.Uint32(data[1:]),
+		Warnings: binary.LittleEndian.Uint16(data[10:]),
+	}
+	columns := int(binary.LittleEndian.Uint16(data[5:]))
+	params := int(binary.LittleEndian.Uint16(data[7:]))
+	if stmt.Params, err = c.readFields(params); err != nil {
+		return nil, err
+	}
+	if stmt.Columns, err = c.readFields(columns); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// StreamExecute runs a COM_STMT_EXECUTE of the statement, args is the
+// payload after the statement id: the flags, the iteration count and the
+// parameters. The binary response is handed to w like Stream.
+// https://dev.mysql.com/doc/internals/en/com-stmt-execute.html
+func (c *Conn) StreamExecute(stmt *mysql.PreparedStmt, args []byte, w mysql.ResultWriter) error {
+	arg := make([]byte, 0, 4+len(args))
+	arg = append(arg, mysql.EncodeUint32(stmt.Id)...)
+	arg = append(arg, args...)
+	if err := c.writeCommand(mysql.COM_STMT_EXECUTE, arg); err != nil {
+		return err
+	}
+	return c.streamResults(w)
+}
+
+// CloseStmt runs a COM_STMT_CLOSE, the server never answers it.
+// https://dev.mysql.com/doc/internals/en/com-stmt-close.html
+func (c *Conn) CloseStmt(stmt *mysql.PreparedStmt) error {
+	if err := c.writeCommand(mysql.COM_STMT_CLOSE, mysql.EncodeUint32(stmt.Id)); err != nil {
+		return err
+	}
+	if err := c.pkg.Flush(); err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// LoadData runs a LOAD DATA LOCAL INFILE and sends r as the file, whatever
+// the name of the file the server asks for. r is read to its end unless the
+// statement fails before the file is asked, an error of r ends the file
+// early and is returned.
+// https://dev.mysql.com/doc/internals/en/com-query-response.html#local-infile-request
+func (c *Conn) LoadData(query string, r io.Reader) (*mysql.Result, error) {
+	if err := c.writeCommand(mysql.COM_QUERY, []byte(query)); err != nil {
+		return nil, err
+	}
+	data, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	switch data[0] {
+	case mysql.OK_HEADER:
+		result, err := mysql.ParseOK(data)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.status = result.Status
+		return result, nil
+	case mysql.ERR_HEADER:
+		return nil, mysql.ParseError(data)
+	case mysql.LocalInFile_HEADER:
+	default:
+		c.Close()
+		return nil, mysql.ErrMalformPacket
+	}
+
+	var readErr error
+	buf := make([]byte, LOCAL_INFILE_CHUNK)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := c.writePacket(buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			readErr = err
+			break
+		}
+	}
+	// an empty packet ends the file
+	if err := c.writePacket(nil); err != nil {
+		return nil, err
+	}
+	result, err := c.readOK()
+	if readErr != nil {
+		return nil, readErr
+	}
+	return result, err
+}
+
+// readResult reads a result of the response, the rows are parsed into the
+// resultset.
+func (c *Conn) readResult() (*mysql.Result, error) {
+	r := &resultReader{}
+	if err := c.streamResult(r); err != nil {
+		return nil, err
+	}
+	return r.result, nil
+}
+
+// streamResult reads a result of the response and hands it to w, the
+// connection is closed if w fails in the middle of it.
+// https://dev.mysql.com/doc/internals/en/com-query-response.html
+func (c *Conn) streamResult(w mysql.ResultWriter) error {
+	data, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	switch data[0] {
+	case mysql.OK_HEADER:
+		r, err := mysql.ParseOK(data)
+		if err != nil {
+			c.Close()
+			return err
+		}
+		c.status = r.Status
+		return c.write(w.WriteResult(r))
+	case mysql.ERR_HEADER:
+		return mysql.ParseError(data)
+	case mysql.LocalInFile_HEADER:
+		// the files are only sent by LoadData, the connection is left in the
+		// middle of the request otherwise
+		c.Close()
+		return mysql.ErrMalformPacket
+	}
+
+	count, _, _ := mysql.DecodeLencInt(data)
+	fields, err := c.readFields(int(count))
+	if err != nil {
+		return err
+	}
+	rs := &mysql.ResultSet{Fields: fields}
+	if err := c.write(w.WriteFields(rs.Fields)); err != nil {
+		return err
+	}
+
+	for {
+		data, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if mysql.IsEOF(data) {
+			result := &mysql.Result{ResultSet: rs}
+			result.Warnings, result.Status = mysql.ParseEOF(data)
+			c.status = result.Status
+			return c.write(w.WriteResult(result))
+		}
+		if data[0] == mysql.ERR_HEADER {
+			// the query failed in the middle of the rows, e.g. it was killed
+			return mysql.ParseError(data)
+		}
+		if err := c.write(w.WriteRow(data)); err != nil {
+			return err
+		}
+	}
+}
+
+// readFields reads n column definitions and the EOF after them, there is
+// no EOF if n is 0.
+func (c *Conn) readFields(n int) ([]*mysql.Field, error) {
+	fields := make([]*mysql.Field, 0, n)
+	if n == 0 {
+		return fields, nil
+	}
+	for i := 0; i < n; i++ {
+		data, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		f, err := mysql.ParseField(data)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	data, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if !mysql.IsEOF(data) {
+		c.Close()
+		return nil, mysql.ErrMalformPacket
+	}
+	return fields, nil
+}
+
+// write closes the connection on an error of the ResultWriter, the rest of
+// the response is never read.
+func (c *Conn) write(err error) error {
+	if err != nil {
+		c.Close()
+	}
+	return err
+}
+
+// resultReader collects a result for readResult.
+type resultReader struct {
+	fields []*mysql.Field
+	values [][]interface{}
+	result *mysql.Result
+}
+
+func (r *resultReader) WriteFields(fields []*mysql.Field) error {
+	r.fields = fields
+	return nil
+}
+
+func (r *resultReader) WriteRow(payload []byte) error {
+	// the values point into the row, which is read into a reused buffer
+	row, err := mysql.ParseRowData(append([]byte{}, payload...), len(r.fields))
+	if err != nil {
+		return err
+	}
+	r.values = append(r.values, row)
+	return nil
+}
+
+func (r *resultReader) WriteResult(result *mysql.Result) error {
+	if result.ResultSet != nil {
+		result.Values = r.values
+	}
+	r.result = result
 	return nil
 }
@@ -0,0 +1,540 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Fleurer/hardshard/pkg/mysql"
+)
+
+const testSalt = "salt1salt2salt3salt4"
+
+var serverCapabilities = mysql.CLIENT_LONG_PASSWORD | mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_TRANSACTIONS |
+	mysql.CLIENT_SECURE_CONNECTION | mysql.CLIENT_MULTI_RESULTS | mysql.CLIENT_PLUGIN_AUTH | mysql.CLIENT_LOCAL_FILES
+
+// startServer serves a single connection with serve, the returned channel
+// is closed once it is done.
+func startServer(t *testing.T, serve func(pio *mysql.PacketIO)) (string, chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("accept err: %s", err)
+			return
+		}
+		defer conn.Close()
+		pio := mysql.NewPacketIOByConn(conn)
+		serve(pio)
+		pio.Flush()
+	}()
+	return ln.Addr().String(), done
+}
+
+// writeHandshake writes the initial handshake of a 5.7 server with the auth plugin.
+func writeHandshake(pio *mysql.PacketIO, plugin string) {
+	payload := []byte{10}
+	payload = append(payload, "5.7.30\x00"...)
+	payload = append(payload, mysql.EncodeUint32(42)...)
+	payload = append(payload, testSalt[:8]...)
+	payload = append(payload, 0)
+	payload = append(payload, mysql.EncodeUint16(uint16(serverCapabilities))...)
+	payload = append(payload, byte(mysql.DEFAULT_COLLATION_ID))
+	payload = append(payload, mysql.EncodeUint16(mysql.SERVER_STATUS_AUTOCOMMIT)...)
+	payload = append(payload, mysql.EncodeUint16(uint16(serverCapabilities>>16))...)
+	payload = append(payload, byte(len(testSalt)+1))
+	payload = append(payload, make([]byte, 10)...)
+	payload = append(payload, testSalt[8:]...)
+	payload = append(payload, 0)
+	payload = append(payload, plugin...)
+	payload = append(payload, 0)
+	pio.WritePacket(payload)
+}
+
+// readAuthResponse returns the user and the auth response of the handshake response.
+func readAuthResponse(t *testing.T, pio *mysql.PacketIO) (string, []byte) {
+	data, err := pio.ReadPacket()
+	if err != nil {
+		t.Errorf("read handshake response err: %s", err)
+		return "", nil
+	}
+	pos := 4 + 4 + 1 + 23
+	end := bytes.IndexByte(data[pos:], 0)
+	user := string(data[pos : pos+end])
+	pos += end + 1
+	n := int(data[pos])
+	return user, append([]byte{}, data[pos+1:pos+1+n]...)
+}
+
+func writeOK(pio *mysql.PacketIO, status uint16) {
+	payload := []byte{mysql.OK_HEADER, 0, 0}
+	payload = append(payload, mysql.EncodeUint16(status)...)
+	payload = append(payload, 0, 0)
+	pio.WritePacket(payload)
+}
+
+func writeEOF(pio *mysql.PacketIO, status uint16) {
+	payload := []byte{mysql.EOF_HEADER, 0, 0}
+	payload = append(payload, mysql.EncodeUint16(status)...)
+	pio.WritePacket(payload)
+}
+
+// readCommand reads the next command of the client, the command is 0 once
+// the client is gone.
+func readCommand(pio *mysql.PacketIO) (byte, string) {
+	pio.ResetSequence()
+	data, err := pio.ReadPacket()
+	if err != nil || len(data) == 0 {
+		return 0, ""
+	}
+	return data[0], string(data[1:])
+}
+
+// serveLogin logs the client in with mysql_native_password.
+func serveLogin(t *testing.T, pio *mysql.PacketIO) {
+	writeHandshake(pio, AUTH_NATIVE_PASSWORD)
+	_, resp := readAuthResponse(t, pio)
+	if !bytes.Equal(resp, mysql.ScramblePassword([]byte(testSalt), []byte("pw"))) {
+		t.Errorf("bad auth response: %v", resp)
+	}
+	writeOK(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+}
+
+func TestConnectNativePassword(t *testing.T) {
+	addr, done := startServer(t, func(pio *mysql.PacketIO) {
+		writeHandshake(pio, AUTH_NATIVE_PASSWORD)
+		user, resp := readAuthResponse(t, pio)
+		if user != "root" || !bytes.Equal(resp, mysql.ScramblePassword([]byte(testSalt), []byte("pw"))) {
+			t.Errorf("bad auth response: %s %v", user, resp)
+		}
+		writeOK(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+	})
+	c, err := Connect(addr, "root", "pw", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+	<-done
+	if c.ThreadId() != 42 || c.ServerVersion() != "5.7.30" || string(c.salt) != testSalt {
+		t.Fatalf("bad handshake: %d %s %q", c.ThreadId(), c.ServerVersion(), c.salt)
+	}
+}
+
+func TestConnectCachingSHA2Password(t *testing.T) {
+	addr, done := startServer(t, func(pio *mysql.PacketIO) {
+		writeHandshake(pio, AUTH_CACHING_SHA2_PASSWORD)
+		_, resp := readAuthResponse(t, pio)
+		if !bytes.Equal(resp, scrambleSHA256Password([]byte(testSalt), []byte("pw"))) {
+			t.Errorf("bad auth response: %v", resp)
+		}
+		// fast auth succeeded
+		pio.WritePacket([]byte{1, 3})
+		writeOK(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+	})
+	c, err := Connect(addr, "root", "pw", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c.Close()
+	<-done
+}
+
+func TestConnectAuthSwitch(t *testing.T) {
+	salt := "01234567890123456789"
+	addr, done := startServer(t, func(pio *mysql.PacketIO) {
+		writeHandshake(pio, AUTH_CACHING_SHA2_PASSWORD)
+		readAuthResponse(t, pio)
+		pio.WritePacket([]byte("\xfe" + AUTH_NATIVE_PASSWORD + "\x00" + salt + "\x00"))
+		resp, err := pio.ReadPacket()
+		if err != nil || !bytes.Equal(resp, mysql.ScramblePassword([]byte(salt), []byte("pw"))) {
+			t.Errorf("bad auth switch response: %v %v", resp, err)
+		}
+		pio.WritePacket([]byte{mysql.ERR_HEADER, 0x15, 0x04, '#', '2', '8', '0', '0', '0', 'n', 'o'})
+	})
+	_, err := Connect(addr, "root", "pw", "")
+	if e, ok := err.(*mysql.MySqlError); !ok || e.Code != mysql.ER_ACCESS_DENIED_ERROR {
+		t.Fatalf("bad result: %v, expected ER_ACCESS_DENIED_ERROR", err)
+	}
+	<-done
+}
+
+func TestSetVars(t *testing.T) {
+	queries := make(chan string, 8)
+	addr, done := startServer(t, func(pio *mysql.PacketIO) {
+		serveLogin(t, pio)
+		for {
+			cmd, query := readCommand(pio)
+			if cmd != mysql.COM_QUERY {
+				return
+			}
+			queries <- query
+			writeOK(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+		}
+	})
+	c, err := Connect(addr, "root", "pw", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	names := c.vars["names"]
+	steps := []struct {
+		vars  map[string]string
+		query string
+	}{
+		{map[string]string{"names": names, "sql_mode": "'ANSI'", "autocommit": "0"}, "SET autocommit = 0, sql_mode = 'ANSI'"},
+		// nothing changed, nothing is sent
+		{map[string]string{"names": names, "sql_mode": "'ANSI'", "autocommit": "0"}, ""},
+		{map[string]string{"names": names, "autocommit": "0"}, "SET sql_mode = DEFAULT"},
+	}
+	for _, step := range steps {
+		if err := c.SetVars(step.vars); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		query := ""
+		select {
+		case query = <-queries:
+		default:
+		}
+		if query != step.query {
+			t.Fatalf("bad query: %q, expected: %q", query, step.query)
+		}
+	}
+	c.Close()
+	<-done
+}
+
+func TestUseDB(t *testing.T) {
+	commands := make(chan string, 8)
+	addr, done := startServer(t, func(pio *mysql.PacketIO) {
+		serveLogin(t, pio)
+		for {
+			cmd, db := readCommand(pio)
+			if cmd != mysql.COM_INIT_DB {
+				return
+			}
+			commands <- db
+			writeOK(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+		}
+	})
+	c, err := Connect(addr, "root", "pw", "db1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// nothing is sent for the current database or for none
+	for _, db := range []string{"db1", "", "db2"} {
+		if err := c.UseDB(db); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	c.Close()
+	<-done
+	close(commands)
+	if db, ok := <-commands; !ok || db != "db2" || len(commands) != 0 {
+		t.Fatalf("bad COM_INIT_DB: %q, expected only: db2", db)
+	}
+	if c.DB() != "db2" {
+		t.Fatalf("bad db: %q, expected: db2", c.DB())
+	}
+}
+
+func TestSetStatement(t *testing.T) {
+	names := "utf8mb4 COLLATE utf8mb4_general_ci"
+	cases := []struct {
+		old     map[string]string
+		vars    map[string]string
+		version string
+		query   string
+	}{
+		{map[string]string{"names": names}, map[string]string{"names": names}, "5.7.30", ""},
+		{
+			map[string]string{"names": names, "wait_timeout": "10"},
+			map[string]string{"names": names, "sql_mode": "'ANSI'", "autocommit": "0"},
+			"5.7.30", "SET autocommit = 0, sql_mode = 'ANSI', wait_timeout = DEFAULT",
+		},
+		// a charset variable brings the others again, NAMES first
+		{
+			map[string]string{"names": names, "character_set_results": "NULL"},
+			map[string]string{"names": names, "character_set_results": "NULL", "autocommit": "0"},
+			"8.0.33", "SET autocommit = 0",
+		},
+		{
+			map[string]string{"names": names},
+			map[string]string{"names": names, "character_set_results": "NULL"},
+			"8.0.33", "SET NAMES " + names + ", character_set_results = NULL",
+		},
+		{
+			map[string]string{"charset": "latin1", "character_set_client": "utf8"},
+			map[string]string{"charset": "latin1"},
+			"8.0.33", "SET CHARACTER SET latin1",
+		},
+		// the transaction variables are named for the server
+		{nil, map[string]string{"transaction_isolation": "'READ-COMMITTED'"}, "5.7.19-log", "SET tx_isolation = 'READ-COMMITTED'"},
+		{nil, map[string]string{"transaction_read_only": "ON"}, "5.5.5-10.4.12-MariaDB", "SET tx_read_only = ON"},
+		{nil, map[string]string{"transaction_isolation": "'READ-COMMITTED'"}, "5.7.20", "SET transaction_isolation = 'READ-COMMITTED'"},
+		{nil, map[string]string{"tx_isolation": "'READ-COMMITTED'"}, "8.0.33", "SET transaction_isolation = 'READ-COMMITTED'"},
+	}
+	for _, c := range cases {
+		if query := setStatement(c.old, c.vars, c.version); query != c.query {
+			t.Fatalf("%v -> %v on %s: bad query: %q, expected: %q", c.old, c.vars, c.version, query, c.query)
+		}
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	cases := []struct {
+		version string
+		at      bool
+	}{
+		{"5.7.20", true},
+		{"5.7.19-log", false},
+		{"5.7.200", true},
+		{"8.0.0", true},
+		{"5.6", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if at := versionAtLeast(c.version, 5, 7, 20); at != c.at {
+			t.Fatalf("%s: bad result: %v, expected: %v", c.version, at, c.at)
+		}
+	}
+}
+
+func TestLoadData(t *testing.T) {
+	addr, done := startServer(t, func(pio *mysql.PacketIO) {
+		serveLogin(t, pio)
+		if _, query := readCommand(pio); !strings.HasPrefix(query, "LOAD DATA LOCAL INFILE") {
+			t.Errorf("bad query: %s", query)
+		}
+		pio.WritePacket([]byte("\xfbdata.txt"))
+		var file []byte
+		for {
+			data, err := pio.ReadPacket()
+			if err != nil {
+				t.Errorf("err: %s", err)
+				return
+			}
+			if len(data) == 0 {
+				break
+			}
+			file = append(file, data...)
+		}
+		if string(file) != "1\tx\n2\ty\n" {
+			t.Errorf("bad file: %q", file)
+		}
+		pio.WritePacket([]byte{mysql.OK_HEADER, 2, 0, 2, 0, 0, 0})
+	})
+	c, err := Connect(addr, "root", "pw", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer c.Close()
+	r, err := c.LoadData("LOAD DATA LOCAL INFILE 'x' INTO TABLE t", strings.NewReader("1\tx\n2\ty\n"))
+	if err != nil || r.AffectedRows != 2 {
+		t.Fatalf("bad result: %+v %v", r, err)
+	}
+	<-done
+}
+
+// recordWriter is a ResultWriter that keeps what it is given.
+type recordWriter struct {
+	events []string
+}
+
+func (w *recordWriter) WriteFields(fields []*mysql.Field) error {
+	w.events = append(w.events, "fields:"+fields[0].Name)
+	return nil
+}
+
+func (w *recordWriter) WriteRow(payload []byte) error {
+	w.events = append(w.events, "row:"+string(payload))
+	return nil
+}
+
+func (w *recordWriter) WriteResult(r *mysql.Result) error {
+	if r.ResultSet != nil {
+		w.events = append(w.events, "eof")
+	} else {
+		w.events = append(w.events, "ok")
+	}
+	return nil
+}
+
+func TestStream(t *testing.T) {
+	addr, done := startServer(t, func(pio *mysql.PacketIO) {
+		serveLogin(t, pio)
+		readCommand(pio)
+		more := mysql.SERVER_STATUS_AUTOCOMMIT | mysql.SERVER_MORE_RESULTS_EXISTS
+		pio.WritePacket([]byte{1})
+		pio.WritePacket((&mysql.Field{Name: "a"}).Dump())
+		writeEOF(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+		pio.WritePacket(mysql.EncodeLencString([]byte("x")))
+		pio.WritePacket(mysql.EncodeLencString([]byte("y")))
+		writeEOF(pio, more)
+		writeOK(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+		pio.Flush()
+		// the connection is left open for the response to be read
+		readCommand(pio)
+	})
+	c, err := Connect(addr, "root", "pw", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	w := &recordWriter{}
+	if err := c.Stream("CALL p()", w); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []string{"fields:a", "row:\x01x", "row:\x01y", "eof", "ok"}
+	if strings.Join(w.events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("bad events: %q, expected: %q", w.events, expected)
+	}
+	c.Close()
+	<-done
+}
+
+// failWriter fails at the first row.
+type failWriter struct {
+	recordWriter
+}
+
+func (w *failWriter) WriteRow(payload []byte) error {
+	return io.ErrClosedPipe
+}
+
+func TestStreamWriterError(t *testing.T) {
+	addr, done := startServer(t, func(pio *mysql.PacketIO) {
+		serveLogin(t, pio)
+		readCommand(pio)
+		pio.WritePacket([]byte{1})
+		pio.WritePacket((&mysql.Field{Name: "a"}).Dump())
+		writeEOF(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+		pio.WritePacket(mysql.EncodeLencString([]byte("x")))
+		writeEOF(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+		pio.Flush()
+		// the client hangs up in the middle of the response
+		if _, err := pio.ReadPacket(); err == nil {
+			t.Errorf("expected the connection closed")
+		}
+	})
+	c, err := Connect(addr, "root", "pw", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := c.Stream("SELECT a FROM t", &failWriter{}); err != io.ErrClosedPipe || !c.IsClosed() {
+		t.Fatalf("bad result: %v %v, expected the error of the writer", err, c.IsClosed())
+	}
+	<-done
+}
+
+func TestPrepareExecute(t *testing.T) {
+	args := []byte{0, 1, 0, 0, 0, 0, 1, mysql.MYSQL_TYPE_TINY, 0, 42}
+	addr, done := startServer(t, func(pio *mysql.PacketIO) {
+		serveLogin(t, pio)
+		if cmd, query := readCommand(pio); cmd != mysql.COM_STMT_PREPARE || query != "CALL p(?)" {
+			t.Errorf("bad command: %d %q", cmd, query)
+		}
+		pio.WritePacket([]byte{mysql.OK_HEADER, 5, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0})
+		pio.WritePacket((&mysql.Field{Name: "?"}).Dump())
+		writeEOF(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+		pio.Flush()
+
+		if cmd, arg := readCommand(pio); cmd != mysql.COM_STMT_EXECUTE || arg != "\x05\x00\x00\x00"+string(args) {
+			t.Errorf("bad command: %d %v", cmd, []byte(arg))
+		}
+		more := mysql.SERVER_STATUS_AUTOCOMMIT | mysql.SERVER_MORE_RESULTS_EXISTS
+		pio.WritePacket([]byte{1})
+		pio.WritePacket((&mysql.Field{Name: "a"}).Dump())
+		writeEOF(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+		// a binary row: the header, the NULL bitmap and the value
+		pio.WritePacket([]byte{0, 0, 1, 'x'})
+		writeEOF(pio, more)
+		writeOK(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+		pio.Flush()
+
+		// COM_STMT_CLOSE is sent with no response to wait for
+		if cmd, arg := readCommand(pio); cmd != mysql.COM_STMT_CLOSE || arg != "\x05\x00\x00\x00" {
+			t.Errorf("bad command: %d %v", cmd, []byte(arg))
+		}
+	})
+	c, err := Connect(addr, "root", "pw", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	stmt, err := c.Prepare("CALL p(?)")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if stmt.Id != 5 || len(stmt.Params) != 1 || len(stmt.Columns) != 0 {
+		t.Fatalf("bad statement: %+v", stmt)
+	}
+	w := &recordWriter{}
+	if err := c.StreamExecute(stmt, args, w); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []string{"fields:a", "row:\x00\x00\x01x", "eof", "ok"}
+	if strings.Join(w.events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("bad events: %q, expected: %q", w.events, expected)
+	}
+	if err := c.CloseStmt(stmt); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c.Close()
+	<-done
+}
+
+func TestConnectZstd(t *testing.T) {
+	defer func(capabilities uint32) { serverCapabilities = capabilities }(serverCapabilities)
+	// zlib is the fallback of the servers before 8.0.18
+	for _, zstd := range []bool{true, false} {
+		serverCapabilities |= mysql.CLIENT_COMPRESS
+		if zstd {
+			serverCapabilities |= mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM
+		} else {
+			serverCapabilities &^= mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM
+		}
+		addr, done := startServer(t, func(pio *mysql.PacketIO) {
+			writeHandshake(pio, AUTH_NATIVE_PASSWORD)
+			data, err := pio.ReadPacket()
+			if err != nil {
+				t.Errorf("read handshake response err: %s", err)
+				return
+			}
+			capability := binary.LittleEndian.Uint32(data)
+			if zstd && (capability&mysql.CLIENT_COMPRESS > 0 || capability&mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM == 0 || data[len(data)-1] != 9) {
+				t.Errorf("bad handshake response: %v, expected zstd at level 9", data)
+			}
+			if !zstd && (capability&mysql.CLIENT_COMPRESS == 0 || capability&mysql.CLIENT_ZSTD_COMPRESSION_ALGORITHM > 0) {
+				t.Errorf("bad handshake response: %v, expected zlib", data)
+			}
+			writeOK(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+			pio.Flush()
+			if zstd {
+				pio.EnableZstdCompression(9)
+			} else {
+				pio.EnableCompression()
+			}
+			if cmd, _ := readCommand(pio); cmd != mysql.COM_PING {
+				t.Errorf("bad command: %d, expected COM_PING", cmd)
+			}
+			writeOK(pio, mysql.SERVER_STATUS_AUTOCOMMIT)
+		})
+		c := &Conn{}
+		c.SetCompression(true)
+		c.SetZstdCompression(9)
+		if err := c.Connect(addr, "root", "pw", ""); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := c.Ping(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		c.Close()
+		<-done
+	}
+}
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+const (
+	DEFAULT_ADDR = "0.0.0.0:4001"
+)
+
+type Config struct {
+	Addr string `json:"addr"`
+	// AllowIPs are the IPs or CIDRs allowed to connect, empty for all
+	AllowIPs []string `json:"allow_ips"`
+	// MaxConnections limits the client connections, 0 for unlimited
+	MaxConnections int `json:"max_connections"`
+	// MetricsAddr serves the metrics over http, empty to disable
+	MetricsAddr string `json:"metrics_addr"`
+	// Users are the accounts of the proxy, the authentication is disabled if it's empty
+	Users []UserConfig `json:"users"`
+	// MaxExecutionTime is the default statement timeout in milliseconds, 0 for none,
+	// a statement may override it with the /*+ MAX_EXECUTION_TIME(n) */ hint
+	MaxExecutionTime int `json:"max_execution_time"`
+	// ServerVersion is the version advertised in the handshake, the mysql 8
+	// drivers check it to enable their features, empty for the builtin one
+	ServerVersion string `json:"server_version"`
+	// Collation is the default collation of the sessions, the one of
+	// mysql.DEFAULT_COLLATION_ID if it's empty
+	Collation string `json:"collation"`
+	// DisabledCapabilities are the capability flags not advertised in the
+	// handshake, like CLIENT_CONNECT_ATTRS
+	DisabledCapabilities []string `json:"disabled_capabilities"`
+	// MaxAllowedPacket is the largest packet taken from the clients in bytes,
+	// like mysql's max_allowed_packet, 64MB if it's 0
+	MaxAllowedPacket int `json:"max_allowed_packet"`
+
+	Log      LogConfig      `json:"log"`
+	Admin    AdminConfig    `json:"admin"`
+	SlowLog  SlowLogConfig  `json:"slow_log"`
+	AuditLog AuditLogConfig `json:"audit_log"`
+	Firewall FirewallConfig `json:"firewall"`
+
+	RateLimits []RateLimitConfig `json:"rate_limits"`
+
+	Nodes   []NodeConfig   `json:"nodes"`
+	Schemas []SchemaConfig `json:"schemas"`
+}
+
+type UserConfig struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	// Hosts restricts where the user connects from, in mysql's account host
+	// syntax (10.0.%) or as CIDRs (10.0.0.0/8), empty for anywhere
+	Hosts []string `json:"hosts"`
+	// MaxConnections limits the connections of the user, 0 for unlimited
+	MaxConnections int `json:"max_connections"`
+	// MaxExecutionTime overrides the default statement timeout for the user
+	MaxExecutionTime int `json:"max_execution_time"`
+}
+
+// NodeConfig is a backend MySQL server.
+type NodeConfig struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// MaxIdle is the number of idle connections kept in the pool
+	MaxIdle int `json:"max_idle"`
+	// Compress asks for the compressed protocol, for the nodes far away
+	Compress bool `json:"compress"`
+	// ZstdCompressionLevel asks for zstd at the level in place of zlib with
+	// Compress, for the nodes of mysql 8.0.18 or later, 0 for zlib
+	ZstdCompressionLevel int `json:"zstd_compression_level"`
+}
+
+// SchemaConfig is a logical database of the clients, once any schema is
+// configured the clients can only use the configured ones.
+type SchemaConfig struct {
+	Name string `json:"name"`
+	// Nodes hold the schema, the sharded tables are spread over all of them
+	// and the others live on the first one, empty for all the nodes
+	Nodes []string `json:"nodes"`
+	// DBs are the physical databases by node, defaults to the schema name
+	DBs    map[string]string `json:"dbs"`
+	Tables []TableConfig     `json:"tables"`
+	// Procedures are the nodes of the stored procedures by name, the CALL of
+	// the others goes to the first node, a /*+ NODE(name) */ hint overrides both
+	Procedures map[string]string `json:"procedures"`
+}
+
+// TableConfig describes a sharded table.
+type TableConfig struct {
+	Name string `json:"name"`
+	// Key is the sharding column
+	Key string `json:"key"`
+}
+
+type LogConfig struct {
+	// Level is one of debug, info, warn and error, it can be changed at runtime by `ADMIN SET log_level = x`
+	Level string `json:"level"`
+	// File is the path of the log file, logs go to stderr if it's empty
+	File       string `json:"file"`
+	MaxSize    int    `json:"max_size"`
+	MaxBackups int    `json:"max_backups"`
+	// Trace dumps the packets of every new connection, it's for debugging only,
+	// use `ADMIN TRACE <conn_id> ON` to trace a single connection
+	Trace bool `json:"trace"`
+}
+
+type AdminConfig struct {
+	// Users are allowed to run the ADMIN statements
+	Users []string `json:"users"`
+}
+
+type SlowLogConfig struct {
+	// File is the path of the slow log, an empty path disables the slow log
+	File string `json:"file"`
+	// LongQueryTime is the default threshold in seconds, like mysql's long_query_time
+	LongQueryTime float64 `json:"long_query_time"`
+	// MaxSize is the size in megabytes at which the file gets rotated
+	MaxSize int `json:"max_size"`
+	// MaxBackups is the number of rotated files to retain
+	MaxBackups int `json:"max_backups"`
+}
+
+type AuditLogConfig struct {
+	// File is the path of the audit log, an empty path disables the audit log
+	File       string `json:"file"`
+	MaxSize    int    `json:"max_size"`
+	MaxBackups int    `json:"max_backups"`
+	// Classes filters the statements by class: ddl, dml, select and other, empty for all
+	Classes []string `json:"classes"`
+	// Users filters the statements by user, empty for all
+	Users []string `json:"users"`
+	// BufferSize is the number of events queued before they get dropped
+	BufferSize int `json:"buffer_size"`
+}
+
+type FirewallConfig struct {
+	// Rules are evaluated in order before the routing, the first matched rule decides
+	Rules []FirewallRule `json:"rules"`
+}
+
+// FirewallRule matches a statement if all of its non-empty conditions match.
+type FirewallRule struct {
+	Name string `json:"name"`
+	// Action is either "deny" or "allow", defaults to "deny"
+	Action string `json:"action"`
+	// Users and Hosts match the client, the hosts are IPs or CIDRs
+	Users []string `json:"users"`
+	Hosts []string `json:"hosts"`
+	// Fingerprints match the normalized statements, see sqlparser.Fingerprint
+	Fingerprints []string `json:"fingerprints"`
+	// Checks match the shape of the statements, one of update_without_where,
+	// delete_without_where, select_without_limit, truncate and drop
+	Checks []string `json:"checks"`
+}
+
+// RateLimitConfig is a token bucket applied to the statements of a user,
+// of a fingerprint, or of both.
+type RateLimitConfig struct {
+	Name string `json:"name"`
+	// User is the proxy user, * gives every user a bucket of its own, empty for all users sharing one bucket
+	User string `json:"user"`
+	// Fingerprint matches the normalized statements, empty for all statements
+	Fingerprint string `json:"fingerprint"`
+	// QPS is the refill rate and Burst is the size of the bucket
+	QPS   float64 `json:"qps"`
+	Burst float64 `json:"burst"`
+	// Mode is "reject" (default) to fail at once, or "wait" to queue up to MaxWait milliseconds
+	Mode    string `json:"mode"`
+	MaxWait int    `json:"max_wait"`
+}
+
+func Default() *Config {
+	return &Config{
+		Addr: DEFAULT_ADDR,
+		Log: LogConfig{
+			Level:      "info",
+			MaxSize:    100,
+			MaxBackups: 5,
+		},
+		SlowLog: SlowLogConfig{
+			LongQueryTime: 1,
+			MaxSize:       100,
+			MaxBackups:    5,
+		},
+		AuditLog: AuditLogConfig{
+			MaxSize:    100,
+			MaxBackups: 5,
+			BufferSize: 4096,
+		},
+	}
+}
+
+// LoadFile reads a json config file, the missing fields keep their default values.
+func LoadFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Config, error) {
+	cfg := Default()
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
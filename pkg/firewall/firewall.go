@@ -0,0 +1,169 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Fleurer/hardshard/pkg/config"
+	"github.com/Fleurer/hardshard/pkg/netutil"
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+const (
+	ACTION_DENY  = "deny"
+	ACTION_ALLOW = "allow"
+)
+
+const (
+	CHECK_UPDATE_WITHOUT_WHERE = "update_without_where"
+	CHECK_DELETE_WITHOUT_WHERE = "delete_without_where"
+	CHECK_SELECT_WITHOUT_LIMIT = "select_without_limit"
+	CHECK_TRUNCATE             = "truncate"
+	CHECK_DROP                 = "drop"
+)
+
+// Request is the statement to check along with who sends it.
+type Request struct {
+	User        string
+	Host        string
+	DB          string
+	Query       string
+	Fingerprint string
+
+	info *sqlparser.Info
+}
+
+type Rule struct {
+	Name         string
+	Action       string
+	users        map[string]bool
+	hosts        []*net.IPNet
+	fingerprints map[string]bool
+	checks       []string
+}
+
+type Firewall struct {
+	rules []*Rule
+	// sharded tables as schema.table
+	sharded map[string]bool
+}
+
+func New(cfg config.FirewallConfig, schemas []config.SchemaConfig) (*Firewall, error) {
+	f := &Firewall{sharded: map[string]bool{}}
+	for _, s := range schemas {
+		for _, t := range s.Tables {
+			f.sharded[s.Name+"."+t.Name] = true
+		}
+	}
+	for i, rc := range cfg.Rules {
+		r, err := newRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("firewall rule #%d %s: %s", i, rc.Name, err)
+		}
+		f.rules = append(f.rules, r)
+	}
+	return f, nil
+}
+
+func newRule(rc config.FirewallRule) (*Rule, error) {
+	r := &Rule{
+		Name:         rc.Name,
+		Action:       strings.ToLower(rc.Action),
+		users:        map[string]bool{},
+		fingerprints: map[string]bool{},
+	}
+	if r.Action == "" {
+		r.Action = ACTION_DENY
+	}
+	if r.Action != ACTION_DENY && r.Action != ACTION_ALLOW {
+		return nil, fmt.Errorf("unknown action %s", rc.Action)
+	}
+	for _, u := range rc.Users {
+		r.users[u] = true
+	}
+	var err error
+	if r.hosts, err = netutil.ParseIPNets(rc.Hosts); err != nil {
+		return nil, err
+	}
+	for _, fp := range rc.Fingerprints {
+		// normalize again, so the fingerprints can be written loosely in the config
+		r.fingerprints[sqlparser.Fingerprint(fp)] = true
+	}
+	for _, c := range rc.Checks {
+		switch c {
+		case CHECK_UPDATE_WITHOUT_WHERE, CHECK_DELETE_WITHOUT_WHERE, CHECK_SELECT_WITHOUT_LIMIT, CHECK_TRUNCATE, CHECK_DROP:
+			r.checks = append(r.checks, c)
+		default:
+			return nil, fmt.Errorf("unknown check %s", c)
+		}
+	}
+	return r, nil
+}
+
+// Check returns the deny rule that rejects the request, or nil if it is allowed.
+func (f *Firewall) Check(req *Request) *Rule {
+	for _, r := range f.rules {
+		if f.match(r, req) {
+			if r.Action == ACTION_ALLOW {
+				return nil
+			}
+			return r
+		}
+	}
+	return nil
+}
+
+func (f *Firewall) match(r *Rule, req *Request) bool {
+	if len(r.users) > 0 && !r.users[req.User] {
+		return false
+	}
+	if len(r.hosts) > 0 && !netutil.ContainsIP(r.hosts, req.Host) {
+		return false
+	}
+	if len(r.fingerprints) > 0 && !r.fingerprints[req.Fingerprint] {
+		return false
+	}
+	if len(r.checks) > 0 {
+		if req.info == nil {
+			req.info = sqlparser.Analyze(req.Query)
+		}
+		for _, c := range r.checks {
+			if f.check(c, req) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (f *Firewall) check(name string, req *Request) bool {
+	info := req.info
+	switch name {
+	case CHECK_UPDATE_WITHOUT_WHERE:
+		return info.Type == sqlparser.STMT_UPDATE && !info.HasWhere
+	case CHECK_DELETE_WITHOUT_WHERE:
+		return info.Type == sqlparser.STMT_DELETE && !info.HasWhere
+	case CHECK_SELECT_WITHOUT_LIMIT:
+		return info.Type == sqlparser.STMT_SELECT && !info.HasLimit && f.touchSharded(req)
+	case CHECK_TRUNCATE:
+		return sqlparser.FirstKeyword(req.Query) == "truncate"
+	case CHECK_DROP:
+		return sqlparser.FirstKeyword(req.Query) == "drop"
+	}
+	return false
+}
+
+func (f *Firewall) touchSharded(req *Request) bool {
+	for _, t := range req.info.Tables {
+		schema := t.Schema
+		if schema == "" {
+			schema = req.DB
+		}
+		if f.sharded[schema+"."+t.Name] {
+			return true
+		}
+	}
+	return false
+}
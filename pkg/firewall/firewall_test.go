@@ -0,0 +1,60 @@
+package firewall
+
+import (
+	"testing"
+
+	"github.com/Fleurer/hardshard/pkg/config"
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+func TestCheck(t *testing.T) {
+	cfg := config.FirewallConfig{
+		Rules: []config.FirewallRule{
+			{Name: "ops", Action: "allow", Users: []string{"ops"}, Hosts: []string{"10.0.0.0/8"}},
+			{Name: "no-full-scan", Checks: []string{CHECK_UPDATE_WITHOUT_WHERE, CHECK_DELETE_WITHOUT_WHERE, CHECK_SELECT_WITHOUT_LIMIT}},
+			{Name: "no-drop", Checks: []string{CHECK_DROP, CHECK_TRUNCATE}},
+			{Name: "bad-query", Fingerprints: []string{"select sleep(1)"}},
+			{Name: "bad-host", Hosts: []string{"192.168.1.1"}},
+		},
+	}
+	schemas := []config.SchemaConfig{{Name: "db1", Tables: []config.TableConfig{{Name: "orders", Key: "user_id"}}}}
+	f, err := New(cfg, schemas)
+	if err != nil {
+		t.Fatalf("New err: %s", err)
+	}
+
+	cases := []struct {
+		user  string
+		host  string
+		query string
+		rule  string
+	}{
+		{"app", "10.0.0.1", "DELETE FROM orders", "no-full-scan"},
+		{"ops", "10.0.0.1", "DELETE FROM orders", ""},
+		{"ops", "172.16.0.1", "DELETE FROM orders", "no-full-scan"},
+		{"app", "10.0.0.1", "DELETE FROM orders WHERE id = 1", ""},
+		{"app", "10.0.0.1", "update orders set a = 1", "no-full-scan"},
+		{"app", "10.0.0.1", "select * from orders where user_id > 1", "no-full-scan"},
+		{"app", "10.0.0.1", "select * from orders where user_id > 1 limit 10", ""},
+		{"app", "10.0.0.1", "select * from users", ""},
+		{"app", "10.0.0.1", "/* x */ drop table users", "no-drop"},
+		{"app", "10.0.0.1", "TRUNCATE users", "no-drop"},
+		{"app", "10.0.0.1", "SELECT SLEEP(10)", "bad-query"},
+		{"app", "192.168.1.1", "select 1", "bad-host"},
+	}
+	for _, c := range cases {
+		req := &Request{User: c.user, Host: c.host, DB: "db1", Query: c.query, Fingerprint: sqlparser.Fingerprint(c.query)}
+		rule := f.Check(req)
+		name := ""
+		if rule != nil {
+			name = rule.Name
+		}
+		if name != c.rule {
+			t.Fatalf("bad rule for %q from %s@%s: %q, expected: %q", c.query, c.user, c.host, name, c.rule)
+		}
+	}
+
+	if _, err := New(config.FirewallConfig{Rules: []config.FirewallRule{{Checks: []string{"bad"}}}}, nil); err == nil {
+		t.Fatalf("expected error on unknown check")
+	}
+}
@@ -0,0 +1,167 @@
+package log
+
+// A leveled logger with key=value fields:
+//
+//   2018/08/01 10:00:00.123456 [WARN] readPacket fail: err=connection was bad conn_id=10001 remote=127.0.0.1:52718 user=root
+//
+// The level is global and can be changed at runtime, the fields are attached
+// to a Logger with With(), usually once per connection.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelFatal {
+		return fmt.Sprintf("Level(%d)", l)
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level: %s", s)
+}
+
+var (
+	level int32 = int32(LevelInfo)
+
+	mu     sync.Mutex
+	output io.Writer = os.Stderr
+
+	std = &Logger{}
+)
+
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	output = w
+}
+
+type Logger struct {
+	fields string
+}
+
+// With returns a logger that appends the key value pairs to every line.
+func (l *Logger) With(kvs ...interface{}) *Logger {
+	buf := bytes.NewBufferString(l.fields)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		fmt.Fprintf(buf, " %v=%s", kvs[i], quote(fmt.Sprint(kvs[i+1])))
+	}
+	return &Logger{fields: buf.String()}
+}
+
+func (l *Logger) Debug(format string, args ...interface{}) {
+	l.output(LevelDebug, "DEBUG", format, args...)
+}
+
+func (l *Logger) Info(format string, args ...interface{}) {
+	l.output(LevelInfo, "INFO", format, args...)
+}
+
+func (l *Logger) Warn(format string, args ...interface{}) {
+	l.output(LevelWarn, "WARN", format, args...)
+}
+
+func (l *Logger) Error(format string, args ...interface{}) {
+	l.output(LevelError, "ERROR", format, args...)
+}
+
+func (l *Logger) Fatal(format string, args ...interface{}) {
+	l.output(LevelFatal, "FATAL", format, args...)
+	os.Exit(1)
+}
+
+// Trace is written regardless of the level, the callers decide themselves
+// whether tracing is on.
+func (l *Logger) Trace(format string, args ...interface{}) {
+	l.output(LevelFatal, "TRACE", format, args...)
+}
+
+func (l *Logger) output(lv Level, label string, format string, args ...interface{}) {
+	if lv < GetLevel() {
+		return
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 128))
+	buf.WriteString(time.Now().Format("2006/01/02 15:04:05.000000"))
+	buf.WriteString(" [")
+	buf.WriteString(label)
+	buf.WriteString("] ")
+	// the fields stay on the first line when the message is a multi-line dump
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		buf.WriteString(msg[:i])
+		buf.WriteString(l.fields)
+		buf.WriteString(msg[i:])
+	} else {
+		buf.WriteString(msg)
+		buf.WriteString(l.fields)
+	}
+	buf.WriteByte('\n')
+
+	mu.Lock()
+	defer mu.Unlock()
+	output.Write(buf.Bytes())
+}
+
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+func With(kvs ...interface{}) *Logger {
+	return std.With(kvs...)
+}
+
+func Debug(format string, args ...interface{}) {
+	std.Debug(format, args...)
+}
+
+func Info(format string, args ...interface{}) {
+	std.Info(format, args...)
+}
+
+func Warn(format string, args ...interface{}) {
+	std.Warn(format, args...)
+}
+
+func Error(format string, args ...interface{}) {
+	std.Error(format, args...)
+}
+
+func Fatal(format string, args ...interface{}) {
+	std.Fatal(format, args...)
+}
@@ -0,0 +1,38 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	buf := bytes.NewBufferString("")
+	mu.Lock()
+	prev := output
+	mu.Unlock()
+	SetOutput(buf)
+	defer SetOutput(prev)
+	SetLevel(LevelWarn)
+	defer SetLevel(LevelInfo)
+
+	l := With("conn_id", 10001, "user", "a b")
+	l.Info("hidden")
+	l.Warn("read fail: err=%s", "EOF")
+	l.Trace("packet\n00000000  01")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("bad lines: %q", lines)
+	}
+	if !strings.HasSuffix(lines[0], `[WARN] read fail: err=EOF conn_id=10001 user="a b"`) {
+		t.Fatalf("bad line: %s", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], `[TRACE] packet conn_id=10001 user="a b"`) || lines[2] != "00000000  01" {
+		t.Fatalf("bad trace: %q", lines[1:])
+	}
+
+	if lv, err := ParseLevel("debug"); err != nil || lv != LevelDebug {
+		t.Fatalf("bad level: %v, err: %v", lv, err)
+	}
+}
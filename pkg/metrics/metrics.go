@@ -0,0 +1,31 @@
+package metrics
+
+// The metrics are published with expvar, they are served as json at
+// http://<metrics_addr>/debug/vars
+
+import (
+	"expvar"
+	"net/http"
+
+	"github.com/Fleurer/hardshard/pkg/log"
+)
+
+var (
+	// Connections is the number of the client connections
+	Connections = expvar.NewInt("connections")
+	// UserConnections is the number of the client connections per user
+	UserConnections = expvar.NewMap("user_connections")
+	// RejectedConnections counts the rejected connections by reason
+	RejectedConnections = expvar.NewMap("rejected_connections")
+	// ThrottledQueries counts the statements rejected by the rate limits, by rule
+	ThrottledQueries = expvar.NewMap("throttled_queries")
+)
+
+// Serve starts the http server of the metrics in background.
+func Serve(addr string) {
+	go func() {
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.Error("metrics: serve %s fail: err=%s", addr, err)
+		}
+	}()
+}
@@ -0,0 +1,133 @@
+package mysql
+
+// The ADMIN statements manage the proxy itself, they are never sent to the backends:
+//
+//   ADMIN SET log_level = {debug|info|warn|error}
+//   ADMIN TRACE <conn_id> {ON|OFF}
+//   ADMIN SHOW STATUS
+//   ADMIN SHOW USERS
+//   ADMIN SHOW PROCESSLIST
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Fleurer/hardshard/pkg/log"
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+func (c *Connection) isAdmin() bool {
+	for _, u := range c.env.Config.Admin.Users {
+		if u == c.user {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Connection) handleAdmin(query string) error {
+	if !c.isAdmin() {
+		return c.writeError(NewDefaultMySqlError(ER_SPECIFIC_ACCESS_DENIED_ERROR, "SUPER"))
+	}
+
+	s := sqlparser.NewScanner(query)
+	s.Accept("admin")
+	var err error
+	switch {
+	case s.Accept("show"):
+		rs, err := c.adminShow(s)
+		if err != nil {
+			return c.writeError(err)
+		}
+		return c.writeResultSet(rs)
+	case s.Accept("set"):
+		err = c.adminSet(s)
+	case s.Accept("trace"):
+		err = c.adminTrace(s)
+	default:
+		err = adminSyntaxError(query)
+	}
+	if err != nil {
+		return c.writeError(err)
+	}
+	return c.writeOK(c.status, 0, 0)
+}
+
+func (c *Connection) adminSet(s *sqlparser.Scanner) error {
+	name := strings.ToLower(s.Next().Value)
+	if !s.AcceptPunct("=") {
+		return adminSyntaxError(name)
+	}
+	value := sqlparser.Unquote(s.Expr())
+	switch name {
+	case "log_level":
+		level, err := log.ParseLevel(value)
+		if err != nil {
+			return NewDefaultMySqlError(ER_WRONG_VALUE_FOR_VAR, name, value)
+		}
+		log.SetLevel(level)
+		c.log.Info("admin: set log level to %s", level)
+	default:
+		return NewDefaultMySqlError(ER_UNKNOWN_SYSTEM_VARIABLE, name)
+	}
+	return nil
+}
+
+func (c *Connection) adminTrace(s *sqlparser.Scanner) error {
+	t := s.Next()
+	id, err := strconv.ParseUint(t.Value, 10, 32)
+	if err != nil {
+		return adminSyntaxError(t.Value)
+	}
+	var on bool
+	switch {
+	case s.Accept("on"):
+		on = true
+	case s.Accept("off"):
+		on = false
+	default:
+		return adminSyntaxError(s.Rest())
+	}
+
+	target := c.env.getConnection(uint32(id))
+	if target == nil {
+		return NewMySqlError(ER_NO_SUCH_THREAD, fmt.Sprintf("Unknown thread id: %d", id))
+	}
+	target.SetTrace(on)
+	c.log.Info("admin: set trace of connection %d to %v", id, on)
+	return nil
+}
+
+func (c *Connection) adminShow(s *sqlparser.Scanner) (*ResultSet, error) {
+	total, users := c.env.connectionCounts()
+	switch {
+	case s.Accept("status"):
+		values := [][]interface{}{
+			{"connections", total},
+			{"max_connections", c.env.Config.MaxConnections},
+			{"log_level", strings.ToLower(log.GetLevel().String())},
+		}
+		return NewResultSet([]string{"Variable_name", "Value"}, values), nil
+	case s.Accept("users"):
+		values := [][]interface{}{}
+		for _, uc := range c.env.Config.Users {
+			values = append(values, []interface{}{uc.Name, users[uc.Name], uc.MaxConnections})
+			delete(users, uc.Name)
+		}
+		// the users connected while the authentication is disabled
+		for name, n := range users {
+			values = append(values, []interface{}{name, n, 0})
+		}
+		return NewResultSet([]string{"User", "Connections", "Max_connections"}, values), nil
+	case s.Accept("processlist"):
+		// the full statements along with the backend connections of the sessions
+		columns := append(append([]string{}, processListColumns...), "Backends")
+		return NewResultSet(columns, c.processList(true, true)), nil
+	}
+	return nil, adminSyntaxError(s.Rest())
+}
+
+func adminSyntaxError(near string) error {
+	return NewDefaultMySqlError(ER_PARSE_ERROR, "Unsupported ADMIN statement", near, 1)
+}
@@ -0,0 +1,100 @@
+package mysql
+
+// Authentication Method: https://dev.mysql.com/doc/internals/en/authentication-method.html
+
+import (
+	"bytes"
+	"crypto/subtle"
+
+	"github.com/Fleurer/hardshard/pkg/config"
+	"github.com/Fleurer/hardshard/pkg/netutil"
+)
+
+type proxyUser struct {
+	name           string
+	password       string
+	hosts          []*netutil.HostPattern
+	maxConnections int
+	// maxExecutionTime in milliseconds, 0 for the global default
+	maxExecutionTime int
+}
+
+func newProxyUser(cfg config.UserConfig) (*proxyUser, error) {
+	u := &proxyUser{name: cfg.Name, password: cfg.Password, maxConnections: cfg.MaxConnections, maxExecutionTime: cfg.MaxExecutionTime}
+	for _, h := range cfg.Hosts {
+		p, err := netutil.ParseHostPattern(h)
+		if err != nil {
+			return nil, err
+		}
+		u.hosts = append(u.hosts, p)
+	}
+	return u, nil
+}
+
+func (u *proxyUser) allowHost(host string) bool {
+	if len(u.hosts) == 0 {
+		return true
+	}
+	for _, p := range u.hosts {
+		if p.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// readAuthData returns the mysql_native_password auth response, it asks the
+// client to switch if it started with another plugin, like caching_sha2_password.
+func (c *Connection) readAuthData(h *handkshakeResponse) ([]byte, error) {
+	plugin := string(bytes.TrimRight(h.authPluginName, "\x00"))
+	if h.capabilities&CLIENT_PLUGIN_AUTH == 0 || plugin == "" || plugin == AUTH_NAME {
+		return h.authData, nil
+	}
+
+	// AuthSwitchRequest: https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::AuthSwitchRequest
+	payload := make([]byte, 0, 1+len(AUTH_NAME)+1+len(c.salt)+1)
+	payload = append(payload, EOF_HEADER)
+	payload = append(payload, AUTH_NAME...)
+	payload = append(payload, 0)
+	payload = append(payload, c.salt...)
+	payload = append(payload, 0)
+	if c.tracing() {
+		c.traceRedacted("write", c.packetIO.Sequence, len(payload))
+	}
+	if err := c.packetIO.WritePacket(payload); err != nil {
+		return nil, err
+	}
+	authData, err := c.packetIO.ReadPacket()
+	if err == nil && c.tracing() {
+		c.traceRedacted("read", c.packetIO.Sequence-1, len(authData))
+	}
+	return authData, err
+}
+
+// authenticate checks the password and the host of the user, everyone is
+// welcome if no users are configured.
+func (c *Connection) authenticate(user string, authData []byte) error {
+	if len(c.env.users) == 0 {
+		return nil
+	}
+	host := c.remoteHost()
+	usingPassword := "NO"
+	if len(authData) > 0 {
+		usingPassword = "YES"
+	}
+	denied := NewDefaultMySqlError(ER_ACCESS_DENIED_ERROR, user, host, usingPassword)
+
+	u, ok := c.env.users[user]
+	if !ok {
+		return denied
+	}
+	expected := ScramblePassword(c.salt, []byte(u.password))
+	if subtle.ConstantTimeCompare(expected, authData) != 1 {
+		return denied
+	}
+	if !u.allowHost(host) {
+		c.log.Warn("authenticate: user %s is not allowed to connect from %s", user, host)
+		return denied
+	}
+	return nil
+}
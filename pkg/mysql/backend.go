@@ -0,0 +1,434 @@
+package mysql
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/router"
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+// BackendConn is a connection to a backend node, see client.Conn.
+type BackendConn interface {
+	Node() string
+	// ThreadId is the connection id on the backend
+	ThreadId() uint32
+	UseDB(db string) error
+	Execute(query string) (*Result, error)
+	// Stream runs the query and hands the response to w as it is read
+	Stream(query string, w ResultWriter) error
+	// LoadData runs a LOAD DATA LOCAL INFILE with r as the file
+	LoadData(query string, r io.Reader) (*Result, error)
+	// SetVars applies the session variables, see client.Conn.SetVars
+	SetVars(vars map[string]string) error
+	FieldList(table string, wildcard string) ([]*Field, error)
+	// Prepare runs a COM_STMT_PREPARE, StreamExecute runs a
+	// COM_STMT_EXECUTE with args, the payload after the statement id, and
+	// hands the response to w like Stream, CloseStmt deallocates it
+	Prepare(query string) (*PreparedStmt, error)
+	StreamExecute(stmt *PreparedStmt, args []byte, w ResultWriter) error
+	CloseStmt(stmt *PreparedStmt) error
+	Close() error
+}
+
+// Backend pools the connections to the backend nodes, see backend.Cluster.
+type Backend interface {
+	Get(node string) (BackendConn, error)
+	// Put takes the connection back, a broken one or one in a transaction is
+	// closed, the caller does not touch it after
+	Put(conn BackendConn)
+	// Kill runs KILL [QUERY] <threadId> on a side connection to the node
+	Kill(node string, threadId uint32, query bool) error
+	Close() error
+}
+
+func (c *Connection) inTransaction() bool {
+	return c.status&SERVER_STATUS_IN_TRANS > 0
+}
+
+func (c *Connection) autocommit() bool {
+	return c.status&SERVER_STATUS_AUTOCOMMIT > 0
+}
+
+// forwardQuery runs the statement on the backends and relays the result,
+// the response of a single node is streamed.
+func (c *Connection) forwardQuery(query string) error {
+	if c.env.Backend == nil {
+		return c.writeError(NewMySqlError(ER_UNKNOWN_ERROR, "No backend node is configured"))
+	}
+	plan, err := c.env.Router.Route(c.db, query)
+	if err != nil {
+		return c.writeError(err)
+	}
+	c.stats.shards = plan.Nodes
+	if len(plan.Nodes) == 1 {
+		return c.streamQuery(query, plan)
+	}
+	// the rows of the shards are only concatenated
+	if info := sqlparser.Analyze(query); info.Type == sqlparser.STMT_SELECT && info.Merge != "" {
+		return c.writeError(NewMySqlError(ER_NOT_SUPPORTED_YET, fmt.Sprintf("This version of hardshard doesn't yet support '%s across the shards'", info.Merge)))
+	}
+
+	c.setProcessState("executing")
+	start := time.Now()
+	var result *Result
+	err = c.withTimeout(query, c.maxExecutionTime(query), func() error {
+		result, err = c.execute(query, plan)
+		return err
+	})
+	c.stats.backendTime = time.Since(start)
+	if err != nil {
+		return c.writeError(err)
+	}
+	if err := c.badSelect(query, false); err != nil && result.HasResultSet() {
+		return c.writeError(err)
+	}
+	c.setProcessState("sending data")
+	return c.writeResults(result)
+}
+
+// badSelect is the ER_SP_BADSELECT of a CALL when the client can't take
+// its resultsets: it did not negotiate CLIENT_MULTI_RESULTS, or
+// CLIENT_PS_MULTI_RESULTS for the binary protocol. It is nil otherwise.
+func (c *Connection) badSelect(query string, binary bool) error {
+	capability := uint32(CLIENT_MULTI_RESULTS)
+	if binary {
+		capability = CLIENT_PS_MULTI_RESULTS
+	}
+	if c.capabilities&capability > 0 || sqlparser.Preview(query) != sqlparser.STMT_CALL {
+		return nil
+	}
+	proc, _ := sqlparser.ParseCall(query)
+	return NewDefaultMySqlError(ER_SP_BADSELECT, proc.Name)
+}
+
+// writeResults writes the chain of results, SERVER_MORE_RESULTS_EXISTS
+// links them and the resultset of the OUT parameters of a CALL keeps
+// SERVER_PS_OUT_PARAMS.
+func (c *Connection) writeResults(result *Result) error {
+	more := c.status & SERVER_MORE_RESULTS_EXISTS
+	defer func() {
+		c.status = c.status&^(SERVER_MORE_RESULTS_EXISTS|SERVER_PS_OUT_PARAMS) | more
+	}()
+	for r := result; r != nil; r = r.Next {
+		c.status &^= SERVER_MORE_RESULTS_EXISTS | SERVER_PS_OUT_PARAMS
+		c.status |= r.Status & SERVER_PS_OUT_PARAMS
+		if r.Next != nil {
+			c.status |= SERVER_MORE_RESULTS_EXISTS
+		} else {
+			c.status |= more
+		}
+		var err error
+		if r.ResultSet != nil {
+			err = c.writeResultSet(r.ResultSet)
+		} else {
+			err = c.writeOK(c.status, r.AffectedRows, r.InsertId)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxExecutionTime is the timeout of the statement: the MAX_EXECUTION_TIME
+// hint, or else the user's, or else the global default.
+func (c *Connection) maxExecutionTime(query string) time.Duration {
+	ms := c.env.Config.MaxExecutionTime
+	if u, ok := c.env.users[c.user]; ok && u.maxExecutionTime > 0 {
+		ms = u.maxExecutionTime
+	}
+	if strings.Contains(query, "/*+") {
+		if h, ok := sqlparser.FindHint(sqlparser.ParseHints(query), "max_execution_time"); ok && len(h.Args) == 1 {
+			if n, err := strconv.Atoi(h.Args[0]); err == nil && n >= 0 {
+				ms = n
+			}
+		}
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// withTimeout kills the statement on the backends once the timeout is
+// exceeded, the backend connections are drained by reading the rest of
+// their responses, so they can go back to the pool. A statement that
+// completes anyway, the kill coming too late, keeps its result.
+func (c *Connection) withTimeout(query string, timeout time.Duration, run func() error) error {
+	if timeout <= 0 {
+		return run()
+	}
+	var mu sync.Mutex
+	done, timedOut := false, false
+	timer := time.AfterFunc(timeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if done {
+			return
+		}
+		timedOut = true
+		c.log.Warn("withTimeout: statement exceeds %s: query=%q", timeout, query)
+		c.killQuery()
+	})
+	err := run()
+	timer.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	done = true
+	if timedOut && err != nil {
+		return NewDefaultMySqlError(ER_QUERY_INTERRUPTED)
+	}
+	return err
+}
+
+// execute runs the statement on every node of the plan and merges the results.
+func (c *Connection) execute(query string, plan *router.Plan) (*Result, error) {
+	conns, err := c.borrowPlan(plan)
+	if err != nil {
+		return nil, err
+	}
+	c.setRunning(conns)
+	defer func() {
+		c.setRunning(nil)
+		c.releaseBackends()
+	}()
+
+	results := make([]*Result, len(conns))
+	errs := make([]error, len(conns))
+	if len(conns) == 1 {
+		results[0], errs[0] = conns[0].Execute(c.env.Router.Rewrite(query, conns[0].Node()))
+	} else {
+		var wg sync.WaitGroup
+		for i, conn := range conns {
+			wg.Add(1)
+			go func(i int, conn BackendConn) {
+				defer wg.Done()
+				results[i], errs[i] = conn.Execute(c.env.Router.Rewrite(query, conn.Node()))
+			}(i, conn)
+		}
+		wg.Wait()
+	}
+	for i, err := range errs {
+		if err != nil {
+			c.log.Debug("execute: node %s fail: err=%s", conns[i].Node(), err)
+			return nil, err
+		}
+	}
+	return mergeResults(results), nil
+}
+
+// mergeResults concatenates the rows, or sums up the affected rows of the
+// shards, forwardQuery refuses the queries that need more than that. A
+// single result is kept as is, with the rest of its chain.
+func mergeResults(results []*Result) *Result {
+	if len(results) == 1 {
+		return results[0]
+	}
+	merged := &Result{Status: results[0].Status}
+	if results[0].ResultSet != nil {
+		merged.ResultSet = &ResultSet{Fields: results[0].Fields}
+	}
+	for _, r := range results {
+		merged.AffectedRows += r.AffectedRows
+		merged.Warnings += r.Warnings
+		if merged.InsertId == 0 {
+			merged.InsertId = r.InsertId
+		}
+		if merged.ResultSet != nil && r.ResultSet != nil {
+			merged.Values = append(merged.Values, r.Values...)
+		}
+	}
+	return merged
+}
+
+// borrowPlan borrows the connections to the nodes of the plan, the logical
+// schema is mapped to the physical database of each node.
+func (c *Connection) borrowPlan(plan *router.Plan) ([]BackendConn, error) {
+	conns := make([]BackendConn, 0, len(plan.Nodes))
+	for _, node := range plan.Nodes {
+		db := c.db
+		if plan.Schema != nil {
+			db = plan.Schema.DB(node)
+		}
+		conn, err := c.borrow(node, db)
+		if err != nil {
+			c.releaseBackends()
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// borrow returns the session's connection to the node, a new one is taken
+// from the pool. It gets the session variables of the session, and the
+// transaction started if one is open.
+func (c *Connection) borrow(node string, db string) (BackendConn, error) {
+	c.backendsMu.Lock()
+	conn, ok := c.backends[node]
+	c.backendsMu.Unlock()
+	if ok {
+		if err := conn.SetVars(c.vars); err != nil {
+			c.log.Warn("borrow: set session variables on node %s fail: err=%s", node, err)
+			return nil, err
+		}
+		if err := conn.UseDB(db); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	conn, err := c.env.Backend.Get(node)
+	if err != nil {
+		c.log.Error("borrow: connect to node %s fail: err=%s", node, err)
+		return nil, err
+	}
+	c.backendsMu.Lock()
+	c.backends[node] = conn
+	c.backendsMu.Unlock()
+	if err := c.prepareBackend(conn, db); err != nil {
+		// a half prepared connection would skip the BEGIN on the next borrow
+		c.log.Warn("borrow: prepare the connection to node %s fail: err=%s", node, err)
+		c.backendsMu.Lock()
+		delete(c.backends, node)
+		c.backendsMu.Unlock()
+		conn.Close()
+		c.env.Backend.Put(conn)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// prepareBackend brings a new connection to the state of the session.
+func (c *Connection) prepareBackend(conn BackendConn, db string) error {
+	if err := conn.SetVars(c.vars); err != nil {
+		return err
+	}
+	if c.nextTransaction != "" {
+		if _, err := conn.Execute(c.nextTransaction); err != nil {
+			return err
+		}
+	}
+	if c.inTransaction() {
+		if _, err := conn.Execute(c.beginQuery); err != nil {
+			return err
+		}
+	}
+	return conn.UseDB(db)
+}
+
+// releaseBackends returns the borrowed connections to the pool, unless
+// they are pinned by an open transaction, or by autocommit=0 which keeps
+// a transaction open on them.
+func (c *Connection) releaseBackends() {
+	if c.inTransaction() || !c.autocommit() {
+		return
+	}
+	c.nextTransaction = ""
+	c.closeBackends()
+}
+
+// closeBackends returns all the borrowed connections, the pool closes those
+// still in a transaction, so it is also the rollback of a closed session.
+func (c *Connection) closeBackends() {
+	c.backendsMu.Lock()
+	defer c.backendsMu.Unlock()
+	for node, conn := range c.backends {
+		c.env.Backend.Put(conn)
+		delete(c.backends, node)
+	}
+}
+
+func (c *Connection) pinnedBackends() []BackendConn {
+	c.backendsMu.Lock()
+	defer c.backendsMu.Unlock()
+	conns := make([]BackendConn, 0, len(c.backends))
+	for _, conn := range c.backends {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (c *Connection) setRunning(conns []BackendConn) {
+	c.backendsMu.Lock()
+	defer c.backendsMu.Unlock()
+	c.running = conns
+}
+
+// killQuery interrupts the statement running on the backends, a connection
+// is closed if the KILL cannot be delivered.
+func (c *Connection) killQuery() {
+	c.backendsMu.Lock()
+	running := c.running
+	c.backendsMu.Unlock()
+	for _, conn := range running {
+		if err := c.env.Backend.Kill(conn.Node(), conn.ThreadId(), true); err != nil {
+			c.log.Warn("killQuery: kill %d on node %s fail: err=%s", conn.ThreadId(), conn.Node(), err)
+			conn.Close()
+		}
+	}
+}
+
+// beginTransaction opens a transaction lazily, the statement is replayed
+// on each backend connection once it gets pinned.
+func (c *Connection) beginTransaction(query string) error {
+	if c.inTransaction() {
+		// like mysql, BEGIN commits the current transaction
+		if err := c.endTransaction("COMMIT"); err != nil {
+			return c.writeError(err)
+		}
+	}
+	c.beginQuery = query
+	c.status |= SERVER_STATUS_IN_TRANS
+	return c.writeOK(c.status, 0, 0)
+}
+
+// endTransaction sends the COMMIT or ROLLBACK to the pinned connections and releases them.
+func (c *Connection) endTransaction(query string) error {
+	var err error
+	for _, conn := range c.pinnedBackends() {
+		if _, e := conn.Execute(query); e != nil && err == nil {
+			c.log.Warn("endTransaction: %s on node %s fail: err=%s", query, conn.Node(), e)
+			err = e
+		}
+	}
+	c.status &^= SERVER_STATUS_IN_TRANS
+	c.beginQuery = ""
+	c.nextTransaction = ""
+	c.closeBackends()
+	return err
+}
+
+func (c *Connection) handleTransaction(query string, typ sqlparser.StmtType) error {
+	if typ == sqlparser.STMT_BEGIN {
+		return c.beginTransaction(query)
+	}
+	s := sqlparser.NewScanner(query)
+	s.Next()
+	s.Accept("work")
+	if typ == sqlparser.STMT_ROLLBACK && s.Accept("to") {
+		// ROLLBACK TO SAVEPOINT keeps the transaction open
+		return c.handleSavepoint(query)
+	}
+	if !c.inTransaction() && c.autocommit() {
+		return c.writeOK(c.status, 0, 0)
+	}
+	if err := c.endTransaction(query); err != nil {
+		return c.writeError(err)
+	}
+	return c.writeOK(c.status, 0, 0)
+}
+
+// handleSavepoint sends SAVEPOINT, ROLLBACK TO and RELEASE SAVEPOINT to the
+// connections pinned by the transaction.
+func (c *Connection) handleSavepoint(query string) error {
+	for _, conn := range c.pinnedBackends() {
+		if _, err := conn.Execute(query); err != nil {
+			return c.writeError(err)
+		}
+	}
+	return c.writeOK(c.status, 0, 0)
+}
@@ -0,0 +1,246 @@
+package mysql
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/config"
+)
+
+// stubConn is a BackendConn that records the statements, every statement
+// returns an OK unless it is in errs or in results.
+type stubConn struct {
+	node     string
+	threadId uint32
+	queries  []string
+	errs     map[string]error
+	results  map[string]*Result
+	fields   []*Field
+	stmt     *PreparedStmt
+	args     [][]byte
+	closed   bool
+}
+
+func (c *stubConn) Node() string     { return c.node }
+func (c *stubConn) ThreadId() uint32 { return c.threadId }
+func (c *stubConn) UseDB(db string) error {
+	return nil
+}
+
+func (c *stubConn) Execute(query string) (*Result, error) {
+	c.queries = append(c.queries, query)
+	if err := c.errs[query]; err != nil {
+		return nil, err
+	}
+	if r, ok := c.results[query]; ok {
+		return r, nil
+	}
+	return &Result{}, nil
+}
+
+func (c *stubConn) Stream(query string, w ResultWriter) error {
+	r, err := c.Execute(query)
+	if err != nil {
+		return err
+	}
+	for ; r != nil; r = r.Next {
+		if r.ResultSet != nil {
+			if err := w.WriteFields(r.Fields); err != nil {
+				return err
+			}
+		}
+		if err := w.WriteResult(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *stubConn) LoadData(query string, r io.Reader) (*Result, error) {
+	return c.Execute(query)
+}
+
+func (c *stubConn) SetVars(vars map[string]string) error {
+	return nil
+}
+
+func (c *stubConn) FieldList(table string, wildcard string) ([]*Field, error) {
+	c.queries = append(c.queries, "FIELD_LIST "+table+" "+wildcard)
+	return c.fields, nil
+}
+
+// Prepare returns stmt, or a statement without parameters, the executions
+// run as "EXECUTE <id>".
+func (c *stubConn) Prepare(query string) (*PreparedStmt, error) {
+	c.queries = append(c.queries, "PREPARE "+query)
+	if c.stmt != nil {
+		return c.stmt, nil
+	}
+	return &PreparedStmt{Id: 1}, nil
+}
+
+func (c *stubConn) StreamExecute(stmt *PreparedStmt, args []byte, w ResultWriter) error {
+	c.args = append(c.args, append([]byte{}, args...))
+	return c.Stream(fmt.Sprintf("EXECUTE %d", stmt.Id), w)
+}
+
+func (c *stubConn) CloseStmt(stmt *PreparedStmt) error {
+	c.queries = append(c.queries, fmt.Sprintf("CLOSE %d", stmt.Id))
+	return nil
+}
+
+func (c *stubConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// stubBackend hands out the prepared conns in order, and new ones after.
+type stubBackend struct {
+	mu     sync.Mutex
+	conns  []*stubConn
+	got    []*stubConn
+	put    []*stubConn
+	kills  []string
+	closed bool
+}
+
+func (b *stubBackend) Get(node string) (BackendConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := &stubConn{}
+	if len(b.conns) > 0 {
+		c, b.conns = b.conns[0], b.conns[1:]
+	}
+	c.node = node
+	c.threadId = uint32(len(b.got) + 1)
+	b.got = append(b.got, c)
+	return c, nil
+}
+
+func (b *stubBackend) Put(conn BackendConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.put = append(b.put, conn.(*stubConn))
+}
+
+func (b *stubBackend) Kill(node string, threadId uint32, query bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.kills = append(b.kills, fmt.Sprintf("%s:%d:%v", node, threadId, query))
+	return nil
+}
+
+func (b *stubBackend) Close() error {
+	b.closed = true
+	return nil
+}
+
+// setupBackendConnection is a connection to the schema db1 on the nodes n0
+// and n1, orders is sharded by user_id.
+func setupBackendConnection(backend *stubBackend) (*Connection, net.Conn) {
+	cfg := config.Default()
+	cfg.Nodes = []config.NodeConfig{{Name: "n0"}, {Name: "n1"}}
+	cfg.Schemas = []config.SchemaConfig{{
+		Name:   "db1",
+		DBs:    map[string]string{"n0": "db1_0", "n1": "db1_1"},
+		Tables: []config.TableConfig{{Name: "orders", Key: "user_id"}},
+	}}
+	env, err := NewEnv(cfg, backend)
+	if err != nil {
+		panic(err)
+	}
+	server, client := net.Pipe()
+	conn := NewConnection(server, env)
+	conn.capabilities &^= CLIENT_SESSION_TRACK | CLIENT_DEPRECATE_EOF
+	conn.db = "db1"
+	return conn, client
+}
+
+func TestBorrowFailure(t *testing.T) {
+	broken := &stubConn{errs: map[string]error{"BEGIN": NewDefaultMySqlError(ER_LOCK_DEADLOCK)}}
+	backend := &stubBackend{conns: []*stubConn{broken}}
+	conn, client := setupBackendConnection(backend)
+	defer client.Close()
+	conn.beginQuery = "BEGIN"
+	conn.status |= SERVER_STATUS_IN_TRANS
+
+	if _, err := conn.borrow("n0", "db1_0"); err == nil {
+		t.Fatalf("expected the error of BEGIN")
+	}
+	if len(conn.pinnedBackends()) != 0 || !broken.closed || len(backend.put) != 1 {
+		t.Fatalf("bad result: %v %v %v, expected the connection discarded", conn.pinnedBackends(), broken.closed, backend.put)
+	}
+	// the next connection gets the transaction started
+	bc, err := conn.borrow("n0", "db1_0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if queries := bc.(*stubConn).queries; len(queries) != 1 || queries[0] != "BEGIN" {
+		t.Fatalf("bad queries: %v, expected: [BEGIN]", queries)
+	}
+}
+
+func TestForwardQueryMerge(t *testing.T) {
+	backend := &stubBackend{}
+	conn, client := setupBackendConnection(backend)
+	defer client.Close()
+	go func() {
+		conn.handleRequestPacket(append([]byte{COM_QUERY}, "SELECT count(*) FROM orders"...))
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// the error is sent before anything runs on the shards
+	if !bytes.Contains(buf, EncodeUint16(ER_NOT_SUPPORTED_YET)) || len(backend.got) != 0 {
+		t.Fatalf("bad result: %q %d, expected ER_NOT_SUPPORTED_YET", buf, len(backend.got))
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	backend := &stubBackend{}
+	conn, client := setupBackendConnection(backend)
+	defer client.Close()
+	slow := func(err error) func() error {
+		return func() error {
+			time.Sleep(20 * time.Millisecond)
+			return err
+		}
+	}
+	// the statement completes before the kill gets to it
+	if err := conn.withTimeout("SELECT 1", time.Millisecond, slow(nil)); err != nil {
+		t.Fatalf("err: %s, expected the result kept", err)
+	}
+	err := conn.withTimeout("SELECT 1", time.Millisecond, slow(io.ErrUnexpectedEOF))
+	if e, ok := err.(*MySqlError); !ok || e.Code != ER_QUERY_INTERRUPTED {
+		t.Fatalf("bad result: %v, expected ER_QUERY_INTERRUPTED", err)
+	}
+}
+
+func TestNewEnvFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hardshard")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := config.Default()
+	cfg.SlowLog.File = filepath.Join(dir, "slow.log")
+	// a directory can't be opened for writing
+	cfg.AuditLog.File = dir
+	backend := &stubBackend{}
+	if _, err := NewEnv(cfg, backend); err == nil {
+		t.Fatalf("expected the error of the audit log")
+	}
+	if backend.closed {
+		t.Fatalf("the backend is closed, it belongs to the caller")
+	}
+}
@@ -1,7 +1,9 @@
 package mysql
 
-//charset key is charset name and value is default collation id
-var CharsetIds = map[string]uint8{
+import "strings"
+
+// charset key is charset name and value is default collation id
+var CharsetIds = map[string]CollationId{
 	"big5":     1,
 	"dec8":     3,
 	"cp850":    4,
@@ -42,9 +44,10 @@ var CharsetIds = map[string]uint8{
 	"geostd8":  92,
 	"cp932":    95,
 	"eucjpms":  97,
+	"gb18030":  248,
 }
 
-//charset key is charset name and value is default collation name
+// charset key is charset name and value is default collation name
 var Charsets = map[string]string{
 	"big5":     "big5_chinese_ci",
 	"dec8":     "dec8_swedish_ci",
@@ -86,9 +89,10 @@ var Charsets = map[string]string{
 	"geostd8":  "geostd8_general_ci",
 	"cp932":    "cp932_japanese_ci",
 	"eucjpms":  "eucjpms_japanese_ci",
+	"gb18030":  "gb18030_chinese_ci",
 }
 
-var Collations = map[uint8]string{
+var Collations = map[CollationId]string{
 	1:   "big5_chinese_ci",
 	2:   "latin2_czech_cs",
 	3:   "dec8_swedish_ci",
@@ -308,9 +312,62 @@ var Collations = map[uint8]string{
 	245: "utf8mb4_croatian_ci",
 	246: "utf8mb4_unicode_520_ci",
 	247: "utf8mb4_vietnamese_ci",
+	// the collations of mysql 8.0, some ids go beyond a byte
+	248: "gb18030_chinese_ci",
+	249: "gb18030_bin",
+	250: "gb18030_unicode_520_ci",
+	255: "utf8mb4_0900_ai_ci",
+	256: "utf8mb4_de_pb_0900_ai_ci",
+	257: "utf8mb4_is_0900_ai_ci",
+	258: "utf8mb4_lv_0900_ai_ci",
+	259: "utf8mb4_ro_0900_ai_ci",
+	260: "utf8mb4_sl_0900_ai_ci",
+	261: "utf8mb4_pl_0900_ai_ci",
+	262: "utf8mb4_et_0900_ai_ci",
+	263: "utf8mb4_es_0900_ai_ci",
+	264: "utf8mb4_sv_0900_ai_ci",
+	265: "utf8mb4_tr_0900_ai_ci",
+	266: "utf8mb4_cs_0900_ai_ci",
+	267: "utf8mb4_da_0900_ai_ci",
+	268: "utf8mb4_lt_0900_ai_ci",
+	269: "utf8mb4_sk_0900_ai_ci",
+	270: "utf8mb4_es_trad_0900_ai_ci",
+	271: "utf8mb4_la_0900_ai_ci",
+	273: "utf8mb4_eo_0900_ai_ci",
+	274: "utf8mb4_hu_0900_ai_ci",
+	275: "utf8mb4_hr_0900_ai_ci",
+	277: "utf8mb4_vi_0900_ai_ci",
+	278: "utf8mb4_0900_as_cs",
+	279: "utf8mb4_de_pb_0900_as_cs",
+	280: "utf8mb4_is_0900_as_cs",
+	281: "utf8mb4_lv_0900_as_cs",
+	282: "utf8mb4_ro_0900_as_cs",
+	283: "utf8mb4_sl_0900_as_cs",
+	284: "utf8mb4_pl_0900_as_cs",
+	285: "utf8mb4_et_0900_as_cs",
+	286: "utf8mb4_es_0900_as_cs",
+	287: "utf8mb4_sv_0900_as_cs",
+	288: "utf8mb4_tr_0900_as_cs",
+	289: "utf8mb4_cs_0900_as_cs",
+	290: "utf8mb4_da_0900_as_cs",
+	291: "utf8mb4_lt_0900_as_cs",
+	292: "utf8mb4_sk_0900_as_cs",
+	293: "utf8mb4_es_trad_0900_as_cs",
+	294: "utf8mb4_la_0900_as_cs",
+	296: "utf8mb4_eo_0900_as_cs",
+	297: "utf8mb4_hu_0900_as_cs",
+	298: "utf8mb4_hr_0900_as_cs",
+	300: "utf8mb4_vi_0900_as_cs",
+	303: "utf8mb4_ja_0900_as_cs",
+	304: "utf8mb4_ja_0900_as_cs_ks",
+	305: "utf8mb4_0900_as_ci",
+	306: "utf8mb4_ru_0900_ai_ci",
+	307: "utf8mb4_ru_0900_as_cs",
+	308: "utf8mb4_zh_0900_as_cs",
+	309: "utf8mb4_0900_bin",
 }
 
-var CollationNames = map[string]uint8{
+var CollationNames = map[string]CollationId{
 	"big5_chinese_ci":          1,
 	"latin2_czech_cs":          2,
 	"dec8_swedish_ci":          3,
@@ -530,10 +587,94 @@ var CollationNames = map[string]uint8{
 	"utf8mb4_croatian_ci":      245,
 	"utf8mb4_unicode_520_ci":   246,
 	"utf8mb4_vietnamese_ci":    247,
+	// the collations of mysql 8.0
+	"gb18030_chinese_ci":         248,
+	"gb18030_bin":                249,
+	"gb18030_unicode_520_ci":     250,
+	"utf8mb4_0900_ai_ci":         255,
+	"utf8mb4_de_pb_0900_ai_ci":   256,
+	"utf8mb4_is_0900_ai_ci":      257,
+	"utf8mb4_lv_0900_ai_ci":      258,
+	"utf8mb4_ro_0900_ai_ci":      259,
+	"utf8mb4_sl_0900_ai_ci":      260,
+	"utf8mb4_pl_0900_ai_ci":      261,
+	"utf8mb4_et_0900_ai_ci":      262,
+	"utf8mb4_es_0900_ai_ci":      263,
+	"utf8mb4_sv_0900_ai_ci":      264,
+	"utf8mb4_tr_0900_ai_ci":      265,
+	"utf8mb4_cs_0900_ai_ci":      266,
+	"utf8mb4_da_0900_ai_ci":      267,
+	"utf8mb4_lt_0900_ai_ci":      268,
+	"utf8mb4_sk_0900_ai_ci":      269,
+	"utf8mb4_es_trad_0900_ai_ci": 270,
+	"utf8mb4_la_0900_ai_ci":      271,
+	"utf8mb4_eo_0900_ai_ci":      273,
+	"utf8mb4_hu_0900_ai_ci":      274,
+	"utf8mb4_hr_0900_ai_ci":      275,
+	"utf8mb4_vi_0900_ai_ci":      277,
+	"utf8mb4_0900_as_cs":         278,
+	"utf8mb4_de_pb_0900_as_cs":   279,
+	"utf8mb4_is_0900_as_cs":      280,
+	"utf8mb4_lv_0900_as_cs":      281,
+	"utf8mb4_ro_0900_as_cs":      282,
+	"utf8mb4_sl_0900_as_cs":      283,
+	"utf8mb4_pl_0900_as_cs":      284,
+	"utf8mb4_et_0900_as_cs":      285,
+	"utf8mb4_es_0900_as_cs":      286,
+	"utf8mb4_sv_0900_as_cs":      287,
+	"utf8mb4_tr_0900_as_cs":      288,
+	"utf8mb4_cs_0900_as_cs":      289,
+	"utf8mb4_da_0900_as_cs":      290,
+	"utf8mb4_lt_0900_as_cs":      291,
+	"utf8mb4_sk_0900_as_cs":      292,
+	"utf8mb4_es_trad_0900_as_cs": 293,
+	"utf8mb4_la_0900_as_cs":      294,
+	"utf8mb4_eo_0900_as_cs":      296,
+	"utf8mb4_hu_0900_as_cs":      297,
+	"utf8mb4_hr_0900_as_cs":      298,
+	"utf8mb4_vi_0900_as_cs":      300,
+	"utf8mb4_ja_0900_as_cs":      303,
+	"utf8mb4_ja_0900_as_cs_ks":   304,
+	"utf8mb4_0900_as_ci":         305,
+	"utf8mb4_ru_0900_ai_ci":      306,
+	"utf8mb4_ru_0900_as_cs":      307,
+	"utf8mb4_zh_0900_as_cs":      308,
+	"utf8mb4_0900_bin":           309,
 }
 
+// CollationId is the id of a collation, the ids of mysql 8.0 go beyond a
+// byte while the handshake only carries one, see HandshakeCharset.
+type CollationId uint16
+
 const (
-	DEFAULT_CHARSET               = "utf8"
-	DEFAULT_COLLATION_ID   uint8  = 33
-	DEFAULT_COLLATION_NAME string = "utf8_general_ci"
+	DEFAULT_CHARSET                    = "utf8mb4"
+	DEFAULT_COLLATION_ID   CollationId = 45
+	DEFAULT_COLLATION_NAME string      = "utf8mb4_general_ci"
+	BINARY_COLLATION_ID    CollationId = 63
 )
+
+// CollationCharset returns the charset of the collation, the prefix of its name.
+func CollationCharset(collation string) string {
+	if i := strings.IndexByte(collation, '_'); i > 0 {
+		return collation[:i]
+	}
+	return collation
+}
+
+// NamesValue is the SET NAMES value of the collation, like "utf8mb4 COLLATE utf8mb4_general_ci".
+func NamesValue(id CollationId) string {
+	name, ok := Collations[id]
+	if !ok {
+		name = DEFAULT_COLLATION_NAME
+	}
+	return CollationCharset(name) + " COLLATE " + name
+}
+
+// HandshakeCharset is the charset byte of the handshake for the collation,
+// a collation beyond a byte is replaced by the default one of its charset.
+func HandshakeCharset(id CollationId) byte {
+	if id > 0xff {
+		id = CharsetIds[CollationCharset(Collations[id])]
+	}
+	return byte(id)
+}
@@ -0,0 +1,54 @@
+package mysql
+
+// The utility commands of the text protocol.
+// https://dev.mysql.com/doc/internals/en/text-protocol.html
+
+import (
+	"encoding/binary"
+)
+
+// handleQuit closes the connection without a response.
+// https://dev.mysql.com/doc/internals/en/com-quit.html
+func (c *Connection) handleQuit() error {
+	return c.Close()
+}
+
+// handleStatistics answers with a human readable string instead of an OK.
+// https://dev.mysql.com/doc/internals/en/com-statistics.html
+func (c *Connection) handleStatistics() error {
+	return c.writePacket([]byte(c.env.statistics()))
+}
+
+// handleDebug dumps the state of the proxy to the log, it needs the SUPER
+// privilege like mysql.
+// https://dev.mysql.com/doc/internals/en/com-debug.html
+func (c *Connection) handleDebug() error {
+	if !c.isAdmin() {
+		return c.writeError(NewDefaultMySqlError(ER_SPECIFIC_ACCESS_DENIED_ERROR, "SUPER"))
+	}
+	c.log.Info("handleDebug: %s", c.env.statistics())
+	for _, conn := range c.env.connections() {
+		p := conn.processInfo()
+		c.log.Info("handleDebug: conn_id=%d user=%s db=%s command=%s state=%q backends=%s",
+			conn.connectionId, p.user, p.db, commandNames[p.command], p.state, conn.backendThreads())
+	}
+	return c.writeEOF(0, c.status)
+}
+
+// handleSetOption switches the multi-statements of the session, it's
+// answered with an EOF like mysql.
+// https://dev.mysql.com/doc/internals/en/com-set-option.html
+func (c *Connection) handleSetOption(body []byte) error {
+	if len(body) < 2 {
+		return c.writeError(NewDefaultMySqlError(ER_MALFORMED_PACKET))
+	}
+	switch binary.LittleEndian.Uint16(body) {
+	case MYSQL_OPTION_MULTI_STATEMENTS_ON:
+		c.capabilities |= CLIENT_MULTI_STATEMENTS
+	case MYSQL_OPTION_MULTI_STATEMENTS_OFF:
+		c.capabilities &^= CLIENT_MULTI_STATEMENTS
+	default:
+		return c.writeError(NewDefaultMySqlError(ER_UNKNOWN_COM_ERROR))
+	}
+	return c.writeEOF(0, c.status)
+}
@@ -0,0 +1,342 @@
+package mysql
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/config"
+)
+
+func errorPacket(code uint16) []byte {
+	m := NewDefaultMySqlError(code)
+	payload := []byte{ERR_HEADER}
+	payload = append(payload, EncodeUint16(m.Code)...)
+	payload = append(payload, '#')
+	payload = append(payload, m.State...)
+	payload = append(payload, m.Message...)
+	return append([]byte{byte(len(payload)), 0, 0, 0}, payload...)
+}
+
+func TestComQuit(t *testing.T) {
+	conn, client := setupConnnection()
+	defer client.Close()
+	// nothing is written, so it does not block on the pipe
+	if err := conn.handleRequestPacket([]byte{COM_QUIT}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(buf) != 0 {
+		t.Fatalf("bad result: %v, expected: %v", buf, []byte{})
+	}
+	if !conn.isClosed {
+		t.Fatalf("bad result: %v, expected: %v", conn.isClosed, true)
+	}
+}
+
+func TestComPing(t *testing.T) {
+	conn, client := setupConnnection()
+	defer client.Close()
+	go func() {
+		conn.handleRequestPacket([]byte{COM_PING})
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expectedBuf := []byte{7, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0}
+	if !bytes.Equal(buf, expectedBuf) {
+		t.Fatalf("bad result: %v, expected: %v", buf, expectedBuf)
+	}
+}
+
+func TestComStatistics(t *testing.T) {
+	conn, client := setupConnnection()
+	defer client.Close()
+	go func() {
+		conn.handleRequestPacket([]byte{COM_STATISTICS})
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(buf) < 4 || int(buf[0]) != len(buf)-4 || !bytes.HasPrefix(buf[4:], []byte("Uptime: ")) {
+		t.Fatalf("bad result: %q", buf)
+	}
+	if !bytes.Contains(buf, []byte("Threads: ")) || !bytes.Contains(buf, []byte("Queries per second avg: ")) {
+		t.Fatalf("bad result: %q", buf)
+	}
+}
+
+func TestComDebug(t *testing.T) {
+	conn, client := setupConnnection()
+	defer client.Close()
+	go func() {
+		conn.handleRequestPacket([]byte{COM_DEBUG})
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(buf) < 7 || buf[4] != ERR_HEADER || buf[5] != 0xcb || buf[6] != 0x04 {
+		t.Fatalf("bad result: %v, expected the error 1227", buf)
+	}
+
+	conn, client = setupConnnection()
+	defer client.Close()
+	conn.user = "root"
+	conn.env.Config.Admin.Users = []string{"root"}
+	go func() {
+		conn.handleRequestPacket([]byte{COM_DEBUG})
+		conn.Close()
+	}()
+	buf, err = ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expectedBuf := []byte{5, 0, 0, 0, 254, 0, 0, 2, 0}
+	if !bytes.Equal(buf, expectedBuf) {
+		t.Fatalf("bad result: %v, expected: %v", buf, expectedBuf)
+	}
+}
+
+func TestComStmtClose(t *testing.T) {
+	conn, client := setupConnnection()
+	defer client.Close()
+	go func() {
+		conn.handleRequestPacket([]byte{COM_STMT_CLOSE, 1, 0, 0, 0})
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(buf) != 0 {
+		t.Fatalf("bad result: %v, expected: %v", buf, []byte{})
+	}
+}
+
+func TestUnknownCommands(t *testing.T) {
+	commands := [][]byte{
+		{},
+		{COM_SLEEP},
+		{COM_TIME},
+		{COM_CONNECT},
+		{COM_DELAYED_INSERT},
+		{COM_BINLOG_DUMP, 4, 0, 0, 0, 0, 0, 1, 0, 0, 0},
+		{COM_REGISTER_SLAVE, 1, 0, 0, 0},
+		{COM_TABLE_DUMP},
+		{COM_DAEMON},
+		{COM_BINLOG_DUMP_GTID},
+		{0xee},
+	}
+	expectedBuf := errorPacket(ER_UNKNOWN_COM_ERROR)
+	for _, payload := range commands {
+		conn, client := setupConnnection()
+		go func() {
+			conn.handleRequestPacket(payload)
+			conn.Close()
+		}()
+		buf, err := ioutil.ReadAll(client)
+		client.Close()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !bytes.Equal(buf, expectedBuf) {
+			t.Fatalf("command %v: bad result: %v, expected: %v", payload, buf, expectedBuf)
+		}
+	}
+}
+
+func changeUserPacket(user string, authData []byte, db string) []byte {
+	payload := []byte{COM_CHANGE_USER}
+	payload = append(payload, user...)
+	payload = append(payload, 0, byte(len(authData)))
+	payload = append(payload, authData...)
+	payload = append(payload, db...)
+	payload = append(payload, 0)
+	payload = append(payload, EncodeUint16(uint16(DEFAULT_COLLATION_ID))...)
+	payload = append(payload, AUTH_NAME...)
+	return append(payload, 0)
+}
+
+func TestComChangeUser(t *testing.T) {
+	cfg := config.Default()
+	cfg.Users = []config.UserConfig{{Name: "app", Password: "secret"}, {Name: "ops", Password: "secret2"}}
+	env, err := NewEnv(cfg, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewConnection(server, env)
+	conn.capabilities &^= CLIENT_SESSION_TRACK | CLIENT_DEPRECATE_EOF
+	env.admitUser(conn, "app")
+	conn.status |= SERVER_STATUS_IN_TRANS
+	conn.beginQuery = "BEGIN"
+
+	payload := changeUserPacket("ops", ScramblePassword(conn.salt, []byte("secret2")), "db2")
+	go func() {
+		conn.handleRequestPacket(payload)
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expectedBuf := []byte{7, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0}
+	if !bytes.Equal(buf, expectedBuf) {
+		t.Fatalf("bad result: %v, expected: %v", buf, expectedBuf)
+	}
+	if conn.user != "ops" || conn.db != "db2" || conn.beginQuery != "" {
+		t.Fatalf("bad result: user=%s db=%s begin=%s, expected: user=ops db=db2 begin=", conn.user, conn.db, conn.beginQuery)
+	}
+	_, users := env.connectionCounts()
+	if users["app"] != 0 || users["ops"] != 1 {
+		t.Fatalf("bad result: %v, expected: map[app:0 ops:1]", users)
+	}
+
+	server, client = net.Pipe()
+	defer client.Close()
+	conn = NewConnection(server, env)
+	payload = changeUserPacket("ops", ScramblePassword(conn.salt, []byte("bad")), "")
+	go conn.handleRequestPacket(payload)
+	buf, err = ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(buf) < 7 || buf[4] != ERR_HEADER || buf[5] != 0x15 || buf[6] != 0x04 {
+		t.Fatalf("bad result: %v, expected the error 1045", buf)
+	}
+}
+
+func TestComChangeUserMalformed(t *testing.T) {
+	// the auth response is longer than the packet
+	conn, client := setupConnnection()
+	defer client.Close()
+	go conn.handleRequestPacket(append([]byte{COM_CHANGE_USER}, "ops\x00\x14abc"...))
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(buf, errorPacket(ER_MALFORMED_PACKET)) {
+		t.Fatalf("bad result: %v, expected the error %d", buf, ER_MALFORMED_PACKET)
+	}
+
+	// the auth switch response is out of sequence
+	conn, client = setupConnnection()
+	defer client.Close()
+	payload := changeUserPacket("ops", nil, "")
+	payload = append(payload[:len(payload)-len(AUTH_NAME)-1], "caching_sha2_password\x00"...)
+	go conn.handleRequestPacket(payload)
+	pio := NewPacketIO(client, client)
+	if switchRequest, err := pio.ReadPacket(); err != nil || switchRequest[0] != EOF_HEADER {
+		t.Fatalf("bad result: %v %v, expected the auth switch request", switchRequest, err)
+	}
+	client.Write([]byte{1, 0, 0, pio.Sequence + 1, 0})
+	buf, err = ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(buf) < 7 || buf[4] != ERR_HEADER || !bytes.Equal(buf[5:7], EncodeUint16(ER_MALFORMED_PACKET)) {
+		t.Fatalf("bad result: %v, expected the error %d", buf, ER_MALFORMED_PACKET)
+	}
+}
+
+func TestComResetConnection(t *testing.T) {
+	conn, client := setupConnnection()
+	defer client.Close()
+	conn.db = "db1"
+	conn.status |= SERVER_STATUS_IN_TRANS
+	conn.beginQuery = "BEGIN"
+	conn.longQueryTime = 0
+	go func() {
+		conn.handleRequestPacket([]byte{COM_RESET_CONNECTION})
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expectedBuf := []byte{7, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0}
+	if !bytes.Equal(buf, expectedBuf) {
+		t.Fatalf("bad result: %v, expected: %v", buf, expectedBuf)
+	}
+	if conn.db != "db1" || conn.beginQuery != "" || conn.longQueryTime != time.Second {
+		t.Fatalf("bad result: db=%s begin=%s long_query_time=%s", conn.db, conn.beginQuery, conn.longQueryTime)
+	}
+}
+
+func TestComSetOption(t *testing.T) {
+	conn, client := setupConnnection()
+	defer client.Close()
+	go func() {
+		conn.handleRequestPacket([]byte{COM_SET_OPTION, 1, 0})
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expectedBuf := []byte{5, 0, 0, 0, 254, 0, 0, 2, 0}
+	if !bytes.Equal(buf, expectedBuf) {
+		t.Fatalf("bad result: %v, expected: %v", buf, expectedBuf)
+	}
+	if conn.capabilities&CLIENT_MULTI_STATEMENTS != 0 {
+		t.Fatalf("bad result: %d, expected multi-statements off", conn.capabilities)
+	}
+}
+
+func TestMultiStatements(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected []byte
+	}{
+		{
+			"SET autocommit = 0; SET sql_mode = ''; USE db1",
+			[]byte{
+				7, 0, 0, 0, 0, 0, 0, 8, 0, 0, 0,
+				7, 0, 0, 1, 0, 0, 0, 8, 0, 0, 0,
+				7, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0,
+			},
+		},
+		{
+			// the second statement is skipped
+			"SET autocommit = 2; SET sql_mode = ''",
+			nil,
+		},
+	}
+	for _, c := range cases {
+		conn, client := setupConnnection()
+		conn.capabilities |= CLIENT_MULTI_STATEMENTS
+		go func() {
+			conn.handleRequestPacket(append([]byte{COM_QUERY}, c.query...))
+			conn.Close()
+		}()
+		buf, err := ioutil.ReadAll(client)
+		client.Close()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if c.expected == nil {
+			if len(buf) < 7 || buf[4] != ERR_HEADER || buf[5] != 0xcf || buf[6] != 0x04 || int(buf[0])+4 != len(buf) {
+				t.Fatalf("%s: bad result: %v, expected the error 1231 only", c.query, buf)
+			}
+			if _, ok := conn.vars["sql_mode"]; ok {
+				t.Fatalf("%s: bad result: %v, expected no sql_mode", c.query, conn.vars)
+			}
+			continue
+		}
+		if !bytes.Equal(buf, c.expected) {
+			t.Fatalf("%s: bad result: %v, expected: %v", c.query, buf, c.expected)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package mysql
+
+// The compressed protocol wraps the packets into compressed packets, which
+// have a sequence of their own. A compressed packet carries a part of the
+// stream of the packets, it may hold several packets, or a part of one.
+// https://dev.mysql.com/doc/internals/en/compressed-packet-header.html
+//
+// The packets are not compressed one by one, the writes are buffered and
+// sent on Flush, or once the buffer grows over COMPRESS_BUFFER_SIZE, like
+// the net buffer of mysql.
+//
+// The payloads are zlib streams with CLIENT_COMPRESS, or zstd frames with
+// the CLIENT_ZSTD_COMPRESSION_ALGORITHM of mysql 8.0.18, whose level is
+// told by the handshake response. The zstd encoders and decoder are shared
+// by the connections.
+// https://dev.mysql.com/doc/refman/8.0/en/connection-compression-control.html
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	COMPRESSED_HEADER_SIZE = 7
+	// MIN_COMPRESS_LENGTH is the payload size below which mysql sends it uncompressed
+	MIN_COMPRESS_LENGTH = 50
+	// COMPRESS_BUFFER_SIZE is the default net_buffer_length of mysql
+	COMPRESS_BUFFER_SIZE = 16 * 1024
+	// DEFAULT_ZSTD_LEVEL is the default zstd_compression_level of mysql,
+	// the levels go from MIN_ZSTD_LEVEL to MAX_ZSTD_LEVEL
+	DEFAULT_ZSTD_LEVEL = 3
+	MIN_ZSTD_LEVEL     = 1
+	MAX_ZSTD_LEVEL     = 22
+)
+
+var (
+	zstdOnce     sync.Once
+	zstdDecoder  *zstd.Decoder
+	zstdEncoders map[zstd.EncoderLevel]*zstd.Encoder
+)
+
+// zstdEncoder returns the shared encoder of the level of mysql, the levels
+// of mysql are mapped to the few of the encoder. The first call sets up
+// the decoder too.
+func zstdEncoder(level int) *zstd.Encoder {
+	zstdOnce.Do(func() {
+		var err error
+		// an uncompressed length holds 3 bytes
+		if zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MAX_PACKET_PAYLOAD_LENGTH)); err != nil {
+			panic(err)
+		}
+		zstdEncoders = map[zstd.EncoderLevel]*zstd.Encoder{}
+		for l := zstd.SpeedFastest; l <= zstd.SpeedBestCompression; l++ {
+			if zstdEncoders[l], err = zstd.NewWriter(nil, zstd.WithEncoderLevel(l)); err != nil {
+				panic(err)
+			}
+		}
+	})
+	return zstdEncoders[zstd.EncoderLevelFromZstd(level)]
+}
+
+type compressedIO struct {
+	r        io.Reader
+	w        io.Writer
+	Sequence uint8
+
+	// rbuf is the uncompressed data of the last compressed packet not
+	// read yet, and wbuf the written data not sent yet
+	rbuf []byte
+	wbuf []byte
+	zr   io.ReadCloser
+	zw   *zlib.Writer
+	zbuf bytes.Buffer
+	// zstd is set for zstd in place of zlib, zdata is the compressed data
+	// of the last write
+	zstd  *zstd.Encoder
+	zdata []byte
+	// maxLength limits the payload of a compressed packet and its
+	// uncompressed data, 0 for no limit
+	maxLength int
+
+	// the buffers reused by the reads, rbuf is a part of one of them
+	header  [COMPRESSED_HEADER_SIZE]byte
+	packet  []byte
+	data    []byte
+	zreader bytes.Reader
+}
+
+func newCompressedIO(r io.Reader, w io.Writer) *compressedIO {
+	return &compressedIO{r: r, w: w}
+}
+
+func (c *compressedIO) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		if err := c.readCompressedPacket(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// readCompressedPacket reads the next compressed packet into rbuf.
+func (c *compressedIO) readCompressedPacket() error {
+	// [compressed length: byte[3]][sequence: byte[1]][uncompressed length: byte[3]]
+	header := c.header[:]
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	// like mysql and mariadb, the sequence is not checked, they do not
+	// always agree on it
+	c.Sequence = header[3] + 1
+	uncompressedLength := int(header[4]) | int(header[5])<<8 | int(header[6])<<16
+	// checked before anything is allocated, like the packets of ReadPacket
+	if c.maxLength > 0 && (length > c.maxLength || uncompressedLength > c.maxLength) {
+		return ErrPacketTooLarge
+	}
+
+	c.packet = resize(c.packet, length)
+	payload := c.packet
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+	// an uncompressed length of 0 means that the payload is not compressed
+	if uncompressedLength == 0 {
+		c.rbuf = payload
+		return nil
+	}
+	if c.zstd != nil {
+		data, err := zstdDecoder.DecodeAll(payload, resize(c.data, uncompressedLength)[:0])
+		if err != nil {
+			return fmt.Errorf("uncompress packet: %s", err)
+		}
+		if len(data) != uncompressedLength {
+			return fmt.Errorf("uncompress packet: %d bytes, expected %d", len(data), uncompressedLength)
+		}
+		c.data, c.rbuf = data, data
+		return nil
+	}
+	var err error
+	c.zreader.Reset(payload)
+	if c.zr == nil {
+		c.zr, err = zlib.NewReader(&c.zreader)
+	} else {
+		err = c.zr.(zlib.Resetter).Reset(&c.zreader, nil)
+	}
+	if err != nil {
+		return err
+	}
+	c.data = resize(c.data, uncompressedLength)
+	c.rbuf = c.data
+	if _, err := io.ReadFull(c.zr, c.rbuf); err != nil {
+		return fmt.Errorf("uncompress packet: %s", err)
+	}
+	return nil
+}
+
+func (c *compressedIO) Write(p []byte) (int, error) {
+	c.wbuf = append(c.wbuf, p...)
+	if len(c.wbuf) >= COMPRESS_BUFFER_SIZE {
+		if err := c.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends the buffered data in compressed packets.
+func (c *compressedIO) Flush() error {
+	for start := 0; start < len(c.wbuf); start += MAX_PACKET_PAYLOAD_LENGTH {
+		end := start + MAX_PACKET_PAYLOAD_LENGTH
+		if end > len(c.wbuf) {
+			end = len(c.wbuf)
+		}
+		if err := c.writeCompressedPacket(c.wbuf[start:end]); err != nil {
+			return err
+		}
+	}
+	c.wbuf = c.wbuf[:0]
+	return nil
+}
+
+func (c *compressedIO) writeCompressedPacket(data []byte) error {
+	payload, uncompressedLength := data, 0
+	if len(data) >= MIN_COMPRESS_LENGTH {
+		compressed, err := c.compress(data)
+		if err != nil {
+			return err
+		}
+		// the data which does not shrink is sent as is
+		if len(compressed) < len(data) {
+			payload, uncompressedLength = compressed, len(data)
+		}
+	}
+	length := len(payload)
+	header := c.header[:]
+	header[0], header[1], header[2], header[3] = byte(length), byte(length>>8), byte(length>>16), c.Sequence
+	header[4], header[5], header[6] = byte(uncompressedLength), byte(uncompressedLength>>8), byte(uncompressedLength>>16)
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(payload); err != nil {
+		return err
+	}
+	c.Sequence++
+	return nil
+}
+
+// compress returns the data compressed into a buffer reused by the next
+// call.
+func (c *compressedIO) compress(data []byte) ([]byte, error) {
+	if c.zstd != nil {
+		c.zdata = c.zstd.EncodeAll(data, resize(c.zdata, 0))
+		return c.zdata, nil
+	}
+	c.zbuf.Reset()
+	if c.zw == nil {
+		c.zw = zlib.NewWriter(&c.zbuf)
+	} else {
+		c.zw.Reset(&c.zbuf)
+	}
+	if _, err := c.zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := c.zw.Close(); err != nil {
+		return nil, err
+	}
+	return c.zbuf.Bytes(), nil
+}
+
+// resize returns buf with n bytes, it is reallocated only if it is too
+// small. Like the payload of PacketIO, a large one is not kept.
+func resize(buf []byte, n int) []byte {
+	if n > cap(buf) || cap(buf) > MAX_POOLED_PAYLOAD_SIZE {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
@@ -1,20 +1,24 @@
 package mysql
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/siddontang/go-log/log"
+	"github.com/Fleurer/hardshard/pkg/log"
 )
 
 var connectionIdCounter uint32 = 10000
 
-var DEFAULT_CAPABILITIES uint32 = CLIENT_PLUGIN_AUTH | CLIENT_SECURE_CONNECTION | CLIENT_CONNECT_WITH_DB | CLIENT_CONNECT_ATTRS | CLIENT_PROTOCOL_41
-
-const debug = true
+var DEFAULT_CAPABILITIES uint32 = CLIENT_PLUGIN_AUTH | CLIENT_SECURE_CONNECTION | CLIENT_CONNECT_WITH_DB | CLIENT_CONNECT_ATTRS | CLIENT_PROTOCOL_41 |
+	CLIENT_MULTI_STATEMENTS | CLIENT_MULTI_RESULTS | CLIENT_PS_MULTI_RESULTS | CLIENT_SESSION_TRACK | CLIENT_DEPRECATE_EOF | CLIENT_LOCAL_FILES |
+	CLIENT_COMPRESS | CLIENT_ZSTD_COMPRESSION_ALGORITHM
 
 type Connection struct {
 	conn         net.Conn
@@ -24,45 +28,99 @@ type Connection struct {
 	capabilities uint32
 	status       uint16
 	salt         []byte
-	collationId  uint8
+	collationId  CollationId
+	env          *Env
+	log          *log.Logger
+	// trace is set by the admin to dump the packets of this connection
+	trace int32
+
+	user  string
+	db    string
+	attrs map[string]string
+	// userAdmitted is set once the connection is counted for the user
+	userAdmitted bool
+
+	// the collation of the handshake, COM_RESET_CONNECTION goes back to it
+	handshakeCollationId CollationId
+
+	// stateChanges are the session state changes for the next OK packet, and
+	// trackedInTrans is the transaction state last told to the client, if it
+	// negotiated CLIENT_SESSION_TRACK
+	stateChanges   []byte
+	trackedInTrans bool
+
+	// session scoped long_query_time of the slow log
+	longQueryTime time.Duration
+	stats         queryStats
+
+	// backends are the connections borrowed by the session by node, they
+	// stay pinned while a transaction is open, and running are those
+	// executing the current statement
+	backendsMu sync.Mutex
+	backends   map[string]BackendConn
+	running    []BackendConn
+	// beginQuery opened the transaction, it is replayed on the pinned connections
+	beginQuery string
+	// vars are the session variables of SET_KEY_WORDS, and nextTransaction
+	// is the SET TRANSACTION of the next transaction, both are replayed on
+	// the borrowed connections
+	vars            map[string]string
+	nextTransaction string
+
+	// stmts are the prepared statements by id
+	stmts      map[uint32]*proxyStmt
+	lastStmtId uint32
+
+	procMu  sync.Mutex
+	process processInfo
 }
 
 type handkshakeResponse struct {
 	capabilities   uint32
-	charset        byte
+	charset        CollationId
 	maxPacketSize  uint32
 	user           []byte
 	authData       []byte
 	db             []byte
 	authPluginName []byte
 	attrs          map[string]string
+	zstdLevel      int
 }
 
 func (h handkshakeResponse) String() string {
-	return fmt.Sprintf("handshakeResponse[capabilities: %d, charset: %d, user: %s, authData: %v, db: %s, authPluginName: %s, attrs: %v]",
-		h.capabilities, h.charset, h.user, h.authData, h.db, h.authPluginName, h.attrs)
+	// the auth data is a scramble of the password, never print it
+	return fmt.Sprintf("handshakeResponse[capabilities: %d, charset: %d, maxPacketSize: %d, user: %s, authData: <%d bytes>, db: %s, authPluginName: %s, attrs: %v, zstdLevel: %d]",
+		h.capabilities, h.charset, h.maxPacketSize, h.user, len(h.authData), h.db, h.authPluginName, h.attrs, h.zstdLevel)
 }
 
-func NewConnection(conn net.Conn) *Connection {
+func NewConnection(conn net.Conn, env *Env) *Connection {
 	c := &Connection{
 		conn:         conn,
 		packetIO:     NewPacketIOByConn(conn),
 		isClosed:     false,
 		connectionId: atomic.AddUint32(&connectionIdCounter, 1),
-		capabilities: DEFAULT_CAPABILITIES,
+		capabilities: env.capabilities,
 		status:       SERVER_STATUS_AUTOCOMMIT,
-		salt:         GenerateRandBuf(20),
-		collationId:  DEFAULT_COLLATION_ID,
-	}
-	if debug {
-		c.salt = []byte("salt1salt2salt3salt4")
+		salt:         GenerateSalt(20),
+		collationId:  env.collationId,
+		env:          env,
+		backends:     map[string]BackendConn{},
+		vars:         map[string]string{},
+		stmts:        map[uint32]*proxyStmt{},
 	}
+	c.packetIO.MaxPacketSize = env.maxAllowedPacket
+	c.longQueryTime = time.Duration(env.Config.SlowLog.LongQueryTime * float64(time.Second))
+	c.log = log.With("conn_id", c.connectionId, "remote", conn.RemoteAddr())
+	c.SetTrace(env.Config.Log.Trace)
+	c.setCollation(env.collationId)
+	c.setProcess(COM_CONNECT, "login", "")
 	return c
 }
 
 func (c *Connection) Run() {
 	defer func() {
 		c.Close()
+		c.packetIO.Release()
 	}()
 	if err := c.handshake(); err != nil {
 		c.writeError(err)
@@ -73,20 +131,54 @@ func (c *Connection) Run() {
 
 func (c *Connection) handshake() error {
 	if err := c.writeInitialHandshake(); err != nil {
-		log.Error("handshake: writeInitialHandshake fail: err=%s", err)
+		c.log.Error("handshake: writeInitialHandshake fail: err=%s", err)
 		return err
 	}
 	handshake, err := c.readHandshakeResponse()
-	// TODO: aut
-	fmt.Printf("handshake: %s\n", handshake)
 	if err != nil {
-		log.Error("handshake: readHandshakeResponse fail: err=%s", err)
+		c.log.Error("handshake: readHandshakeResponse fail: err=%s", err)
+		return err
+	}
+	if c.tracing() {
+		c.log.Trace("handshake: %s", handshake)
+	}
+	// the features are on if both sides support them
+	c.capabilities &= handshake.capabilities
+	authData, err := c.readAuthData(handshake)
+	if err != nil {
+		c.log.Error("handshake: readAuthData fail: err=%s", err)
+		return err
+	}
+	user := strings.TrimRight(string(handshake.user), "\x00")
+	if err := c.authenticate(user, authData); err != nil {
+		c.log.Warn("handshake: authenticate fail: user=%s err=%s", user, err)
+		return err
+	}
+	if err := c.env.admitUser(c, user); err != nil {
+		c.log.Warn("handshake: admitUser fail: user=%s err=%s", user, err)
+		return err
+	}
+	db := strings.TrimRight(string(handshake.db), "\x00")
+	if err := c.checkDB(db); err != nil {
+		c.log.Warn("handshake: checkDB fail: db=%s err=%s", db, err)
 		return err
 	}
+	c.db = db
+	c.attrs = handshake.attrs
+	c.setCollation(handshake.charset)
+	c.handshakeCollationId = c.collationId
+	c.log = c.log.With("user", c.user)
+	c.setProcess(COM_SLEEP, "", "")
 	if err := c.writeOK(0, 0, 0); err != nil {
-		log.Error("handshake: writeOK fail: err=%s", err)
+		c.log.Error("handshake: writeOK fail: err=%s", err)
 		return err
 	}
+	// like mysql, zlib wins if the client asks for both
+	if c.capabilities&CLIENT_COMPRESS > 0 {
+		c.packetIO.EnableCompression()
+	} else if c.capabilities&CLIENT_ZSTD_COMPRESSION_ALGORITHM > 0 {
+		c.packetIO.EnableZstdCompression(handshake.zstdLevel)
+	}
 	return nil
 }
 
@@ -95,13 +187,25 @@ func (c *Connection) loop() {
 		c.packetIO.ResetSequence()
 		payload, err := c.packetIO.ReadPacket()
 		if err != nil {
-			log.Warn("connection.Run() readPacket error=%s", err.Error())
+			c.log.Warn("connection.Run() readPacket error=%s", err.Error())
+			if err == ErrPacketTooLarge {
+				// like mysql, the client is told before the connection is closed
+				c.writeError(err)
+			}
 			return
 		}
+		if c.tracing() {
+			if len(payload) > 0 && payload[0] == COM_CHANGE_USER {
+				c.traceRedacted("read", c.packetIO.Sequence-1, len(payload))
+			} else {
+				c.log.Trace("read packet: seq=%d len=%d\n%s", c.packetIO.Sequence-1, len(payload), hex.Dump(payload))
+			}
+		}
 
 		err = c.handleRequestPacket(payload)
+		c.setProcess(COM_SLEEP, "", "")
 		if err != nil {
-			log.Warn("handleRequestPacket error=%s", err.Error())
+			c.log.Warn("handleRequestPacket error=%s", err.Error())
 			// c.packetio.WriteErrorPacket(err)
 		}
 
@@ -116,57 +220,119 @@ func (c *Connection) Close() error {
 		return nil
 	}
 
+	// the last packets may be held by the compressed protocol
+	c.packetIO.Flush()
 	err := c.conn.Close()
 	if err != nil {
 		return err
 	}
 
 	c.isClosed = true
+	if c.env.Backend != nil {
+		c.closeBackends()
+	}
 	return nil
 }
 
 func (c *Connection) handleRequestPacket(payload []byte) error {
+	// the response is sent in one go once the command is handled
+	defer c.packetIO.Flush()
+
+	if len(payload) == 0 {
+		return c.writeError(NewDefaultMySqlError(ER_UNKNOWN_COM_ERROR))
+	}
 	cmd := payload[0]
 	body := payload[1:]
-	fmt.Printf("cmd: %v\n%s\n", cmd, hex.Dump(body))
-	c.writeOK(0, 0, 0)
+	if cmd == COM_QUERY {
+		c.setProcess(cmd, "starting", string(body))
+	} else {
+		c.setProcess(cmd, "starting", "")
+	}
 
 	switch cmd {
 	case COM_QUIT:
+		return c.handleQuit()
 	case COM_QUERY:
+		return c.handleComQuery(string(body))
 	case COM_INIT_DB:
+		return c.handleInitDB(string(body))
 	case COM_FIELD_LIST:
+		return c.handleFieldList(body)
+	case COM_PROCESS_KILL:
+		return c.handleProcessKill(body)
+	case COM_PING:
+		return c.writeOK(c.status, 0, 0)
+	case COM_STATISTICS:
+		return c.handleStatistics()
+	case COM_DEBUG:
+		return c.handleDebug()
+	case COM_PROCESS_INFO:
+		return c.handleShowProcessList(false)
+	case COM_CHANGE_USER:
+		return c.handleChangeUser(body)
+	case COM_RESET_CONNECTION:
+		return c.handleResetConnection()
+	case COM_SET_OPTION:
+		return c.handleSetOption(body)
 	case COM_STMT_PREPARE:
+		return c.handleStmtPrepare(string(body))
 	case COM_STMT_EXECUTE:
+		return c.handleStmtExecute(body)
 	case COM_STMT_CLOSE:
-	case COM_STMT_SEND_LONG_DATA:
+		return c.handleStmtClose(body)
 	case COM_STMT_RESET:
-	case COM_SET_OPTION:
-	default:
-		// return NewError()
+		return c.handleStmtReset(body)
+	case COM_STMT_SEND_LONG_DATA:
+		// never answered, the long data is not supported
+		return nil
 	}
-	return nil
+	// COM_SLEEP, COM_TIME and the like are internal to the server, the
+	// replication and COM_STMT_FETCH are not supported
+	c.log.Debug("handleRequestPacket: unknown command %d", cmd)
+	return c.writeError(NewDefaultMySqlError(ER_UNKNOWN_COM_ERROR))
 }
 
 func (c *Connection) writeOK(status uint16, affectedRows uint64, insertId uint64) error {
+	c.stats.affectedRows = affectedRows
+	return c.writeOKPacket(OK_HEADER, status, affectedRows, insertId, 0)
+}
+
+func (c *Connection) writeOKPacket(header byte, status uint16, affectedRows uint64, insertId uint64, warnings uint16) error {
 	// OK_PACKET: https://dev.mysql.com/doc/dev/mysql-server/8.0.0/page_protocol_basic_ok_packet.html
 	// As of MySQL 5.7.5, OK packes are also used to indicate EOF, and EOF packets are deprecated.
 	// These rules distinguish whether the packet represents OK or EOF:
 	// - OK: header = 0 and length of packet > 7
 	// - EOF: header = 0xfe and length of packet < 9
-	payload := make([]byte, 0, 32)
-	payload = append(payload, OK_HEADER)
+	var stateInfo []byte
+	if c.capabilities&CLIENT_SESSION_TRACK > 0 {
+		if stateInfo = c.sessionStateInfo(status); len(stateInfo) > 0 {
+			status |= SERVER_SESSION_STATE_CHANGED
+		}
+	}
+	payload := make([]byte, 0, 32+len(stateInfo))
+	payload = append(payload, header)
 	payload = append(payload, EncodeLencInt(affectedRows)...)
 	payload = append(payload, EncodeLencInt(insertId)...)
 	if c.capabilities&CLIENT_PROTOCOL_41 > 0 {
 		// if CLIENT_PROTOCOL_41 is set, the packet contains a warning count.
-		payload = append(payload, EncodeUint16(status)...) // status_flags
-		payload = append(payload, EncodeUint16(0)...)      // number of warnings
+		payload = append(payload, EncodeUint16(status)...)   // status_flags
+		payload = append(payload, EncodeUint16(warnings)...) // number of warnings
 	}
-	return c.packetIO.WritePacket(payload)
+	if c.capabilities&CLIENT_SESSION_TRACK > 0 {
+		// the info is empty, the state changes follow if any
+		payload = append(payload, 0)
+		if len(stateInfo) > 0 {
+			payload = append(payload, EncodeLencString(stateInfo)...)
+		}
+	}
+	return c.writePacket(payload)
 }
 
 func (c *Connection) writeEOF(warnings uint16, status uint16) error {
+	// with CLIENT_DEPRECATE_EOF an OK packet with the EOF header takes its place
+	if c.capabilities&CLIENT_DEPRECATE_EOF > 0 {
+		return c.writeOKPacket(EOF_HEADER, status, 0, 0, warnings)
+	}
 	// EOF_PACKET: https://dev.mysql.com/doc/dev/mysql-server/8.0.0/page_protocol_basic_eof_packet.html
 	payload := make([]byte, 0, 5)
 	payload = append(payload, EOF_HEADER)
@@ -174,7 +340,16 @@ func (c *Connection) writeEOF(warnings uint16, status uint16) error {
 		payload = append(payload, EncodeUint16(warnings)...) // number of warnings
 		payload = append(payload, EncodeUint16(status)...)   // SERVER_STATUS_flags_enum
 	}
-	return c.packetIO.WritePacket(payload)
+	return c.writePacket(payload)
+}
+
+// writeFieldsEOF ends the column definitions of a resultset, nothing is
+// written with CLIENT_DEPRECATE_EOF.
+func (c *Connection) writeFieldsEOF() error {
+	if c.capabilities&CLIENT_DEPRECATE_EOF > 0 {
+		return nil
+	}
+	return c.writeEOF(0, c.status)
 }
 
 func (c *Connection) writeError(e error) error {
@@ -187,6 +362,7 @@ func (c *Connection) writeError(e error) error {
 	if !ok {
 		m = NewMySqlError(ER_UNKNOWN_ERROR, e.Error())
 	}
+	c.stats.errorCode = m.Code
 
 	payload := make([]byte, 0, 16+len(m.Message))
 	payload = append(payload, ERR_HEADER)
@@ -199,7 +375,7 @@ func (c *Connection) writeError(e error) error {
 	}
 
 	payload = append(payload, m.Message...) // RestOfPacketString
-	return c.packetIO.WritePacket(payload)
+	return c.writePacket(payload)
 }
 
 func (c *Connection) writeInitialHandshake() error {
@@ -208,7 +384,7 @@ func (c *Connection) writeInitialHandshake() error {
 	// protocol version: 10
 	payload = append(payload, 10)
 	// string[NULL], server version
-	payload = append(payload, SERVER_VERSION...)
+	payload = append(payload, c.env.serverVersion...)
 	payload = append(payload, 0)
 	// int32, connection id
 	payload = append(payload, EncodeUint32(c.connectionId)...)
@@ -217,15 +393,16 @@ func (c *Connection) writeInitialHandshake() error {
 	// 1 byte, [00] filter
 	payload = append(payload, 0)
 	// 2 bytes, capabilities lower 2 bytes
-	payload = append(payload, byte(c.capabilities), byte(c.capabilities>>8))
-	// 1 byte, charset, default utf-8
-	payload = append(payload, byte(c.collationId))
+	capabilities := c.env.capabilities
+	payload = append(payload, byte(capabilities), byte(capabilities>>8))
+	// 1 byte, charset, the default collation of the proxy
+	payload = append(payload, HandshakeCharset(c.collationId))
 	// 2 bytes, status
 	payload = append(payload, EncodeUint16(c.status)...)
 	// 2 bytes, capability_flags_2, upper 2 bytes of the capabilities
-	payload = append(payload, byte(c.capabilities>>16), byte(c.capabilities>>24))
+	payload = append(payload, byte(capabilities>>16), byte(capabilities>>24))
 	// 1 byte, length of auth-plugin-data or 0
-	if c.capabilities&CLIENT_PLUGIN_AUTH > 0 {
+	if capabilities&CLIENT_PLUGIN_AUTH > 0 {
 		payload = append(payload, byte(len(c.salt)))
 	} else {
 		panic("please CLIENT_PLUGIN_AUTH")
@@ -234,7 +411,7 @@ func (c *Connection) writeInitialHandshake() error {
 	payload = append(payload, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
 	// string[$len]   auth-plugin-data-part-2
 	// $len=MAX(13, length of auth-plugin-data - 8)
-	if c.capabilities&CLIENT_SECURE_CONNECTION > 0 {
+	if capabilities&CLIENT_SECURE_CONNECTION > 0 {
 		if len(c.salt[8:]) > 13 {
 			panic("please len(salt[8:]) <= 13")
 		}
@@ -244,8 +421,8 @@ func (c *Connection) writeInitialHandshake() error {
 	}
 	// string[NUL] auth-plugin name, if capabilities & CLIENT_PLUGIN_AUTH
 	payload = append(payload, 0)
-	if debug {
-		fmt.Printf("initialHandhshake: \n%s", hex.Dump(payload))
+	if c.tracing() {
+		c.traceRedacted("write", c.packetIO.Sequence, len(payload))
 	}
 	return c.packetIO.WritePacket(payload)
 }
@@ -256,9 +433,6 @@ func (c *Connection) readHandshakeResponse() (*handkshakeResponse, error) {
 	if err != nil {
 		return nil, err
 	}
-	if debug {
-		fmt.Printf("readHandshakeResponse:\n%s\n", hex.Dump(pr.buf))
-	}
 	h := handkshakeResponse{}
 	h.attrs = map[string]string{}
 	if err != nil {
@@ -267,12 +441,17 @@ func (c *Connection) readHandshakeResponse() (*handkshakeResponse, error) {
 	if h.capabilities, err = pr.ReadUint32(); err != nil {
 		return nil, err
 	}
+	// the largest packet the client takes, like mysql the proxy does not
+	// limit the responses by it, it is only logged
 	if h.maxPacketSize, err = pr.ReadUint32(); err != nil {
 		return nil, err
 	}
-	if h.charset, err = pr.ReadByte(); err != nil {
+	c.log.Debug("readHandshakeResponse: client max_packet_size=%d", h.maxPacketSize)
+	charset, err := pr.ReadByte()
+	if err != nil {
 		return nil, err
 	}
+	h.charset = CollationId(charset)
 	// reserved 23 bytes
 	pr.Next(23)
 	if h.user, err = pr.ReadBytes('\x00'); err != nil {
@@ -296,23 +475,77 @@ func (c *Connection) readHandshakeResponse() (*handkshakeResponse, error) {
 		}
 	}
 	if h.capabilities&CLIENT_CONNECT_ATTRS > 0 {
-		_, _, err := pr.ReadLencInt()
+		n, _, err := pr.ReadLencInt()
 		if err != nil {
 			return nil, fmt.Errorf("fail on read attrs: %s", err)
 		}
+		// the zstd level may follow the attrs
+		attrs := &PacketReader{buffer: bytes.NewBuffer(pr.Next(int(n)))}
 		for i := uint64(0); ; i++ {
-			key, err := pr.ReadLencString()
+			key, err := attrs.ReadLencString()
 			if err == io.EOF {
 				break
 			} else if err != nil {
 				return nil, fmt.Errorf("fail on read attrs key: %s", err)
 			}
-			val, err := pr.ReadLencString()
+			val, err := attrs.ReadLencString()
 			if err != nil {
 				return nil, fmt.Errorf("fail on read attrs val: %s", err)
 			}
 			h.attrs[key] = val
 		}
 	}
+	if h.capabilities&CLIENT_ZSTD_COMPRESSION_ALGORITHM > 0 {
+		level, err := pr.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("fail on read h.zstdLevel: %s", err)
+		}
+		h.zstdLevel = int(level)
+		if h.zstdLevel < MIN_ZSTD_LEVEL || h.zstdLevel > MAX_ZSTD_LEVEL {
+			return nil, NewMySqlError(ER_HANDSHAKE_ERROR, fmt.Sprintf("Compression level '%d' is invalid for zstd", level))
+		}
+	}
 	return &h, nil
 }
+
+// Reject answers the client with an error instead of the initial handshake.
+func (c *Connection) Reject(err error) {
+	c.writeError(err)
+	c.Close()
+	c.packetIO.Release()
+}
+
+// remoteHost returns the client IP without the port.
+func (c *Connection) remoteHost() string {
+	addr := c.conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (c *Connection) writePacket(payload []byte) error {
+	if c.tracing() {
+		c.log.Trace("write packet: seq=%d len=%d\n%s", c.packetIO.Sequence, len(payload), hex.Dump(payload))
+	}
+	return c.packetIO.WritePacket(payload)
+}
+
+// traceRedacted traces a packet carrying auth data without its payload, the
+// salt and the scrambled password are kept out of the log.
+func (c *Connection) traceRedacted(op string, seq uint8, n int) {
+	c.log.Trace("%s packet: seq=%d len=%d <redacted>", op, seq, n)
+}
+
+func (c *Connection) SetTrace(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&c.trace, v)
+}
+
+func (c *Connection) tracing() bool {
+	return atomic.LoadInt32(&c.trace) == 1
+}
@@ -8,12 +8,17 @@ import (
 	"net"
 	"reflect"
 	"testing"
+
+	"github.com/Fleurer/hardshard/pkg/config"
 )
 
 func setupConnnection() (*Connection, net.Conn) {
 	server, client := net.Pipe()
-	conn := NewConnection(server)
+	env, _ := NewEnv(config.Default(), nil)
+	conn := NewConnection(server, env)
 	conn.salt = []byte("salt1salt2salt3salt4")
+	// the tests talk like the clients before 5.7
+	conn.capabilities &^= CLIENT_SESSION_TRACK | CLIENT_DEPRECATE_EOF
 	return conn, client
 }
 
@@ -100,6 +105,8 @@ func TestWriteError2(t *testing.T) {
 func TestWriteInitialHandshake(t *testing.T) {
 	conn, client := setupConnnection()
 	defer client.Close()
+	// the ids come from a global counter, pin it for the other tests may run first
+	conn.connectionId = 10005
 	go func() {
 		conn.writeInitialHandshake()
 		conn.Close()
@@ -113,8 +120,8 @@ func TestWriteInitialHandshake(t *testing.T) {
 		46, 51, 49, 45, 104, 97, 114, 100,
 		115, 104, 97, 114, 100, 45, 48, 46,
 		49, 0, 21, 39, 0, 0, 115, 97,
-		108, 116, 49, 115, 97, 108, 0, 8,
-		130, 33, 2, 0, 24, 0, 20, 0,
+		108, 116, 49, 115, 97, 108, 0, 168,
+		130, 45, 2, 0, 159, 5, 20, 0,
 		0, 0, 0, 0, 0, 0, 0, 0,
 		0, 116, 50, 115, 97, 108, 116, 51,
 		115, 97, 108, 116, 52, 0,
@@ -124,6 +131,53 @@ func TestWriteInitialHandshake(t *testing.T) {
 	}
 }
 
+func TestWriteConfiguredHandshake(t *testing.T) {
+	cfg := config.Default()
+	cfg.ServerVersion = "8.0.30"
+	cfg.Collation = "utf8mb4_ja_0900_as_cs"
+	cfg.DisabledCapabilities = []string{"client_connect_attrs"}
+	env, err := NewEnv(cfg, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := NewConnection(server, env)
+	conn.salt = []byte("salt1salt2salt3salt4")
+	conn.connectionId = 10005
+	go func() {
+		conn.writeInitialHandshake()
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// the collation 303 goes beyond a byte, the handshake carries utf8mb4_general_ci
+	expectedBuf := []byte{
+		52, 0, 0, 0, 10, 56, 46, 48,
+		46, 51, 48, 0, 21, 39, 0, 0,
+		115, 97, 108, 116, 49, 115, 97, 108,
+		0, 168, 130, 45, 2, 0, 143, 5,
+		20, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 116, 50, 115, 97, 108,
+		116, 51, 115, 97, 108, 116, 52, 0,
+	}
+	if !bytes.Equal(buf, expectedBuf) {
+		t.Fatalf("bad result: %v, expected: %v", buf, expectedBuf)
+	}
+	if conn.vars["names"] != "utf8mb4 COLLATE utf8mb4_ja_0900_as_cs" {
+		t.Fatalf("bad result: %s, expected: %s", conn.vars["names"], "utf8mb4 COLLATE utf8mb4_ja_0900_as_cs")
+	}
+
+	for _, disabled := range [][]string{{"CLIENT_PROTOCOL_41"}, {"CLIENT_NOPE"}} {
+		cfg.DisabledCapabilities = disabled
+		if _, err := NewEnv(cfg, nil); err == nil {
+			t.Fatalf("%v: expected an error", disabled)
+		}
+	}
+}
+
 func TestReadHandshakeResponse(t *testing.T) {
 	conn, client := setupConnnection()
 	defer client.Close()
@@ -151,3 +205,143 @@ func TestReadHandshakeResponse(t *testing.T) {
 
 	conn.Close()
 }
+
+func TestReadHandshakeResponseZstd(t *testing.T) {
+	for _, level := range []byte{7, 0} {
+		payload := EncodeUint32(CLIENT_PROTOCOL_41 | CLIENT_SECURE_CONNECTION | CLIENT_PLUGIN_AUTH | CLIENT_CONNECT_ATTRS | CLIENT_ZSTD_COMPRESSION_ALGORITHM)
+		payload = append(payload, 0, 0, 0, 0, 45)
+		payload = append(payload, make([]byte, 23)...)
+		payload = append(payload, "u\x00\x00mysql_native_password\x00"...)
+		attrs := append(EncodeLencString([]byte("_pid")), EncodeLencString([]byte("1"))...)
+		payload = append(payload, EncodeLencString(attrs)...)
+		// the level of zstd follows the attrs
+		payload = append(payload, level)
+
+		conn, client := setupConnnection()
+		go func() {
+			client.Write(append([]byte{byte(len(payload)), 0, 0, 0}, payload...))
+			client.Close()
+		}()
+		h, err := conn.readHandshakeResponse()
+		conn.Close()
+		if level == 0 {
+			if err == nil {
+				t.Fatalf("expected the error of the level 0")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("readHandshakeResponse err: %s", err)
+		}
+		if h.zstdLevel != int(level) || !reflect.DeepEqual(h.attrs, map[string]string{"_pid": "1"}) {
+			t.Fatalf("bad handshake: %s, expected the zstd level %d", h, level)
+		}
+	}
+}
+
+func TestSessionTrack(t *testing.T) {
+	okPacket := func(status uint16, stateInfo ...byte) []byte {
+		payload := []byte{OK_HEADER, 0, 0}
+		payload = append(payload, EncodeUint16(status|SERVER_SESSION_STATE_CHANGED)...)
+		payload = append(payload, 0, 0, 0)
+		payload = append(payload, EncodeLencString(stateInfo)...)
+		return append([]byte{byte(len(payload)), 0, 0, 0}, payload...)
+	}
+	cases := []struct {
+		handle   func(c *Connection) error
+		expected []byte
+	}{
+		{
+			func(c *Connection) error { return c.handleSet("SET autocommit = 0") },
+			okPacket(0, append(append([]byte{SESSION_TRACK_SYSTEM_VARIABLES, 15, 10}, "autocommit"...), append([]byte{3}, "OFF"...)...)...),
+		},
+		{
+			func(c *Connection) error { return c.useDB("db1") },
+			okPacket(SERVER_STATUS_AUTOCOMMIT, SESSION_TRACK_SCHEMA, 4, 3, 'd', 'b', '1'),
+		},
+		{
+			func(c *Connection) error { return c.beginTransaction("BEGIN") },
+			okPacket(SERVER_STATUS_AUTOCOMMIT|SERVER_STATUS_IN_TRANS, append([]byte{SESSION_TRACK_TRANSACTION_STATE, 9, 8}, "T_______"...)...),
+		},
+		{
+			// no EOF after the fields, the rows end with an OK packet of the EOF header
+			func(c *Connection) error { return c.writeResultSet(NewResultSet([]string{"a"}, [][]interface{}{{1}})) },
+			nil,
+		},
+	}
+	for i, cs := range cases {
+		conn, client := setupConnnection()
+		conn.capabilities |= CLIENT_SESSION_TRACK | CLIENT_DEPRECATE_EOF
+		go func() {
+			cs.handle(conn)
+			conn.Close()
+		}()
+		buf, err := ioutil.ReadAll(client)
+		client.Close()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if cs.expected == nil {
+			terminator := []byte{8, 0, 0, 3, EOF_HEADER, 0, 0, 2, 0, 0, 0, 0}
+			if !bytes.HasSuffix(buf, terminator) || bytes.Count(buf, []byte{EOF_HEADER}) != 1 {
+				t.Fatalf("case %d: bad result: %v, expected the terminator: %v", i, buf, terminator)
+			}
+			continue
+		}
+		if !bytes.Equal(buf, cs.expected) {
+			t.Fatalf("case %d: bad result: %v, expected: %v", i, buf, cs.expected)
+		}
+	}
+}
+
+func TestWriteResults(t *testing.T) {
+	conn, client := setupConnnection()
+	defer client.Close()
+	out := &Result{Status: SERVER_PS_OUT_PARAMS, ResultSet: NewResultSet([]string{"x"}, [][]interface{}{{"1"}})}
+	result := &Result{ResultSet: NewResultSet([]string{"a"}, nil), Next: out}
+	out.Next = &Result{AffectedRows: 1}
+	go func() {
+		conn.writeResults(result)
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	more := SERVER_STATUS_AUTOCOMMIT | SERVER_MORE_RESULTS_EXISTS
+	// the EOFs after the rows of the resultsets, and the final OK
+	expected := [][]byte{
+		{EOF_HEADER, 0, 0, byte(more), 0},
+		{EOF_HEADER, 0, 0, byte(more), byte((more | SERVER_PS_OUT_PARAMS) >> 8)},
+		{OK_HEADER, 1, 0, 2, 0, 0, 0},
+	}
+	for _, payload := range expected {
+		i := bytes.Index(buf, payload)
+		if i < 0 {
+			t.Fatalf("bad result: %v, expected: %v", buf, payload)
+		}
+		buf = buf[i+len(payload):]
+	}
+	if len(buf) != 0 || conn.status != SERVER_STATUS_AUTOCOMMIT {
+		t.Fatalf("bad result: %v %d, expected nothing after the OK", buf, conn.status)
+	}
+}
+
+func TestReleaseUser(t *testing.T) {
+	conn, client := setupConnnection()
+	defer client.Close()
+	env := conn.env
+	if err := env.Admit(conn); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := env.admitUser(conn, "u1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, users := env.connectionCounts(); users[conn.user] != 1 {
+		t.Fatalf("bad result: %v, expected a connection of %q", users, conn.user)
+	}
+	env.Release(conn)
+	if n, users := env.connectionCounts(); n != 0 || len(users) != 0 {
+		t.Fatalf("bad result: %d %v, expected no entry left", n, users)
+	}
+}
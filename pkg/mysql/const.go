@@ -24,6 +24,25 @@ const (
 	SERVER_STATUS_METADATA_CHANGED     uint16 = 0x0400
 	SERVER_QUERY_WAS_SLOW              uint16 = 0x0800
 	SERVER_PS_OUT_PARAMS               uint16 = 0x1000
+	SERVER_STATUS_IN_TRANS_READONLY    uint16 = 0x2000
+	SERVER_SESSION_STATE_CHANGED       uint16 = 0x4000
+)
+
+// the options of COM_SET_OPTION
+const (
+	MYSQL_OPTION_MULTI_STATEMENTS_ON  uint16 = 0
+	MYSQL_OPTION_MULTI_STATEMENTS_OFF uint16 = 1
+)
+
+// the types of the session state changes in the OK packet
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_ok_packet.html
+const (
+	SESSION_TRACK_SYSTEM_VARIABLES byte = iota
+	SESSION_TRACK_SCHEMA
+	SESSION_TRACK_STATE_CHANGE
+	SESSION_TRACK_GTIDS
+	SESSION_TRACK_TRANSACTION_CHARACTERISTICS
+	SESSION_TRACK_TRANSACTION_STATE
 )
 
 const (
@@ -84,8 +103,48 @@ const (
 	CLIENT_PLUGIN_AUTH
 	CLIENT_CONNECT_ATTRS
 	CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA
+	CLIENT_CAN_HANDLE_EXPIRED_PASSWORDS
+	CLIENT_SESSION_TRACK
+	CLIENT_DEPRECATE_EOF
+	CLIENT_OPTIONAL_RESULTSET_METADATA
+	CLIENT_ZSTD_COMPRESSION_ALGORITHM
 )
 
+// REQUIRED_CAPABILITIES are relied on by the handshake of the proxy, they
+// can't be disabled
+const REQUIRED_CAPABILITIES uint32 = CLIENT_PROTOCOL_41 | CLIENT_SECURE_CONNECTION | CLIENT_PLUGIN_AUTH
+
+// CAPABILITY_NAMES are the capability flags by name, for the config
+var CAPABILITY_NAMES = map[string]uint32{
+	"CLIENT_LONG_PASSWORD":                  CLIENT_LONG_PASSWORD,
+	"CLIENT_FOUND_ROWS":                     CLIENT_FOUND_ROWS,
+	"CLIENT_LONG_FLAG":                      CLIENT_LONG_FLAG,
+	"CLIENT_CONNECT_WITH_DB":                CLIENT_CONNECT_WITH_DB,
+	"CLIENT_NO_SCHEMA":                      CLIENT_NO_SCHEMA,
+	"CLIENT_COMPRESS":                       CLIENT_COMPRESS,
+	"CLIENT_ODBC":                           CLIENT_ODBC,
+	"CLIENT_LOCAL_FILES":                    CLIENT_LOCAL_FILES,
+	"CLIENT_IGNORE_SPACE":                   CLIENT_IGNORE_SPACE,
+	"CLIENT_PROTOCOL_41":                    CLIENT_PROTOCOL_41,
+	"CLIENT_INTERACTIVE":                    CLIENT_INTERACTIVE,
+	"CLIENT_SSL":                            CLIENT_SSL,
+	"CLIENT_IGNORE_SIGPIPE":                 CLIENT_IGNORE_SIGPIPE,
+	"CLIENT_TRANSACTIONS":                   CLIENT_TRANSACTIONS,
+	"CLIENT_RESERVED":                       CLIENT_RESERVED,
+	"CLIENT_SECURE_CONNECTION":              CLIENT_SECURE_CONNECTION,
+	"CLIENT_MULTI_STATEMENTS":               CLIENT_MULTI_STATEMENTS,
+	"CLIENT_MULTI_RESULTS":                  CLIENT_MULTI_RESULTS,
+	"CLIENT_PS_MULTI_RESULTS":               CLIENT_PS_MULTI_RESULTS,
+	"CLIENT_PLUGIN_AUTH":                    CLIENT_PLUGIN_AUTH,
+	"CLIENT_CONNECT_ATTRS":                  CLIENT_CONNECT_ATTRS,
+	"CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA": CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA,
+	"CLIENT_CAN_HANDLE_EXPIRED_PASSWORDS":   CLIENT_CAN_HANDLE_EXPIRED_PASSWORDS,
+	"CLIENT_SESSION_TRACK":                  CLIENT_SESSION_TRACK,
+	"CLIENT_DEPRECATE_EOF":                  CLIENT_DEPRECATE_EOF,
+	"CLIENT_OPTIONAL_RESULTSET_METADATA":    CLIENT_OPTIONAL_RESULTSET_METADATA,
+	"CLIENT_ZSTD_COMPRESSION_ALGORITHM":     CLIENT_ZSTD_COMPRESSION_ALGORITHM,
+}
+
 //https://dev.mysql.com/doc/internals/en/com-query-response.html#packet-Protocol::ColumnType
 const (
 	MYSQL_TYPE_DECIMAL byte = iota
@@ -194,23 +253,46 @@ var (
 	TK_STR_COLUMNS = "columns"
 	TK_STR_FIELDS  = "fields"
 
+	// SET_KEY_WORDS are the session variables tracked by the proxy, they
+	// are replayed on the backend connections borrowed by the session
 	SET_KEY_WORDS = map[string]struct{}{
-		"names": struct{}{},
+		"names":   struct{}{},
+		"charset": struct{}{},
 
-		"character_set_results":           struct{}{},
-		"@@character_set_results":         struct{}{},
-		"@@session.character_set_results": struct{}{},
+		"character_set_results":    struct{}{},
+		"character_set_client":     struct{}{},
+		"character_set_connection": struct{}{},
+		"collation_connection":     struct{}{},
 
-		"character_set_client":           struct{}{},
-		"@@character_set_client":         struct{}{},
-		"@@session.character_set_client": struct{}{},
+		"autocommit":            struct{}{},
+		"transaction_isolation": struct{}{},
+		"tx_isolation":          struct{}{},
+		"transaction_read_only": struct{}{},
+		"tx_read_only":          struct{}{},
 
-		"character_set_connection":           struct{}{},
-		"@@character_set_connection":         struct{}{},
-		"@@session.character_set_connection": struct{}{},
+		"sql_mode":                 struct{}{},
+		"time_zone":                struct{}{},
+		"sql_safe_updates":         struct{}{},
+		"sql_select_limit":         struct{}{},
+		"sql_auto_is_null":         struct{}{},
+		"foreign_key_checks":       struct{}{},
+		"unique_checks":            struct{}{},
+		"group_concat_max_len":     struct{}{},
+		"div_precision_increment":  struct{}{},
+		"lc_time_names":            struct{}{},
+		"net_read_timeout":         struct{}{},
+		"net_write_timeout":        struct{}{},
+		"wait_timeout":             struct{}{},
+		"interactive_timeout":      struct{}{},
+		"innodb_lock_wait_timeout": struct{}{},
+		"lock_wait_timeout":        struct{}{},
+		"max_execution_time":       struct{}{},
+	}
 
-		"autocommit":           struct{}{},
-		"@@autocommit":         struct{}{},
-		"@@session.autocommit": struct{}{},
+	// TX_VAR_ALIASES are the transaction variables before 5.7.20 and their
+	// new names, the session keeps the new ones
+	TX_VAR_ALIASES = map[string]string{
+		"tx_isolation": "transaction_isolation",
+		"tx_read_only": "transaction_read_only",
 	}
 )
@@ -0,0 +1,283 @@
+package mysql
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/audit"
+	"github.com/Fleurer/hardshard/pkg/config"
+	"github.com/Fleurer/hardshard/pkg/firewall"
+	"github.com/Fleurer/hardshard/pkg/metrics"
+	"github.com/Fleurer/hardshard/pkg/netutil"
+	"github.com/Fleurer/hardshard/pkg/ratelimit"
+	"github.com/Fleurer/hardshard/pkg/router"
+	"github.com/Fleurer/hardshard/pkg/slowlog"
+)
+
+// Env holds the proxy-wide facilities shared by all the client connections.
+type Env struct {
+	Config   *config.Config
+	SlowLog  *slowlog.Logger
+	Audit    *audit.Logger
+	Firewall *firewall.Firewall
+	Limiter  *ratelimit.Limiter
+	Router   *router.Router
+	// Backend is nil if no node is configured
+	Backend Backend
+
+	allowIPs []*net.IPNet
+	users    map[string]*proxyUser
+
+	// the running connections by id, and the number of connections per user
+	connsMu   sync.RWMutex
+	conns     map[uint32]*Connection
+	userConns map[string]int
+
+	// the server version, the default collation and the capabilities of
+	// the handshake
+	serverVersion string
+	collationId   CollationId
+	capabilities  uint32
+	// maxAllowedPacket limits the packets of the clients
+	maxAllowedPacket int
+
+	// the status counters of COM_STATISTICS
+	startTime   time.Time
+	questions   uint64
+	slowQueries uint64
+}
+
+func NewEnv(cfg *config.Config, backend Backend) (*Env, error) {
+	env := &Env{
+		Config:    cfg,
+		Backend:   backend,
+		users:     map[string]*proxyUser{},
+		conns:     map[uint32]*Connection{},
+		userConns: map[string]int{},
+		startTime: time.Now(),
+	}
+	var err error
+	if env.allowIPs, err = netutil.ParseIPNets(cfg.AllowIPs); err != nil {
+		return nil, err
+	}
+	env.serverVersion = cfg.ServerVersion
+	if env.serverVersion == "" {
+		env.serverVersion = SERVER_VERSION
+	}
+	env.collationId = DEFAULT_COLLATION_ID
+	if cfg.Collation != "" {
+		id, ok := CollationNames[strings.ToLower(cfg.Collation)]
+		if !ok {
+			return nil, fmt.Errorf("unknown collation: %s", cfg.Collation)
+		}
+		env.collationId = id
+	}
+	env.maxAllowedPacket = cfg.MaxAllowedPacket
+	if env.maxAllowedPacket == 0 {
+		env.maxAllowedPacket = DEFAULT_MAX_ALLOWED_PACKET
+	}
+	if env.maxAllowedPacket < MIN_MAX_ALLOWED_PACKET || env.maxAllowedPacket > MAX_MAX_ALLOWED_PACKET {
+		return nil, fmt.Errorf("max_allowed_packet %d is out of [%d, %d]", cfg.MaxAllowedPacket, MIN_MAX_ALLOWED_PACKET, MAX_MAX_ALLOWED_PACKET)
+	}
+	if env.capabilities, err = disableCapabilities(DEFAULT_CAPABILITIES, cfg.DisabledCapabilities); err != nil {
+		return nil, err
+	}
+	for _, uc := range cfg.Users {
+		u, err := newProxyUser(uc)
+		if err != nil {
+			return nil, err
+		}
+		env.users[u.name] = u
+	}
+	if env.Firewall, err = firewall.New(cfg.Firewall, cfg.Schemas); err != nil {
+		return nil, err
+	}
+	if env.Limiter, err = ratelimit.New(cfg.RateLimits); err != nil {
+		return nil, err
+	}
+	if env.Router, err = router.New(cfg.Nodes, cfg.Schemas); err != nil {
+		return nil, err
+	}
+	if cfg.SlowLog.File != "" {
+		l, err := slowlog.Open(cfg.SlowLog.File, int64(cfg.SlowLog.MaxSize)<<20, cfg.SlowLog.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		env.SlowLog = l
+	}
+	if c := cfg.AuditLog; c.File != "" {
+		filter := audit.Filter{Classes: c.Classes, Users: c.Users}
+		l, err := audit.Open(c.File, int64(c.MaxSize)<<20, c.MaxBackups, filter, c.BufferSize)
+		if err != nil {
+			// the backend is closed by its owner
+			if env.SlowLog != nil {
+				env.SlowLog.Close()
+			}
+			return nil, err
+		}
+		env.Audit = l
+	}
+	return env, nil
+}
+
+// disableCapabilities removes the named capabilities, the required ones
+// can't be removed.
+func disableCapabilities(capabilities uint32, names []string) (uint32, error) {
+	for _, name := range names {
+		flag, ok := CAPABILITY_NAMES[strings.ToUpper(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown capability: %s", name)
+		}
+		if flag&REQUIRED_CAPABILITIES > 0 {
+			return 0, fmt.Errorf("capability %s can not be disabled", name)
+		}
+		capabilities &^= flag
+	}
+	return capabilities, nil
+}
+
+func (env *Env) Close() error {
+	var err error
+	if env.Backend != nil {
+		err = env.Backend.Close()
+	}
+	if env.SlowLog != nil {
+		if e := env.SlowLog.Close(); e != nil {
+			err = e
+		}
+	}
+	if env.Audit != nil {
+		if e := env.Audit.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Admit registers the new connection before its handshake, it checks the
+// client against the allow_ips and the max_connections.
+func (env *Env) Admit(c *Connection) error {
+	host := c.remoteHost()
+	if len(env.allowIPs) > 0 && !netutil.ContainsIP(env.allowIPs, host) {
+		metrics.RejectedConnections.Add("host_not_privileged", 1)
+		return NewDefaultMySqlError(ER_HOST_NOT_PRIVILEGED, host)
+	}
+
+	env.connsMu.Lock()
+	defer env.connsMu.Unlock()
+	if max := env.Config.MaxConnections; max > 0 && len(env.conns) >= max {
+		metrics.RejectedConnections.Add("too_many_connections", 1)
+		return NewDefaultMySqlError(ER_CON_COUNT_ERROR)
+	}
+	env.conns[c.connectionId] = c
+	metrics.Connections.Set(int64(len(env.conns)))
+	return nil
+}
+
+// Release unregisters the closed connection.
+func (env *Env) Release(c *Connection) {
+	env.connsMu.Lock()
+	defer env.connsMu.Unlock()
+	if _, ok := env.conns[c.connectionId]; !ok {
+		return
+	}
+	delete(env.conns, c.connectionId)
+	metrics.Connections.Set(int64(len(env.conns)))
+	env.releaseUser(c)
+}
+
+func (env *Env) releaseUser(c *Connection) {
+	if c.userAdmitted {
+		// the users come and go, their entries do not stay at 0
+		if env.userConns[c.user]--; env.userConns[c.user] <= 0 {
+			delete(env.userConns, c.user)
+			metrics.UserConnections.Delete(c.user)
+		} else {
+			metrics.UserConnections.Add(c.user, -1)
+		}
+		c.userAdmitted = false
+	}
+}
+
+// admitUser checks the max_connections of the user after the authentication.
+func (env *Env) admitUser(c *Connection, user string) error {
+	env.connsMu.Lock()
+	defer env.connsMu.Unlock()
+	return env.admitUserLocked(c, user)
+}
+
+func (env *Env) admitUserLocked(c *Connection, user string) error {
+	if u, ok := env.users[user]; ok && u.maxConnections > 0 && env.userConns[user] >= u.maxConnections {
+		metrics.RejectedConnections.Add("too_many_user_connections", 1)
+		return NewDefaultMySqlError(ER_TOO_MANY_USER_CONNECTIONS, user)
+	}
+	c.user = user
+	env.userConns[user]++
+	metrics.UserConnections.Add(user, 1)
+	c.userAdmitted = true
+	return nil
+}
+
+// changeUser moves the connection to the count of the new user on
+// COM_CHANGE_USER, the connection is counted for nobody if it fails.
+func (env *Env) changeUser(c *Connection, user string) error {
+	env.connsMu.Lock()
+	defer env.connsMu.Unlock()
+	env.releaseUser(c)
+	return env.admitUserLocked(c, user)
+}
+
+// connectionCounts returns the total and the per-user number of connections.
+func (env *Env) connectionCounts() (int, map[string]int) {
+	env.connsMu.RLock()
+	defer env.connsMu.RUnlock()
+	users := make(map[string]int, len(env.userConns))
+	for u, n := range env.userConns {
+		users[u] = n
+	}
+	return len(env.conns), users
+}
+
+// connections returns the running connections ordered by id.
+func (env *Env) connections() []*Connection {
+	env.connsMu.RLock()
+	conns := make([]*Connection, 0, len(env.conns))
+	for _, c := range env.conns {
+		conns = append(conns, c)
+	}
+	env.connsMu.RUnlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].connectionId < conns[j].connectionId })
+	return conns
+}
+
+func (env *Env) getConnection(id uint32) *Connection {
+	env.connsMu.RLock()
+	defer env.connsMu.RUnlock()
+	return env.conns[id]
+}
+
+// userOf returns the user of a connection run by another goroutine, c.user
+// is only written under connsMu.
+func (env *Env) userOf(c *Connection) string {
+	env.connsMu.RLock()
+	defer env.connsMu.RUnlock()
+	return c.user
+}
+
+// statistics is the status string of COM_STATISTICS, like mysqladmin status.
+func (env *Env) statistics() string {
+	uptime := time.Since(env.startTime)
+	threads, _ := env.connectionCounts()
+	questions := atomic.LoadUint64(&env.questions)
+	qps := 0.0
+	if uptime >= time.Second {
+		qps = float64(questions) / uptime.Seconds()
+	}
+	return fmt.Sprintf("Uptime: %d  Threads: %d  Questions: %d  Slow queries: %d  Opens: 0  Flush tables: 0  Open tables: 0  Queries per second avg: %.3f",
+		int64(uptime/time.Second), threads, questions, atomic.LoadUint64(&env.slowQueries), qps)
+}
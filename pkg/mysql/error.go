@@ -8,6 +8,8 @@ import (
 var (
 	ErrBadConn       = errors.New("connection was bad")
 	ErrMalformPacket = errors.New("Malform packet error")
+	// ErrPacketTooLarge is returned by ReadPacket for a payload over its MaxPacketSize
+	ErrPacketTooLarge = NewDefaultMySqlError(ER_NET_PACKET_TOO_LARGE)
 )
 
 type MySqlError struct {
@@ -31,3 +33,27 @@ func NewMySqlError(code uint16, message string) *MySqlError {
 	}
 	return &e
 }
+
+// NewDefaultMySqlError formats the message with the server's error message template of the code.
+func NewDefaultMySqlError(code uint16, args ...interface{}) *MySqlError {
+	message, ok := MySQLErrName[code]
+	if !ok {
+		return NewMySqlError(code, fmt.Sprint(args...))
+	}
+	return NewMySqlError(code, fmt.Sprintf(message, args...))
+}
+
+// ParseError parses an ERR packet of the 4.1 protocol.
+func ParseError(payload []byte) *MySqlError {
+	if len(payload) < 3 || payload[0] != ERR_HEADER {
+		return NewMySqlError(ER_UNKNOWN_ERROR, "Malformed error packet")
+	}
+	e := &MySqlError{Code: uint16(payload[1]) | uint16(payload[2])<<8, State: DEFAULT_MYSQL_STATE}
+	msg := payload[3:]
+	if len(msg) >= 6 && msg[0] == '#' {
+		e.State = string(msg[1:6])
+		msg = msg[6:]
+	}
+	e.Message = string(msg)
+	return e
+}
@@ -0,0 +1,61 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+// handleKill serves `KILL [CONNECTION | QUERY] <id>` with the proxy's own
+// connection ids, the ids of the backends are never exposed to the clients.
+func (c *Connection) handleKill(query string) error {
+	id, onlyQuery, err := sqlparser.ParseKill(query)
+	if err != nil {
+		return c.writeError(NewDefaultMySqlError(ER_PARSE_ERROR, "You have an error in your SQL syntax", query, 1))
+	}
+	return c.kill(uint32(id), onlyQuery)
+}
+
+// handleProcessKill serves COM_PROCESS_KILL, it kills the whole connection.
+// https://dev.mysql.com/doc/internals/en/com-process-kill.html
+func (c *Connection) handleProcessKill(body []byte) error {
+	if len(body) < 4 {
+		return c.writeError(NewDefaultMySqlError(ER_MALFORMED_PACKET))
+	}
+	return c.kill(binary.LittleEndian.Uint32(body), false)
+}
+
+func (c *Connection) kill(id uint32, onlyQuery bool) error {
+	target := c.env.getConnection(id)
+	if target == nil {
+		return c.writeError(NewMySqlError(ER_NO_SUCH_THREAD, fmt.Sprintf("Unknown thread id: %d", id)))
+	}
+	// like mysql, a user kills its own connections, the admins kill any
+	owner := c.env.userOf(target)
+	if owner != c.user && !c.isAdmin() {
+		return c.writeError(NewMySqlError(ER_KILL_DENIED_ERROR, fmt.Sprintf("You are not owner of thread %d", id)))
+	}
+	c.log.Info("kill: connection %d of user %s, query only: %v", id, owner, onlyQuery)
+	if target == c {
+		if !onlyQuery {
+			c.Close()
+			return nil
+		}
+		return c.writeOK(c.status, 0, 0)
+	}
+	target.Kill(onlyQuery)
+	return c.writeOK(c.status, 0, 0)
+}
+
+// Kill interrupts the statement running on the backends, and closes the
+// client connection unless onlyQuery, the connection's own goroutine
+// cleans up once its read fails.
+func (c *Connection) Kill(onlyQuery bool) {
+	if c.env.Backend != nil {
+		c.killQuery()
+	}
+	if !onlyQuery {
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,65 @@
+package mysql
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// setupKillTarget adds a connection of user to the env of conn.
+func setupKillTarget(conn *Connection, user string) (*Connection, net.Conn) {
+	server, client := net.Pipe()
+	target := NewConnection(server, conn.env)
+	conn.env.Admit(target)
+	conn.env.admitUser(target, user)
+	return target, client
+}
+
+func TestKill(t *testing.T) {
+	conn, client := setupConnnection()
+	defer client.Close()
+	conn.env.Admit(conn)
+	conn.env.admitUser(conn, "app")
+	target, targetClient := setupKillTarget(conn, "app")
+	other, otherClient := setupKillTarget(conn, "ops")
+	defer otherClient.Close()
+
+	cases := []struct {
+		payload []byte
+		code    uint16
+	}{
+		{append([]byte{COM_QUERY}, "KILL 4294967295"...), ER_NO_SUCH_THREAD},
+		{append([]byte{COM_PROCESS_KILL}, EncodeUint32(4294967295)...), ER_NO_SUCH_THREAD},
+		{[]byte{COM_PROCESS_KILL, 1}, ER_MALFORMED_PACKET},
+		{append([]byte{COM_QUERY}, fmt.Sprintf("KILL QUERY %d", other.connectionId)...), ER_KILL_DENIED_ERROR},
+		{append([]byte{COM_PROCESS_KILL}, EncodeUint32(other.connectionId)...), ER_KILL_DENIED_ERROR},
+		{append([]byte{COM_QUERY}, fmt.Sprintf("KILL QUERY %d", target.connectionId)...), 0},
+		{append([]byte{COM_PROCESS_KILL}, EncodeUint32(target.connectionId)...), 0},
+	}
+	for _, c := range cases {
+		c := c
+		conn.packetIO.ResetSequence()
+		done := make(chan struct{})
+		go func() {
+			conn.handleRequestPacket(c.payload)
+			close(done)
+		}()
+		payload, err := NewPacketIO(client, nil).ReadPacket()
+		<-done
+		if err != nil {
+			t.Fatalf("%q: err: %s", c.payload, err)
+		}
+		if c.code == 0 && payload[0] != OK_HEADER {
+			t.Fatalf("%q: bad result: %v, expected OK", c.payload, payload)
+		}
+		if c.code != 0 && (payload[0] != ERR_HEADER || !bytes.Equal(payload[1:3], EncodeUint16(c.code))) {
+			t.Fatalf("%q: bad result: %q, expected the error %d", c.payload, payload, c.code)
+		}
+	}
+	// COM_PROCESS_KILL hung up the target
+	if buf, err := ioutil.ReadAll(targetClient); err != nil || len(buf) != 0 {
+		t.Fatalf("bad result: %v %v, expected the target closed", buf, err)
+	}
+}
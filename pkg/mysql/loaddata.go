@@ -0,0 +1,475 @@
+package mysql
+
+// LOAD DATA LOCAL INFILE asks the client for the file, which the proxy
+// relays to the backends. The lines of a sharded table are split by the
+// sharding key, each shard gets its own lines in a LOAD DATA of its own.
+// https://dev.mysql.com/doc/internals/en/com-query-response.html#local-infile-request
+// https://dev.mysql.com/doc/refman/5.7/en/load-data.html
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/router"
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+const LOAD_DATA_BUFFER_SIZE = 64 * 1024
+
+// loadStream feeds the file of a LOAD DATA to a backend connection, the
+// statement runs in its own goroutine, which reads the file from the pipe.
+type loadStream struct {
+	conn BackendConn
+	pw   *io.PipeWriter
+	w    *bufio.Writer
+	// failed is set once the statement stops reading the file
+	failed bool
+	done   chan struct{}
+	result *Result
+	err    error
+}
+
+func startLoadStream(conn BackendConn, query string) *loadStream {
+	pr, pw := io.Pipe()
+	ls := &loadStream{conn: conn, pw: pw, w: bufio.NewWriterSize(pw, LOAD_DATA_BUFFER_SIZE), done: make(chan struct{})}
+	go func() {
+		defer close(ls.done)
+		ls.result, ls.err = conn.LoadData(query, pr)
+		if ls.err != nil {
+			pr.CloseWithError(ls.err)
+		} else {
+			// the file was read to its end
+			pr.Close()
+		}
+	}()
+	return ls
+}
+
+func (ls *loadStream) Write(data []byte) {
+	if ls.failed {
+		return
+	}
+	if _, err := ls.w.Write(data); err != nil {
+		ls.failed = true
+	}
+}
+
+// finish ends the file, or aborts it with err, and waits for the result.
+func (ls *loadStream) finish(err error) (*Result, error) {
+	if err == nil && !ls.failed {
+		err = ls.w.Flush()
+	}
+	ls.pw.CloseWithError(err)
+	<-ls.done
+	return ls.result, ls.err
+}
+
+// handleLoadData relays a LOAD DATA LOCAL INFILE, the others read the file
+// on the server and are forwarded as they are. The shards are loaded each
+// in a statement of its own, a failed shard does not roll back the others.
+func (c *Connection) handleLoadData(query string) error {
+	ld, err := sqlparser.ParseLoadData(query)
+	if err != nil || !ld.Local {
+		return c.forwardQuery(query)
+	}
+	if c.capabilities&CLIENT_LOCAL_FILES == 0 {
+		return c.writeError(NewDefaultMySqlError(ER_NOT_ALLOWED_COMMAND))
+	}
+	if c.env.Backend == nil {
+		return c.writeError(NewMySqlError(ER_UNKNOWN_ERROR, "No backend node is configured"))
+	}
+	plan, err := c.env.Router.Route(c.db, query)
+	if err != nil {
+		return c.writeError(err)
+	}
+	c.stats.shards = plan.Nodes
+
+	conns, err := c.borrowPlan(plan)
+	if err != nil {
+		return c.writeError(err)
+	}
+	c.setRunning(conns)
+	defer func() {
+		c.setRunning(nil)
+		c.releaseBackends()
+	}()
+
+	var splitter *rowSplitter
+	if len(conns) > 1 {
+		if splitter, err = c.newRowSplitter(ld, plan.Schema, conns[0]); err != nil {
+			return c.writeError(err)
+		}
+	}
+
+	c.setProcessState("executing")
+	start := time.Now()
+	streams := make(map[string]*loadStream, len(conns))
+	for _, conn := range conns {
+		streams[conn.Node()] = startLoadStream(conn, c.env.Router.Rewrite(query, conn.Node()))
+	}
+	readErr := c.relayLocalFile(ld.File, plan.Schema, splitter, streams)
+
+	var firstErr error
+	var affectedRows uint64
+	var warnings uint16
+	for _, conn := range conns {
+		result, err := streams[conn.Node()].finish(readErr)
+		if err != nil {
+			c.log.Debug("handleLoadData: node %s fail: err=%s", conn.Node(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		affectedRows += result.AffectedRows
+		warnings += result.Warnings
+	}
+	c.stats.backendTime = time.Since(start)
+	if readErr != nil {
+		// the client is gone in the middle of the file, or sent a packet
+		// too large
+		if readErr == ErrPacketTooLarge {
+			c.writeError(readErr)
+		}
+		c.Close()
+		return readErr
+	}
+	if firstErr != nil {
+		return c.writeError(firstErr)
+	}
+	c.stats.affectedRows = affectedRows
+	return c.writeOKPacket(OK_HEADER, c.status, affectedRows, 0, warnings)
+}
+
+// relayLocalFile asks the client for the file and writes it to the
+// streams, the lines are split by the splitter if any, or else all go to
+// the single stream. The file is read to its end even if the backends
+// fail.
+func (c *Connection) relayLocalFile(file string, schema *router.Schema, splitter *rowSplitter, streams map[string]*loadStream) error {
+	payload := make([]byte, 0, len(file)+1)
+	payload = append(payload, LocalInFile_HEADER)
+	payload = append(payload, file...)
+	if err := c.writePacket(payload); err != nil {
+		return err
+	}
+	for {
+		data, err := c.packetIO.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if splitter == nil {
+			for _, s := range streams {
+				s.Write(data)
+			}
+		} else {
+			splitter.Write(data)
+			c.writeLines(schema, splitter, streams, len(data) == 0)
+		}
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// writeLines sends the complete lines of the splitter to their shards,
+// the lines skipped by IGNORE n LINES go to every shard, so that each of
+// them skips the same lines.
+func (c *Connection) writeLines(schema *router.Schema, splitter *rowSplitter, streams map[string]*loadStream, eof bool) {
+	for {
+		line, key, ok := splitter.Next(eof)
+		if !ok {
+			return
+		}
+		if splitter.ignored < splitter.ignoreLines {
+			splitter.ignored++
+			for _, s := range streams {
+				s.Write(line)
+			}
+			continue
+		}
+		node := schema.Nodes[0]
+		if key != nil {
+			node = schema.Shard(*key)
+		}
+		streams[node].Write(line)
+	}
+}
+
+// newRowSplitter finds the position of the sharding key in the lines, by
+// the column list of the statement, or else by the columns of the table.
+func (c *Connection) newRowSplitter(ld *sqlparser.LoadData, schema *router.Schema, conn BackendConn) (*rowSplitter, error) {
+	if ld.FieldsTerminatedBy == "" && ld.FieldsEnclosedBy == "" {
+		return nil, NewMySqlError(ER_NOT_SUPPORTED_YET, "This version of hardshard doesn't yet support 'LOAD DATA of the fixed-row format into a sharded table'")
+	}
+	if ld.LinesTerminatedBy == "" {
+		return nil, NewMySqlError(ER_NOT_SUPPORTED_YET, "This version of hardshard doesn't yet support 'LOAD DATA with empty LINES TERMINATED BY into a sharded table'")
+	}
+	key, _ := schema.Key(ld.Table.Name)
+	columns := ld.Columns
+	if len(columns) == 0 {
+		fields, err := conn.FieldList(ld.Table.Name, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields {
+			columns = append(columns, f.Name)
+		}
+	}
+	for i, column := range columns {
+		if strings.EqualFold(column, key) {
+			return newRowSplitter(ld, i), nil
+		}
+	}
+	return nil, fmt.Errorf("router: the sharding key %s of table %s is required", key, ld.Table.Name)
+}
+
+// rowSplitter cuts the file of a LOAD DATA into lines by the FIELDS and
+// LINES options, and picks the field of the sharding key out of each. It is
+// fed with the packets of the client, a line may span several of them.
+type rowSplitter struct {
+	fieldsTerminated []byte
+	enclosed         []byte
+	escape           []byte
+	linesStarting    []byte
+	linesTerminated  []byte
+	key              int
+
+	ignoreLines int
+	ignored     int
+
+	// buf holds the lines from head on, the one at head is scanned up to
+	// pos. started is set after its LINES STARTING BY, field is the index
+	// of the current field, which starts at fieldStart.
+	buf        []byte
+	head       int
+	pos        int
+	started    bool
+	quoted     bool
+	field      int
+	fieldStart int
+	keyStart   int
+	keyEnd     int
+}
+
+func newRowSplitter(ld *sqlparser.LoadData, key int) *rowSplitter {
+	s := &rowSplitter{
+		fieldsTerminated: []byte(ld.FieldsTerminatedBy),
+		enclosed:         []byte(ld.FieldsEnclosedBy),
+		linesStarting:    []byte(ld.LinesStartingBy),
+		linesTerminated:  []byte(ld.LinesTerminatedBy),
+		key:              key,
+		ignoreLines:      ld.IgnoreLines,
+	}
+	// like mysql, only the first character of ESCAPED BY is used
+	if ld.FieldsEscapedBy != "" {
+		s.escape = []byte(ld.FieldsEscapedBy[:1])
+	}
+	s.startLine(0)
+	return s
+}
+
+func (s *rowSplitter) startLine(head int) {
+	s.head = head
+	s.pos = head
+	s.started = len(s.linesStarting) == 0
+	s.quoted = false
+	s.field = 0
+	s.fieldStart = head
+	s.keyStart, s.keyEnd = -1, -1
+}
+
+// Write appends the data of a packet, the lines returned by Next are
+// invalid after it.
+func (s *rowSplitter) Write(data []byte) {
+	if s.head > 0 {
+		n := copy(s.buf, s.buf[s.head:])
+		s.buf = s.buf[:n]
+		s.pos -= s.head
+		s.fieldStart -= s.head
+		if s.keyStart >= 0 {
+			s.keyStart -= s.head
+			s.keyEnd -= s.head
+		}
+		s.head = 0
+	}
+	s.buf = append(s.buf, data...)
+}
+
+// match reports whether buf[i:] starts with sep, more is set if the data
+// is too short to tell yet.
+func (s *rowSplitter) match(i int, sep []byte, eof bool) (ok bool, more bool) {
+	if len(sep) == 0 {
+		return false, false
+	}
+	rest := s.buf[i:]
+	if len(rest) >= len(sep) {
+		return bytes.HasPrefix(rest, sep), false
+	}
+	return false, !eof && bytes.HasPrefix(sep, rest)
+}
+
+// Next returns the next complete line, the terminator included, with the
+// value of its sharding key, which is nil if the field is missing or NULL.
+// At the end of the file, the rest is the last line.
+func (s *rowSplitter) Next(eof bool) (line []byte, key *string, ok bool) {
+	i := s.pos
+scan:
+	for i < len(s.buf) {
+		if !s.started {
+			// the bytes before LINES STARTING BY are skipped by mysql
+			m, more := s.match(i, s.linesStarting, eof)
+			switch {
+			case more:
+				break scan
+			case m:
+				i += len(s.linesStarting)
+				s.started = true
+				s.fieldStart = i
+			default:
+				i++
+			}
+			continue
+		}
+		if len(s.escape) > 0 && s.buf[i] == s.escape[0] {
+			if i+1 == len(s.buf) && !eof {
+				break
+			}
+			i += 2
+			continue
+		}
+		if s.quoted {
+			if m, more := s.match(i, s.enclosed, eof); more {
+				break
+			} else if !m {
+				i++
+				continue
+			}
+			// a doubled quote is a quote, the quote followed by a
+			// terminator ends the field, and any other is a quote too
+			next := i + len(s.enclosed)
+			doubled, more1 := s.match(next, s.enclosed, eof)
+			endsField, more2 := s.match(next, s.fieldsTerminated, eof)
+			endsLine, more3 := s.match(next, s.linesTerminated, eof)
+			switch {
+			case doubled:
+				i = next + len(s.enclosed)
+			case endsField || endsLine || next == len(s.buf):
+				s.quoted = false
+				i = next
+			case more1 || more2 || more3:
+				break scan
+			default:
+				i = next
+			}
+			continue
+		}
+		if i == s.fieldStart {
+			if m, more := s.match(i, s.enclosed, eof); more {
+				break
+			} else if m {
+				s.quoted = true
+				i += len(s.enclosed)
+				continue
+			}
+		}
+		if m, more := s.match(i, s.linesTerminated, eof); more {
+			break
+		} else if m {
+			s.endField(i)
+			return s.cut(i + len(s.linesTerminated))
+		}
+		if m, more := s.match(i, s.fieldsTerminated, eof); more {
+			break
+		} else if m {
+			s.endField(i)
+			i += len(s.fieldsTerminated)
+			s.field++
+			s.fieldStart = i
+			continue
+		}
+		i++
+	}
+	if i > len(s.buf) {
+		// an escape character at the end of the file
+		i = len(s.buf)
+	}
+	s.pos = i
+	if eof && s.head < len(s.buf) {
+		if s.started {
+			s.endField(len(s.buf))
+		}
+		return s.cut(len(s.buf))
+	}
+	return nil, nil, false
+}
+
+func (s *rowSplitter) endField(end int) {
+	if s.field == s.key {
+		s.keyStart, s.keyEnd = s.fieldStart, end
+	}
+}
+
+// cut returns the line from head to end, and starts the next one.
+func (s *rowSplitter) cut(end int) ([]byte, *string, bool) {
+	var key *string
+	if s.keyStart >= 0 {
+		key = s.value(s.buf[s.keyStart:s.keyEnd])
+	}
+	line := s.buf[s.head:end]
+	s.startLine(end)
+	return line, key, true
+}
+
+// value unquotes and unescapes a field like mysql, nil is NULL.
+func (s *rowSplitter) value(field []byte) *string {
+	quoted := false
+	if n := len(s.enclosed); n > 0 && len(field) >= 2*n && bytes.HasPrefix(field, s.enclosed) && bytes.HasSuffix(field, s.enclosed) {
+		field = field[n : len(field)-n]
+		quoted = true
+	}
+	if !quoted && len(s.enclosed) > 0 && string(field) == "NULL" {
+		return nil
+	}
+	if len(s.escape) == 0 {
+		v := string(field)
+		return &v
+	}
+	if !quoted && len(field) == 2 && field[0] == s.escape[0] && field[1] == 'N' {
+		return nil
+	}
+	b := make([]byte, 0, len(field))
+	for i := 0; i < len(field); i++ {
+		ch := field[i]
+		if quoted && bytes.HasPrefix(field[i:], s.enclosed) && bytes.HasPrefix(field[i+len(s.enclosed):], s.enclosed) {
+			b = append(b, s.enclosed...)
+			i += 2*len(s.enclosed) - 1
+			continue
+		}
+		if ch == s.escape[0] && i+1 < len(field) {
+			i++
+			switch field[i] {
+			case '0':
+				ch = 0
+			case 'b':
+				ch = '\b'
+			case 'n':
+				ch = '\n'
+			case 'r':
+				ch = '\r'
+			case 't':
+				ch = '\t'
+			case 'Z':
+				ch = 26
+			default:
+				ch = field[i]
+			}
+		}
+		b = append(b, ch)
+	}
+	v := string(b)
+	return &v
+}
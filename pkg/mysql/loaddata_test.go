@@ -0,0 +1,58 @@
+package mysql
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+func TestRowSplitter(t *testing.T) {
+	cases := []struct {
+		ld      sqlparser.LoadData
+		packets []string
+		lines   []string
+		keys    []string
+	}{
+		{
+			sqlparser.LoadData{FieldsTerminatedBy: "\t", FieldsEscapedBy: "\\", LinesTerminatedBy: "\n"},
+			[]string{"1\ta\n2\tb", "\\\n\\N\tc\n", "\\N\td"},
+			[]string{"1\ta\n", "2\tb\\\n\\N\tc\n", "\\N\td"},
+			[]string{"a", "b\nN", "d"},
+		},
+		{
+			sqlparser.LoadData{FieldsTerminatedBy: ",", FieldsEnclosedBy: "\"", FieldsEscapedBy: "\\", LinesTerminatedBy: "\r\n"},
+			[]string{"1,\"x,\r", "\n\"\"y\"\r\n2,NULL\r", "\n3"},
+			[]string{"1,\"x,\r\n\"\"y\"\r\n", "2,NULL\r\n", "3"},
+			[]string{"x,\r\n\"y", "<nil>", "<nil>"},
+		},
+		{
+			sqlparser.LoadData{FieldsTerminatedBy: ",", LinesStartingBy: "xx", LinesTerminatedBy: "\n"},
+			[]string{"skip\nxx1,", "k1\nx", "x2,k2\n"},
+			[]string{"skip\nxx1,k1\n", "xx2,k2\n"},
+			[]string{"k1", "k2"},
+		},
+	}
+	for _, c := range cases {
+		s := newRowSplitter(&c.ld, 1)
+		lines, keys := []string{}, []string{}
+		for i, p := range append(c.packets, "") {
+			s.Write([]byte(p))
+			for {
+				line, key, ok := s.Next(i == len(c.packets))
+				if !ok {
+					break
+				}
+				lines = append(lines, string(line))
+				if key == nil {
+					keys = append(keys, "<nil>")
+				} else {
+					keys = append(keys, *key)
+				}
+			}
+		}
+		if !reflect.DeepEqual(lines, c.lines) || !reflect.DeepEqual(keys, c.keys) {
+			t.Fatalf("bad result of %q: %q %q, expected: %q %q", c.packets, lines, keys, c.lines, c.keys)
+		}
+	}
+}
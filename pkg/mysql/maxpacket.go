@@ -0,0 +1,51 @@
+package mysql
+
+// The proxy has a max_allowed_packet of its own, the packets of the clients
+// over it are refused with ER_NET_PACKET_TOO_LARGE before they are read.
+// https://dev.mysql.com/doc/refman/8.0/en/packet-too-large.html
+
+import (
+	"strings"
+
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+// isSelectMaxAllowedPacket matches `SELECT @@[{GLOBAL | SESSION}.]max_allowed_packet [[AS] alias]`,
+// it returns the name of the column.
+func isSelectMaxAllowedPacket(query string) (string, bool) {
+	s := sqlparser.NewScanner(query)
+	if !s.Accept("select") {
+		return "", false
+	}
+	t := s.Next()
+	if t.Type != sqlparser.TOKEN_VARIABLE {
+		return "", false
+	}
+	name := strings.ToLower(t.Value)
+	for _, scope := range []string{"@@global.", "@@session.", "@@local.", "@@"} {
+		if strings.HasPrefix(name, scope) {
+			name = name[len(scope):]
+			break
+		}
+	}
+	if name != "max_allowed_packet" {
+		return "", false
+	}
+	column := t.Value
+	if s.Accept("as") || s.Peek().Type != sqlparser.TOKEN_PUNCT {
+		alias := s.Next()
+		switch alias.Type {
+		case sqlparser.TOKEN_IDENT, sqlparser.TOKEN_QUOTED_IDENT:
+			column = alias.Name()
+		case sqlparser.TOKEN_STRING:
+			column = sqlparser.Unquote(alias.Value)
+		default:
+			return "", false
+		}
+	}
+	return column, s.EOF()
+}
+
+func (c *Connection) handleSelectMaxAllowedPacket(column string) error {
+	return c.writeResultSet(NewResultSet([]string{column}, [][]interface{}{{c.env.maxAllowedPacket}}))
+}
@@ -0,0 +1,27 @@
+package mysql
+
+import (
+	"testing"
+)
+
+func TestIsSelectMaxAllowedPacket(t *testing.T) {
+	cases := []struct {
+		query  string
+		column string
+		ok     bool
+	}{
+		{"SELECT @@max_allowed_packet", "@@max_allowed_packet", true},
+		{"select @@GLOBAL.max_allowed_packet;", "@@GLOBAL.max_allowed_packet", true},
+		{"SELECT @@session.max_allowed_packet AS `size`", "size", true},
+		{"SELECT @@max_allowed_packet size", "size", true},
+		{"SELECT @@max_allowed_packet, @@version", "", false},
+		{"SELECT @@net_buffer_length", "", false},
+		{"SELECT @max_allowed_packet", "", false},
+	}
+	for _, c := range cases {
+		column, ok := isSelectMaxAllowedPacket(c.query)
+		if ok != c.ok || (ok && column != c.column) {
+			t.Fatalf("%s: bad result: %q %v, expected: %q %v", c.query, column, ok, c.column, c.ok)
+		}
+	}
+}
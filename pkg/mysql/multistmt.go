@@ -0,0 +1,36 @@
+package mysql
+
+// With CLIENT_MULTI_STATEMENTS a COM_QUERY may carry several statements,
+// each of them is routed on its own and their responses are chained by
+// SERVER_MORE_RESULTS_EXISTS.
+// https://dev.mysql.com/doc/internals/en/multi-statement.html
+
+import (
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+func (c *Connection) handleComQuery(query string) error {
+	if c.capabilities&CLIENT_MULTI_STATEMENTS == 0 {
+		return c.handleQuery(query)
+	}
+	stmts := sqlparser.Split(query)
+	if len(stmts) < 2 {
+		return c.handleQuery(query)
+	}
+	for i, stmt := range stmts {
+		if i < len(stmts)-1 {
+			c.status |= SERVER_MORE_RESULTS_EXISTS
+		}
+		err := c.handleQuery(stmt)
+		c.status &^= SERVER_MORE_RESULTS_EXISTS
+		if err != nil || c.isClosed {
+			return err
+		}
+		// like mysql, the statements after a failed one are skipped, the
+		// ERR packet ends the responses
+		if c.stats.errorCode != 0 {
+			return nil
+		}
+	}
+	return nil
+}
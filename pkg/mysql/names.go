@@ -0,0 +1,128 @@
+package mysql
+
+// The client charset comes from the handshake and is changed by SET NAMES and
+// SET CHARACTER SET. The session always holds one of the variables "names" or
+// "charset", so the borrowed backend connections get the same charset.
+// https://dev.mysql.com/doc/refman/5.7/en/charset-connection.html
+
+import (
+	"strings"
+
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+// setCollation sets the client collation, an unknown one falls back to the
+// default of the proxy like mysql.
+func (c *Connection) setCollation(id CollationId) {
+	if _, ok := Collations[id]; !ok {
+		id = c.env.collationId
+	}
+	c.collationId = id
+	c.clearCharsetVars()
+	c.vars["names"] = NamesValue(id)
+}
+
+// clearCharsetVars forgets the charset variables overridden by SET NAMES
+// and SET CHARACTER SET.
+func (c *Connection) clearCharsetVars() {
+	for _, name := range []string{"names", "charset", "character_set_client", "character_set_connection", "character_set_results", "collation_connection"} {
+		delete(c.vars, name)
+	}
+}
+
+// setCharsetVar handles the SET of the charset variables, ok is false for
+// the other variables.
+func (c *Connection) setCharsetVar(e *sqlparser.SetExpr) (ok bool, err error) {
+	switch e.Name {
+	case "names":
+		id, err := parseNames(e.Value, c.env.collationId)
+		if err != nil {
+			return true, err
+		}
+		c.setCollation(id)
+	case "charset":
+		charset, err := parseCharsetName(sqlparser.NewScanner(e.Value))
+		if err != nil {
+			return true, err
+		}
+		if charset == "default" {
+			c.setCollation(c.env.collationId)
+			break
+		}
+		c.clearCharsetVars()
+		c.collationId = CharsetIds[charset]
+		c.vars["charset"] = charset
+	case "character_set_client", "character_set_connection", "character_set_results":
+		charset := strings.ToLower(sqlparser.Unquote(e.Value))
+		if charset == "null" || charset == "default" {
+			return false, nil
+		}
+		id, ok := CharsetIds[charset]
+		if !ok {
+			return true, NewDefaultMySqlError(ER_UNKNOWN_CHARACTER_SET, charset)
+		}
+		if e.Name == "character_set_client" {
+			c.collationId = id
+		}
+		return false, nil
+	case "collation_connection":
+		collation := strings.ToLower(sqlparser.Unquote(e.Value))
+		if _, ok := CollationNames[collation]; !ok && collation != "default" {
+			return true, NewDefaultMySqlError(ER_UNKNOWN_COLLATION, collation)
+		}
+		return false, nil
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// parseNames parses `charset [COLLATE collation] | DEFAULT` of SET NAMES,
+// DEFAULT is the given default collation.
+func parseNames(value string, defaultId CollationId) (CollationId, error) {
+	s := sqlparser.NewScanner(value)
+	charset, err := parseCharsetName(s)
+	if err != nil {
+		return 0, err
+	}
+	if charset == "default" {
+		return defaultId, nil
+	}
+	id := CharsetIds[charset]
+	if s.Accept("collate") {
+		t := s.Next()
+		collation := strings.ToLower(t.Name())
+		if t.Type == sqlparser.TOKEN_STRING {
+			collation = strings.ToLower(sqlparser.Unquote(t.Value))
+		}
+		var ok bool
+		if id, ok = CollationNames[collation]; !ok {
+			return 0, NewDefaultMySqlError(ER_UNKNOWN_COLLATION, collation)
+		}
+		if CollationCharset(collation) != charset {
+			return 0, NewDefaultMySqlError(ER_COLLATION_CHARSET_MISMATCH, collation, charset)
+		}
+	}
+	if !s.EOF() {
+		return 0, NewDefaultMySqlError(ER_PARSE_ERROR, "You have an error in your SQL syntax", value, 1)
+	}
+	return id, nil
+}
+
+// parseCharsetName reads a known charset name or DEFAULT, lower cased.
+func parseCharsetName(s *sqlparser.Scanner) (string, error) {
+	t := s.Next()
+	var charset string
+	switch t.Type {
+	case sqlparser.TOKEN_IDENT, sqlparser.TOKEN_QUOTED_IDENT:
+		charset = strings.ToLower(t.Name())
+	case sqlparser.TOKEN_STRING:
+		charset = strings.ToLower(sqlparser.Unquote(t.Value))
+	default:
+		return "", NewDefaultMySqlError(ER_PARSE_ERROR, "You have an error in your SQL syntax", t.Value, 1)
+	}
+	if _, ok := CharsetIds[charset]; !ok && charset != "default" {
+		return "", NewDefaultMySqlError(ER_UNKNOWN_CHARACTER_SET, charset)
+	}
+	return charset, nil
+}
@@ -0,0 +1,57 @@
+package mysql
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+func TestParseNames(t *testing.T) {
+	cases := []struct {
+		value string
+		id    CollationId
+		code  uint16
+	}{
+		{"utf8mb4", 45, 0},
+		{"'UTF8MB4' COLLATE 'utf8mb4_bin'", 46, 0},
+		{"latin1 collate latin1_bin", 47, 0},
+		{"utf8mb4 COLLATE utf8mb4_ja_0900_as_cs", 303, 0},
+		{"DEFAULT", DEFAULT_COLLATION_ID, 0},
+		{"utf9", 0, ER_UNKNOWN_CHARACTER_SET},
+		{"utf8mb4 COLLATE utf8mb4_nope", 0, ER_UNKNOWN_COLLATION},
+		{"utf8mb4 COLLATE latin1_bin", 0, ER_COLLATION_CHARSET_MISMATCH},
+	}
+	for _, c := range cases {
+		id, err := parseNames(c.value, DEFAULT_COLLATION_ID)
+		code := uint16(0)
+		if err != nil {
+			code = err.(*MySqlError).Code
+		}
+		if id != c.id || code != c.code {
+			t.Fatalf("%s: bad result: %d %d, expected: %d %d", c.value, id, code, c.id, c.code)
+		}
+	}
+}
+
+func TestSetCharsetVar(t *testing.T) {
+	conn, client := setupConnnection()
+	defer client.Close()
+	conn.vars["character_set_results"] = "NULL"
+	exprs, _ := sqlparser.ParseSet("SET CHARACTER SET gbk")
+	if ok, err := conn.setCharsetVar(exprs[0]); !ok || err != nil {
+		t.Fatalf("bad result: %v %v", ok, err)
+	}
+	expected := map[string]string{"charset": "gbk"}
+	if !reflect.DeepEqual(conn.vars, expected) || conn.collationId != 28 {
+		t.Fatalf("bad result: %v %d, expected: %v %d", conn.vars, conn.collationId, expected, 28)
+	}
+	exprs, _ = sqlparser.ParseSet("SET NAMES utf8mb4 COLLATE utf8mb4_unicode_ci")
+	if ok, err := conn.setCharsetVar(exprs[0]); !ok || err != nil {
+		t.Fatalf("bad result: %v %v", ok, err)
+	}
+	expected = map[string]string{"names": "utf8mb4 COLLATE utf8mb4_unicode_ci"}
+	if !reflect.DeepEqual(conn.vars, expected) || conn.collationId != 224 {
+		t.Fatalf("bad result: %v %d, expected: %v %d", conn.vars, conn.collationId, expected, 224)
+	}
+}
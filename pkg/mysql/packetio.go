@@ -12,18 +12,65 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 )
 
 const (
 	MAX_PACKET_PAYLOAD_LENGTH = 1<<24 - 1 // 16mb
+	PACKET_HEADER_SIZE        = 4
+	// PACKET_BUFFER_SIZE is the size of the buffered reader and writer of a connection
+	PACKET_BUFFER_SIZE = 8 * 1024
+	// MAX_POOLED_PAYLOAD_SIZE bounds the payload buffer kept for the next reads,
+	// a larger one is dropped once it is read
+	MAX_POOLED_PAYLOAD_SIZE = 1024 * 1024
+	// the default and the range of max_allowed_packet, like mysql 8.0
+	DEFAULT_MAX_ALLOWED_PACKET = 64 * 1024 * 1024
+	MIN_MAX_ALLOWED_PACKET     = 1024
+	MAX_MAX_ALLOWED_PACKET     = 1024 * 1024 * 1024
 )
 
 type PacketIO struct {
 	r        io.Reader
 	w        io.Writer
 	Sequence uint8
+	// MaxPacketSize limits the payloads read, 0 for no limit. ReadPacket
+	// fails with ErrPacketTooLarge before it reads a larger one.
+	MaxPacketSize int
+
+	// buffers are the pooled buffers of NewBufferedPacketIO, the packets
+	// written stay in bw until Flush, or until the next read
+	buffers *packetBuffers
+	bw      *bufio.Writer
+	// payload is reused by the reads, header by the reads and the writes
+	payload []byte
+	header  [4]byte
+
+	// compressed is set once the compressed protocol is on, r and w go
+	// through it then
+	compressed *compressedIO
+}
+
+type packetBuffers struct {
+	r       *bufio.Reader
+	w       *bufio.Writer
+	payload []byte
 }
 
+var packetBuffersPool = sync.Pool{
+	New: func() interface{} {
+		return &packetBuffers{
+			r: bufio.NewReaderSize(nil, PACKET_BUFFER_SIZE),
+			w: bufio.NewWriterSize(nil, PACKET_BUFFER_SIZE),
+		}
+	},
+}
+
+// releasedIO stands for the reader and the writer of a released PacketIO.
+type releasedIO struct{}
+
+func (releasedIO) Read(p []byte) (int, error)  { return 0, io.ErrClosedPipe }
+func (releasedIO) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
 type PacketReader struct {
 	buf    []byte
 	buffer *bytes.Buffer
@@ -37,70 +84,207 @@ func NewPacketIO(r io.Reader, w io.Writer) *PacketIO {
 	return pio
 }
 
+// NewBufferedPacketIO buffers the reads and the writes with the pooled
+// buffers, the packets written are sent on Flush. Release puts the buffers
+// back to the pool.
+func NewBufferedPacketIO(r io.Reader, w io.Writer) *PacketIO {
+	b := packetBuffersPool.Get().(*packetBuffers)
+	b.r.Reset(r)
+	b.w.Reset(w)
+	pio := NewPacketIO(b.r, b.w)
+	pio.buffers = b
+	pio.bw = b.w
+	pio.payload = b.payload
+	return pio
+}
+
 func NewPacketIOByConn(conn net.Conn) *PacketIO {
-	r := bufio.NewReaderSize(conn, 1024*8)
-	w := conn
-	return NewPacketIO(r, w)
+	return NewBufferedPacketIO(conn, conn)
+}
+
+// Release puts the buffers back to the pool, the PacketIO is not usable
+// after it. It is up to the owner of the connection, nobody else may touch
+// the PacketIO then.
+func (pio *PacketIO) Release() {
+	b := pio.buffers
+	if b == nil {
+		return
+	}
+	b.r.Reset(nil)
+	b.w.Reset(nil)
+	b.payload = nil
+	if cap(pio.payload) <= MAX_POOLED_PAYLOAD_SIZE {
+		b.payload = pio.payload[:0]
+	}
+	packetBuffersPool.Put(b)
+
+	pio.buffers, pio.bw, pio.payload, pio.compressed = nil, nil, nil, nil
+	pio.r, pio.w = releasedIO{}, releasedIO{}
 }
 
 func (pio *PacketIO) ResetSequence() {
 	pio.Sequence = 0
+	if pio.compressed != nil {
+		pio.compressed.Sequence = 0
+	}
 }
 
-func (pio *PacketIO) ReadPacket() ([]byte, error) {
-	// [length: byte[3]][sequence_id: byte[1]][playload: byte[length]]
-	header := []byte{0, 0, 0, 0}
-
-	_, err := io.ReadFull(pio.r, header)
-	if err != nil {
-		return nil, ErrBadConn
+// EnableCompression switches to the compressed protocol, it is called
+// right after the OK of the authentication. The compressed packets are
+// held to the MaxPacketSize set by then, with the header of a packet.
+func (pio *PacketIO) EnableCompression() {
+	pio.compressed = newCompressedIO(pio.r, pio.w)
+	if pio.MaxPacketSize > 0 {
+		pio.compressed.maxLength = pio.MaxPacketSize + PACKET_HEADER_SIZE
 	}
+	pio.r = pio.compressed
+	pio.w = pio.compressed
+}
+
+// EnableZstdCompression switches to the compressed protocol with zstd at
+// the level, like EnableCompression.
+func (pio *PacketIO) EnableZstdCompression(level int) {
+	pio.EnableCompression()
+	pio.compressed.zstd = zstdEncoder(level)
+}
 
-	length := uint32(header[0]) + uint32(header[1])<<8 + uint32(header[2])<<16
+// Compressed reports whether the compressed protocol is on.
+func (pio *PacketIO) Compressed() bool {
+	return pio.compressed != nil
+}
 
-	sequence := uint8(header[3])
-	if pio.Sequence != sequence {
-		return nil, fmt.Errorf("invalid sequence: packet sequence(%d) != pio.Sequence(%d)", sequence, pio.Sequence)
+// Flush sends the buffered packets. Like net_flush of mysql, the sequence
+// of the packets goes on from the sequence of the compressed packets with
+// the compressed protocol.
+func (pio *PacketIO) Flush() error {
+	if pio.compressed != nil {
+		if err := pio.compressed.Flush(); err != nil {
+			return ErrBadConn
+		}
+		pio.Sequence = pio.compressed.Sequence
 	}
+	if pio.bw != nil {
+		if err := pio.bw.Flush(); err != nil {
+			return ErrBadConn
+		}
+	}
+	return nil
+}
 
-	pio.Sequence++
-
-	// 恰好 16Mb 的 packet 后面会追加一个长度为 0 的 packet
-	if length == 0 {
-		return []byte{}, nil
+// buffered reports whether some packets written are not sent yet.
+func (pio *PacketIO) buffered() bool {
+	if pio.compressed != nil && len(pio.compressed.wbuf) > 0 {
+		return true
 	}
+	return pio.bw != nil && pio.bw.Buffered() > 0
+}
 
-	// TODO: reuse the buffer ?
-	payload := make([]byte, length)
-	_, err = io.ReadFull(pio.r, payload)
-	if err != nil {
-		return nil, ErrBadConn
+// ReadPacket reads the payload of the next packet, the packets of a
+// payload over 16MB are joined. The payload is read into a buffer reused by
+// the next read, the caller copies what it keeps.
+func (pio *PacketIO) ReadPacket() ([]byte, error) {
+	// the peer waits for the packets written before it answers
+	if pio.buffered() {
+		if err := pio.Flush(); err != nil {
+			return nil, err
+		}
 	}
 
-	if length < MAX_PACKET_PAYLOAD_LENGTH {
-		return payload, nil
-	} else {
-		// https://dev.mysql.com/doc/internals/en/sending-more-than-16mbyte.html
-		// If the payload is larger than or equal to 2**24-1 bytes the length is set to 2**24-1
-		// (0xffffff) and a additional packets are sent with the rest of the payload until
-		// the payload of a packet is less than 2**24-1 bytes.
-		nextPayload, err := pio.ReadPacket()
+	if pio.payload == nil || cap(pio.payload) > MAX_POOLED_PAYLOAD_SIZE {
+		pio.payload = make([]byte, 0, PACKET_BUFFER_SIZE)
+	}
+	payload := pio.payload[:0]
+	for {
+		length, err := pio.readHeader()
 		if err != nil {
 			return nil, err
 		}
-		// TODO: 这里性能不好，埋指标计数 slow path
-		return append(payload, nextPayload...), nil
+		// 恰好 16Mb 的 packet 后面会追加一个长度为 0 的 packet
+		if length == 0 {
+			break
+		}
+
+		start := len(payload)
+		if pio.MaxPacketSize > 0 && start+length > pio.MaxPacketSize {
+			return nil, ErrPacketTooLarge
+		}
+		if start+length > cap(payload) {
+			// https://dev.mysql.com/doc/internals/en/sending-more-than-16mbyte.html
+			// If the payload is larger than or equal to 2**24-1 bytes the length is set to 2**24-1
+			// (0xffffff) and a additional packets are sent with the rest of the payload until
+			// the payload of a packet is less than 2**24-1 bytes.
+			// 后面还有 packet 时预留一个 packet 的空间，再多就翻倍，免得每个 packet 都拷贝一遍
+			size := start + length
+			if length == MAX_PACKET_PAYLOAD_LENGTH {
+				size += MAX_PACKET_PAYLOAD_LENGTH
+				if size < 2*cap(payload) {
+					size = 2 * cap(payload)
+				}
+				// the reservation never goes past the limit, it fails first
+				if pio.MaxPacketSize > 0 && size > pio.MaxPacketSize {
+					size = pio.MaxPacketSize
+				}
+			}
+			buf := make([]byte, start, size)
+			copy(buf, payload)
+			payload = buf
+		}
+		payload = payload[:start+length]
+		if _, err := io.ReadFull(pio.r, payload[start:]); err != nil {
+			if err == ErrPacketTooLarge {
+				return nil, err
+			}
+			return nil, ErrBadConn
+		}
+		if length < MAX_PACKET_PAYLOAD_LENGTH {
+			break
+		}
+	}
+	pio.payload = payload
+	return payload, nil
+}
+
+// readHeader reads the header of a packet and checks its sequence, it
+// returns the length of the payload.
+func (pio *PacketIO) readHeader() (int, error) {
+	// [length: byte[3]][sequence_id: byte[1]][playload: byte[length]]
+	header := pio.header[:]
+	if _, err := io.ReadFull(pio.r, header); err != nil {
+		if err == ErrPacketTooLarge {
+			return 0, err
+		}
+		return 0, ErrBadConn
+	}
+
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+
+	sequence := uint8(header[3])
+	if pio.compressed != nil {
+		// mysql does not check the sequence of the packets in compressed
+		// packets, it goes on from the sequence of the compressed packets
+		pio.Sequence = pio.compressed.Sequence
+	} else if pio.Sequence != sequence {
+		return 0, fmt.Errorf("invalid sequence: packet sequence(%d) != pio.Sequence(%d)", sequence, pio.Sequence)
+	} else {
+		pio.Sequence++
 	}
+	return length, nil
 }
 
+// WritePacket writes the payload in packets, with the buffered PacketIO
+// they are sent on Flush.
 func (pio *PacketIO) WritePacket(payload []byte) error {
-	for len(payload) > 0 {
+	// 如果 payload 恰好是 16MB 的整数倍，后面追加一个长度为 0 的 packet，
+	// 一个空的 payload 也写成一个长度为 0 的 packet，比如 LOAD DATA LOCAL 的文件结尾
+	// https://github.com/Qihoo360/Atlas/blob/128b0544cefc800366f70e534c5130f35574721c/src/network-mysqld.c#L364
+	for {
 		length := len(payload)
 		if length >= MAX_PACKET_PAYLOAD_LENGTH {
 			length = MAX_PACKET_PAYLOAD_LENGTH
 		}
 
-		header := []byte{byte(length), byte(length >> 8), byte(length >> 16), pio.Sequence}
+		header := pio.header[:]
+		header[0], header[1], header[2], header[3] = byte(length), byte(length>>8), byte(length>>16), pio.Sequence
 		n, err := pio.w.Write(header)
 		if err != nil || n != 4 {
 			return ErrBadConn
@@ -112,21 +296,11 @@ func (pio *PacketIO) WritePacket(payload []byte) error {
 		}
 		pio.Sequence++
 
-		// 如果 payload 恰好等于 16MB，后面追加一个长度为 0 的 packet
-		// https://github.com/Qihoo360/Atlas/blob/128b0544cefc800366f70e534c5130f35574721c/src/network-mysqld.c#L364
-		if len(payload) == MAX_PACKET_PAYLOAD_LENGTH {
-			header := []byte{0, 0, 0, pio.Sequence}
-			n, err := pio.w.Write(header)
-			if err != nil || n != 4 {
-				return ErrBadConn
-			}
-			pio.Sequence++
+		if length < MAX_PACKET_PAYLOAD_LENGTH {
 			return nil
 		}
-
 		payload = payload[length:]
 	}
-	return nil
 }
 
 func (pio *PacketIO) NewPacketReader() (*PacketReader, error) {
@@ -173,7 +347,7 @@ func (pr *PacketReader) ReadUint24() (uint32, error) {
 	if err != nil {
 		return 0, err
 	}
-	num := uint32(buf[1]) | uint32(buf[2])<<8 | uint32(buf[3])<<16
+	num := uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16
 	return num, nil
 }
 
@@ -136,3 +136,213 @@ func TestWritePacket4(t *testing.T) {
 		t.Fatalf("invalid header: %v", bbuf)
 	}
 }
+
+func TestCompressedPacketIO(t *testing.T) {
+	// zlib, and zstd at a level
+	for _, level := range []int{0, DEFAULT_ZSTD_LEVEL} {
+		enable := func(pio *PacketIO) {
+			if level == 0 {
+				pio.EnableCompression()
+			} else {
+				pio.EnableZstdCompression(level)
+			}
+		}
+		buf := bytes.NewBufferString("")
+		w := NewPacketIO(buf, buf)
+		enable(w)
+		small := []byte("\x03select 1")
+		large := bytes.Repeat([]byte("hardshard"), 100)
+		for _, payload := range [][]byte{small, large} {
+			if err := w.WritePacket(payload); err != nil {
+				t.Fatalf("err on WritePacket: %s", err)
+			}
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("the packets are sent before Flush: %v", buf.Bytes())
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("err on Flush: %s", err)
+		}
+		// both packets in a compressed packet of sequence 0, which shrinks
+		header := buf.Bytes()[:7]
+		length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		uncompressedLength := int(header[4]) | int(header[5])<<8 | int(header[6])<<16
+		if header[3] != 0 || length >= uncompressedLength || uncompressedLength != len(small)+len(large)+8 {
+			t.Fatalf("invalid compressed header: %v", header)
+		}
+		// a zstd frame starts with its magic number
+		if magic := buf.Bytes()[7:11]; level > 0 && !bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+			t.Fatalf("not a zstd frame: %v", magic)
+		}
+		if w.Sequence != 1 {
+			t.Fatalf("the sequence does not go on from the compressed one: %d", w.Sequence)
+		}
+
+		r := NewPacketIO(buf, buf)
+		enable(r)
+		for _, expected := range [][]byte{small, large} {
+			payload, err := r.ReadPacket()
+			if err != nil {
+				t.Fatalf("err on ReadPacket: %s", err)
+			}
+			if !bytes.Equal(payload, expected) {
+				t.Fatalf("payload not equal\npayload: %q\nexpected: %q", payload, expected)
+			}
+		}
+		if r.Sequence != 1 {
+			t.Fatalf("bad sequence: %d", r.Sequence)
+		}
+	}
+}
+
+func TestBufferedPacketIO(t *testing.T) {
+	buf := bytes.NewBufferString("")
+	pio := NewBufferedPacketIO(buf, buf)
+	defer pio.Release()
+	large := bytes.Repeat([]byte{'6'}, MAX_PACKET_PAYLOAD_LENGTH*2+1)
+	for _, payload := range [][]byte{[]byte("\x03select 1"), large} {
+		pio.ResetSequence()
+		if err := pio.WritePacket(payload); err != nil {
+			t.Fatalf("err on WritePacket: %s", err)
+		}
+		// the packets larger than the buffer go through
+		if len(payload) < PACKET_BUFFER_SIZE && buf.Len() != 0 {
+			t.Fatalf("the packet is sent before Flush: %v", buf.Bytes())
+		}
+		if err := pio.Flush(); err != nil {
+			t.Fatalf("err on Flush: %s", err)
+		}
+		pio.ResetSequence()
+		got, err := pio.ReadPacket()
+		if err != nil {
+			t.Fatalf("err on ReadPacket: %s", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("payload not equal: %d bytes, expected: %d bytes", len(got), len(payload))
+		}
+	}
+}
+
+func TestReadPacketTooLarge(t *testing.T) {
+	for _, length := range []int{2048, MAX_PACKET_PAYLOAD_LENGTH + 1} {
+		buf := bytes.NewBufferString("")
+		NewPacketIO(buf, buf).WritePacket(make([]byte, length))
+		pio := NewPacketIO(buf, buf)
+		pio.MaxPacketSize = length - 1
+		if _, err := pio.ReadPacket(); err != ErrPacketTooLarge {
+			t.Fatalf("%d bytes: bad result: %v, expected: %v", length, err, ErrPacketTooLarge)
+		}
+		// the packet over the limit is not read
+		if buf.Len() != length%MAX_PACKET_PAYLOAD_LENGTH {
+			t.Fatalf("%d bytes: the payload is read: %d bytes left", length, buf.Len())
+		}
+	}
+}
+
+func TestReadPacketLimitReserve(t *testing.T) {
+	length := MAX_PACKET_PAYLOAD_LENGTH + 10
+	buf := bytes.NewBufferString("")
+	NewPacketIO(buf, buf).WritePacket(make([]byte, length))
+	pio := NewPacketIO(buf, buf)
+	pio.MaxPacketSize = length
+	got, err := pio.ReadPacket()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// no room is reserved past the limit for the packets that follow
+	if len(got) != length || cap(got) != length {
+		t.Fatalf("bad result: %d bytes, %d reserved, expected: %d", len(got), cap(got), length)
+	}
+}
+
+func TestCompressedPacketTooLarge(t *testing.T) {
+	buf := bytes.NewBufferString("")
+	w := NewPacketIO(buf, buf)
+	w.EnableCompression()
+	w.WritePacket(make([]byte, 2048))
+	w.Flush()
+	// the zeros shrink, the uncompressed length goes over the limit
+	left := buf.Len() - COMPRESSED_HEADER_SIZE
+	r := NewPacketIO(buf, buf)
+	r.MaxPacketSize = 2047
+	r.EnableCompression()
+	if _, err := r.ReadPacket(); err != ErrPacketTooLarge {
+		t.Fatalf("bad result: %v, expected: %v", err, ErrPacketTooLarge)
+	}
+	if buf.Len() != left {
+		t.Fatalf("the compressed payload is read: %d bytes left, expected: %d", buf.Len(), left)
+	}
+}
+
+func TestReadUint24(t *testing.T) {
+	pr := &PacketReader{buffer: bytes.NewBuffer([]byte{0xfd, 0x01, 0x02, 0x03})}
+	n, isNull, err := pr.ReadLencInt()
+	if err != nil || isNull || n != 0x030201 {
+		t.Fatalf("bad result: %d %v %v, expected: %d", n, isNull, err, 0x030201)
+	}
+}
+
+// loopReader reads data over and over, like a connection which never runs dry.
+type loopReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.pos:])
+	r.pos = (r.pos + n) % len(r.data)
+	return n, nil
+}
+
+// countingWriter counts the writes, each of them is a syscall on a connection.
+type countingWriter struct {
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func benchmarkReadPacket(b *testing.B, length int) {
+	buf := bytes.NewBufferString("")
+	NewPacketIO(buf, buf).WritePacket(bytes.Repeat([]byte{'x'}, length))
+	pio := NewBufferedPacketIO(&loopReader{data: buf.Bytes()}, &countingWriter{})
+	b.SetBytes(int64(length))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pio.ResetSequence()
+		if _, err := pio.ReadPacket(); err != nil {
+			b.Fatalf("err on ReadPacket: %s", err)
+		}
+	}
+}
+
+func BenchmarkReadPacket(b *testing.B) {
+	benchmarkReadPacket(b, 128)
+}
+
+func BenchmarkReadLargePacket(b *testing.B) {
+	benchmarkReadPacket(b, MAX_PACKET_PAYLOAD_LENGTH*2+1024)
+}
+
+func BenchmarkWritePacket(b *testing.B) {
+	w := &countingWriter{}
+	pio := NewBufferedPacketIO(&loopReader{data: []byte{0}}, w)
+	payload := bytes.Repeat([]byte{'x'}, 128)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := pio.WritePacket(payload); err != nil {
+			b.Fatalf("err on WritePacket: %s", err)
+		}
+		// a response of 100 rows
+		if i%100 == 99 {
+			pio.Flush()
+		}
+	}
+	pio.Flush()
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
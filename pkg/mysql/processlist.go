@@ -0,0 +1,360 @@
+package mysql
+
+// SHOW PROCESSLIST and information_schema.PROCESSLIST list the sessions of
+// the proxy, the sessions of the backends are private to the proxy.
+// https://dev.mysql.com/doc/refman/5.7/en/show-processlist.html
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+// SHOW PROCESSLIST cuts the statements without FULL
+const PROCESSLIST_INFO_LENGTH = 100
+
+var commandNames = map[byte]string{
+	COM_SLEEP:               "Sleep",
+	COM_QUIT:                "Quit",
+	COM_INIT_DB:             "Init DB",
+	COM_QUERY:               "Query",
+	COM_FIELD_LIST:          "Field List",
+	COM_CREATE_DB:           "Create DB",
+	COM_DROP_DB:             "Drop DB",
+	COM_REFRESH:             "Refresh",
+	COM_SHUTDOWN:            "Shutdown",
+	COM_STATISTICS:          "Statistics",
+	COM_PROCESS_INFO:        "Processlist",
+	COM_CONNECT:             "Connect",
+	COM_PROCESS_KILL:        "Kill",
+	COM_DEBUG:               "Debug",
+	COM_PING:                "Ping",
+	COM_TIME:                "Time",
+	COM_DELAYED_INSERT:      "Delayed insert",
+	COM_CHANGE_USER:         "Change user",
+	COM_BINLOG_DUMP:         "Binlog Dump",
+	COM_TABLE_DUMP:          "Table Dump",
+	COM_CONNECT_OUT:         "Connect Out",
+	COM_REGISTER_SLAVE:      "Register Slave",
+	COM_STMT_PREPARE:        "Prepare",
+	COM_STMT_EXECUTE:        "Execute",
+	COM_STMT_SEND_LONG_DATA: "Long Data",
+	COM_STMT_CLOSE:          "Close stmt",
+	COM_STMT_RESET:          "Reset stmt",
+	COM_SET_OPTION:          "Set option",
+	COM_STMT_FETCH:          "Fetch",
+	COM_DAEMON:              "Daemon",
+	COM_BINLOG_DUMP_GTID:    "Binlog Dump GTID",
+	COM_RESET_CONNECTION:    "Reset Connection",
+}
+
+// processInfo is what the session is doing, it is written by the session
+// and read by the others.
+type processInfo struct {
+	user    string
+	db      string
+	command byte
+	state   string
+	info    string
+	since   time.Time
+}
+
+func (c *Connection) setProcess(command byte, state string, info string) {
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	c.process = processInfo{user: c.user, db: c.db, command: command, state: state, info: info, since: time.Now()}
+}
+
+func (c *Connection) setProcessState(state string) {
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	c.process.state = state
+}
+
+func (c *Connection) processInfo() processInfo {
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	return c.process
+}
+
+// backendThreads returns the backend connections of the session as node:thread_id.
+func (c *Connection) backendThreads() string {
+	conns := c.pinnedBackends()
+	threads := make([]string, 0, len(conns))
+	for _, conn := range conns {
+		threads = append(threads, fmt.Sprintf("%s:%d", conn.Node(), conn.ThreadId()))
+	}
+	sort.Strings(threads)
+	return strings.Join(threads, ",")
+}
+
+// processList returns the rows of the sessions visible to the user, only
+// the admins see the sessions of the others, like the PROCESS privilege.
+func (c *Connection) processList(full bool, withBackends bool) [][]interface{} {
+	admin := c.isAdmin()
+	now := time.Now()
+	rows := [][]interface{}{}
+	for _, conn := range c.env.connections() {
+		p := conn.processInfo()
+		if !admin && p.user != c.user {
+			continue
+		}
+		var db, info interface{}
+		if p.db != "" {
+			db = p.db
+		}
+		if p.info != "" {
+			if !full && len(p.info) > PROCESSLIST_INFO_LENGTH {
+				p.info = p.info[:PROCESSLIST_INFO_LENGTH]
+			}
+			info = p.info
+		}
+		user := p.user
+		if p.command == COM_CONNECT {
+			user = "unauthenticated user"
+		}
+		row := []interface{}{int64(conn.connectionId), user, conn.conn.RemoteAddr().String(), db,
+			commandNames[p.command], int64(now.Sub(p.since) / time.Second), p.state, info}
+		if withBackends {
+			row = append(row, conn.backendThreads())
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+var processListColumns = []string{"Id", "User", "Host", "db", "Command", "Time", "State", "Info"}
+
+// isShowProcessList matches `SHOW [FULL] PROCESSLIST`.
+func isShowProcessList(query string) (full bool, ok bool) {
+	s := sqlparser.NewScanner(query)
+	s.Accept("show")
+	full = s.Accept("full")
+	return full, s.Accept("processlist") && s.EOF()
+}
+
+func (c *Connection) handleShowProcessList(full bool) error {
+	return c.writeResultSet(NewResultSet(processListColumns, c.processList(full, false)))
+}
+
+// isProcessListTable tells whether the SELECT reads information_schema.PROCESSLIST.
+func isProcessListTable(query string) bool {
+	if !strings.Contains(strings.ToLower(query), "processlist") {
+		return false
+	}
+	for _, t := range sqlparser.Analyze(query).Tables {
+		if strings.EqualFold(t.Schema, "information_schema") && strings.EqualFold(t.Name, "processlist") {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSelectProcessList serves the simple queries of information_schema.PROCESSLIST:
+//
+//	SELECT {* | col [[AS] alias], ...} FROM information_schema.PROCESSLIST [alias]
+//	  [WHERE col op literal [AND ...]] [ORDER BY col [ASC|DESC]] [LIMIT n]
+func (c *Connection) handleSelectProcessList(query string) error {
+	columns := make([]string, len(processListColumns))
+	for i, name := range processListColumns {
+		columns[i] = strings.ToUpper(name)
+	}
+	rs, err := selectRows(query, columns, c.processList(true, false))
+	if err != nil {
+		return c.writeError(err)
+	}
+	return c.writeResultSet(rs)
+}
+
+type rowFilter struct {
+	column int
+	op     string
+	value  string
+}
+
+func selectRows(query string, columns []string, rows [][]interface{}) (*ResultSet, error) {
+	unsupported := NewDefaultMySqlError(ER_NOT_SUPPORTED_YET, "this query on information_schema.PROCESSLIST")
+	index := func(name string) (int, error) {
+		for i, col := range columns {
+			if strings.EqualFold(col, name) {
+				return i, nil
+			}
+		}
+		return 0, NewDefaultMySqlError(ER_BAD_FIELD_ERROR, name, "field list")
+	}
+	// column reads a column name, maybe qualified
+	column := func(s *sqlparser.Scanner) (int, error) {
+		t := s.Next()
+		if s.AcceptPunct(".") {
+			t = s.Next()
+		}
+		return index(t.Name())
+	}
+
+	s := sqlparser.NewScanner(query)
+	s.Accept("select")
+	var names []string
+	var projection []int
+	if s.AcceptPunct("*") {
+		for i, name := range columns {
+			names, projection = append(names, name), append(projection, i)
+		}
+	} else {
+		for {
+			i, err := column(s)
+			if err != nil {
+				return nil, err
+			}
+			name := columns[i]
+			if s.Accept("as") || (s.Peek().Type == sqlparser.TOKEN_IDENT && !s.Peek().Is("from")) || s.Peek().Type == sqlparser.TOKEN_QUOTED_IDENT {
+				name = s.Next().Name()
+			}
+			names, projection = append(names, name), append(projection, i)
+			if !s.AcceptPunct(",") {
+				break
+			}
+		}
+	}
+	if !s.Accept("from") {
+		return nil, unsupported
+	}
+	// information_schema . processlist [[AS] alias]
+	s.Next()
+	s.AcceptPunct(".")
+	s.Next()
+	if s.Accept("as") || (s.Peek().Type == sqlparser.TOKEN_IDENT && !s.Peek().Is("where") && !s.Peek().Is("order") && !s.Peek().Is("limit")) {
+		s.Next()
+	}
+
+	var filters []rowFilter
+	if s.Accept("where") {
+		for {
+			i, err := column(s)
+			if err != nil {
+				return nil, err
+			}
+			op := s.Next()
+			value := s.Next()
+			if op.Type != sqlparser.TOKEN_PUNCT || (value.Type != sqlparser.TOKEN_STRING && value.Type != sqlparser.TOKEN_NUMBER) {
+				return nil, unsupported
+			}
+			filters = append(filters, rowFilter{column: i, op: op.Value, value: sqlparser.Unquote(value.Value)})
+			if !s.Accept("and") {
+				break
+			}
+		}
+	}
+	orderBy, desc := -1, false
+	if s.Accept("order") {
+		s.Accept("by")
+		i, err := column(s)
+		if err != nil {
+			return nil, err
+		}
+		orderBy = i
+		desc = s.Accept("desc")
+		s.Accept("asc")
+	}
+	limit := -1
+	if s.Accept("limit") {
+		n, err := strconv.Atoi(s.Next().Value)
+		if err != nil {
+			return nil, unsupported
+		}
+		limit = n
+	}
+	if !s.EOF() {
+		return nil, unsupported
+	}
+
+	selected := [][]interface{}{}
+	for _, row := range rows {
+		ok := true
+		for _, f := range filters {
+			if ok = f.match(row[f.column]); !ok {
+				break
+			}
+		}
+		if ok {
+			selected = append(selected, row)
+		}
+	}
+	if orderBy >= 0 {
+		sort.SliceStable(selected, func(i, j int) bool {
+			cmp := compareValues(selected[i][orderBy], selected[j][orderBy])
+			if desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+	}
+	if limit >= 0 && limit < len(selected) {
+		selected = selected[:limit]
+	}
+	values := make([][]interface{}, len(selected))
+	for i, row := range selected {
+		values[i] = make([]interface{}, len(projection))
+		for j, k := range projection {
+			values[i][j] = row[k]
+		}
+	}
+	// the types come from all the rows, the selected ones may be empty
+	source := NewResultSet(columns, rows)
+	rs := &ResultSet{Values: values}
+	for j, k := range projection {
+		f := *source.Fields[k]
+		f.Name = names[j]
+		rs.Fields = append(rs.Fields, &f)
+	}
+	return rs, nil
+}
+
+func (f rowFilter) match(v interface{}) bool {
+	cmp := compareValues(v, f.value)
+	switch f.op {
+	case "=":
+		return v != nil && cmp == 0
+	case "!=", "<>":
+		return v != nil && cmp != 0
+	case "<":
+		return v != nil && cmp < 0
+	case "<=":
+		return v != nil && cmp <= 0
+	case ">":
+		return v != nil && cmp > 0
+	case ">=":
+		return v != nil && cmp >= 0
+	}
+	return false
+}
+
+// compareValues compares as numbers if both are, otherwise as case
+// insensitive strings like the default collation, NULL is the smallest.
+func compareValues(a interface{}, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		}
+		return 1
+	}
+	sa, sb := string(formatValue(a)), string(formatValue(b))
+	na, errA := strconv.ParseFloat(sa, 64)
+	nb, errB := strconv.ParseFloat(sb, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(strings.ToLower(sa), strings.ToLower(sb))
+}
@@ -0,0 +1,29 @@
+package mysql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectRows(t *testing.T) {
+	columns := []string{"ID", "USER", "COMMAND", "TIME", "INFO"}
+	rows := [][]interface{}{
+		{int64(1), "root", "Query", int64(5), "select 1"},
+		{int64(2), "app", "Sleep", int64(30), nil},
+		{int64(3), "app", "Query", int64(12), "update t set a = 1"},
+	}
+	rs, err := selectRows("SELECT id, info AS q FROM information_schema.PROCESSLIST p WHERE p.command != 'Sleep' AND time > 1 ORDER BY time DESC LIMIT 5", columns, rows)
+	if err != nil {
+		t.Fatalf("selectRows err: %s", err)
+	}
+	expected := [][]interface{}{{int64(3), "update t set a = 1"}, {int64(1), "select 1"}}
+	if !reflect.DeepEqual(rs.Values, expected) {
+		t.Fatalf("bad result: %v, expected: %v", rs.Values, expected)
+	}
+	if rs.Fields[1].Name != "q" || rs.Fields[0].Type != MYSQL_TYPE_LONGLONG {
+		t.Fatalf("bad fields: %+v %+v", rs.Fields[0], rs.Fields[1])
+	}
+	if _, err := selectRows("SELECT nope FROM information_schema.processlist", columns, rows); err == nil {
+		t.Fatalf("expected an error for the unknown column")
+	}
+}
@@ -0,0 +1,327 @@
+package mysql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/audit"
+	"github.com/Fleurer/hardshard/pkg/firewall"
+	"github.com/Fleurer/hardshard/pkg/metrics"
+	"github.com/Fleurer/hardshard/pkg/slowlog"
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+// queryStats collects what the slow log and the audit log want to know about the current query.
+type queryStats struct {
+	shards       []string
+	backendTime  time.Duration
+	rowsSent     uint64
+	affectedRows uint64
+	errorCode    uint16
+	fingerprint  string
+}
+
+func (c *Connection) handleQuery(query string) error {
+	return c.runQuery(query, c.dispatchQuery)
+}
+
+// runQuery runs the statement through the firewall and the rate limits,
+// and logs it, dispatch runs it. The statements of COM_QUERY and of
+// COM_STMT_EXECUTE share it.
+func (c *Connection) runQuery(query string, dispatch func(query string, typ sqlparser.StmtType) error) error {
+	start := time.Now()
+	c.stats = queryStats{}
+	atomic.AddUint64(&c.env.questions, 1)
+
+	var err error
+	typ := sqlparser.Preview(query)
+	if ferr := c.checkFirewall(query, typ); ferr != nil {
+		err = c.writeError(ferr)
+	} else if lerr := c.checkRateLimit(query, typ); lerr != nil {
+		err = c.writeError(lerr)
+	} else {
+		err = dispatch(query, typ)
+	}
+
+	c.logSlowQuery(query, time.Since(start))
+	c.logAudit(query, typ, start)
+	return err
+}
+
+func (c *Connection) dispatchQuery(query string, typ sqlparser.StmtType) error {
+	switch typ {
+	case sqlparser.STMT_SET:
+		return c.handleSet(query)
+	case sqlparser.STMT_ADMIN:
+		return c.handleAdmin(query)
+	case sqlparser.STMT_USE:
+		return c.handleUse(query)
+	case sqlparser.STMT_SHOW:
+		if full, ok := isShowProcessList(query); ok {
+			return c.handleShowProcessList(full)
+		}
+		if like, ok := isShowDatabases(query); ok && c.env.Router.HasSchemas() {
+			return c.handleShowDatabases(like)
+		}
+	case sqlparser.STMT_SELECT:
+		if isProcessListTable(query) {
+			return c.handleSelectProcessList(query)
+		}
+		if isSelectDatabase(query) {
+			return c.handleSelectDatabase()
+		}
+		if column, ok := isSelectMaxAllowedPacket(query); ok {
+			return c.handleSelectMaxAllowedPacket(column)
+		}
+	case sqlparser.STMT_KILL:
+		return c.handleKill(query)
+	case sqlparser.STMT_LOAD:
+		return c.handleLoadData(query)
+	case sqlparser.STMT_BEGIN, sqlparser.STMT_COMMIT, sqlparser.STMT_ROLLBACK:
+		return c.handleTransaction(query, typ)
+	}
+	switch sqlparser.FirstKeyword(query) {
+	case "savepoint", "release":
+		if c.inTransaction() || !c.autocommit() {
+			return c.handleSavepoint(query)
+		}
+	}
+	return c.forwardQuery(query)
+}
+
+// fingerprint is computed once per query, it is shared by the firewall and the logs.
+func (c *Connection) fingerprint(query string) string {
+	if c.stats.fingerprint == "" {
+		c.stats.fingerprint = sqlparser.Fingerprint(query)
+	}
+	return c.stats.fingerprint
+}
+
+func (c *Connection) checkFirewall(query string, typ sqlparser.StmtType) error {
+	// the admin statements are for the proxy itself, they are guarded by the admin users
+	if typ == sqlparser.STMT_ADMIN {
+		return nil
+	}
+	req := &firewall.Request{
+		User:        c.user,
+		Host:        c.remoteHost(),
+		DB:          c.db,
+		Query:       query,
+		Fingerprint: c.fingerprint(query),
+	}
+	if rule := c.env.Firewall.Check(req); rule != nil {
+		c.log.Warn("checkFirewall: statement rejected by rule %s: query=%q", rule.Name, query)
+		return NewMySqlError(ER_SPECIFIC_ACCESS_DENIED_ERROR, fmt.Sprintf("Statement rejected by firewall rule '%s'", rule.Name))
+	}
+	return nil
+}
+
+// checkRateLimit takes a token from the matched rate limits, the statement
+// may be held here for a while by the rules in wait mode.
+func (c *Connection) checkRateLimit(query string, typ sqlparser.StmtType) error {
+	limiter := c.env.Limiter
+	if typ == sqlparser.STMT_ADMIN || limiter.Empty() {
+		return nil
+	}
+	fingerprint := ""
+	if limiter.HasFingerprints() {
+		fingerprint = c.fingerprint(query)
+	}
+	if rule := limiter.Acquire(c.user, fingerprint); rule != nil {
+		metrics.ThrottledQueries.Add(rule.Name, 1)
+		c.log.Debug("checkRateLimit: statement throttled by rule %s: query=%q", rule.Name, query)
+		return NewMySqlError(ER_USER_LIMIT_REACHED, fmt.Sprintf("User '%s' has exceeded the '%s' resource (current value: %g)", c.user, rule.Name, rule.QPS()))
+	}
+	return nil
+}
+
+// handleSet keeps the session variables of SET_KEY_WORDS, they are
+// replayed lazily on the borrowed backend connections. The global and the
+// other variables are ignored.
+func (c *Connection) handleSet(query string) error {
+	exprs, err := sqlparser.ParseSet(query)
+	if err != nil {
+		return c.writeOK(c.status, 0, 0)
+	}
+	for _, e := range exprs {
+		switch e.Scope {
+		case sqlparser.SCOPE_TRANSACTION:
+			if c.inTransaction() {
+				return c.writeError(NewDefaultMySqlError(ER_CANT_CHANGE_TX_CHARACTERISTICS))
+			}
+			if c.nextTransaction == query {
+				continue
+			}
+			// the connections pinned by autocommit=0 get it now, the ones
+			// borrowed later get it replayed
+			for _, conn := range c.pinnedBackends() {
+				if _, err := conn.Execute(query); err != nil {
+					return c.writeError(err)
+				}
+			}
+			c.nextTransaction = query
+			continue
+		case sqlparser.SCOPE_SESSION:
+		default:
+			continue
+		}
+		if e.Name == "long_query_time" {
+			seconds, err := strconv.ParseFloat(sqlparser.Unquote(e.Value), 64)
+			if err != nil {
+				return c.writeError(NewDefaultMySqlError(ER_WRONG_TYPE_FOR_VAR, e.Name))
+			}
+			if seconds < 0 {
+				return c.writeError(NewDefaultMySqlError(ER_WRONG_VALUE_FOR_VAR, e.Name, e.Value))
+			}
+			c.longQueryTime = time.Duration(seconds * float64(time.Second))
+			continue
+		}
+		if _, ok := SET_KEY_WORDS[e.Name]; !ok {
+			c.log.Debug("handleSet: untracked variable %s is ignored", e.Name)
+			continue
+		}
+		if strings.Contains(e.Value, "@@") && c.env.Backend != nil {
+			value, err := c.resolveValue(e.Value)
+			if err != nil {
+				return c.writeError(err)
+			}
+			e.Value = value
+		}
+		if e.Name == "autocommit" {
+			if err := c.setAutocommit(e.Value); err != nil {
+				return c.writeError(err)
+			}
+		}
+		ok, err := c.setCharsetVar(e)
+		if err != nil {
+			return c.writeError(err)
+		}
+		if !ok {
+			name := e.Name
+			if newName, ok := TX_VAR_ALIASES[name]; ok {
+				name = newName
+			}
+			if strings.EqualFold(e.Value, "default") {
+				delete(c.vars, name)
+			} else {
+				c.vars[name] = e.Value
+			}
+		}
+		c.trackSet(e)
+	}
+	return c.writeOK(c.status, 0, 0)
+}
+
+// resolveValue evaluates a value that refers to the variables, like
+// CONCAT(@@sql_mode, ',ANSI'), on a backend with the variables of the
+// session. The result is kept as a literal, a SET building on a former one
+// would replace it otherwise.
+func (c *Connection) resolveValue(value string) (string, error) {
+	defer c.releaseBackends()
+	conn, err := c.borrow(c.representativeNode())
+	if err != nil {
+		return "", err
+	}
+	r, err := conn.Execute("SELECT " + value)
+	if err != nil {
+		return "", err
+	}
+	if r.ResultSet == nil || len(r.Values) != 1 || len(r.Fields) != 1 {
+		return "", NewDefaultMySqlError(ER_OPERAND_COLUMNS, 1)
+	}
+	v := r.Values[0][0]
+	if v == nil {
+		return "NULL", nil
+	}
+	switch r.Fields[0].Type {
+	case MYSQL_TYPE_DECIMAL, MYSQL_TYPE_NEWDECIMAL, MYSQL_TYPE_TINY, MYSQL_TYPE_SHORT, MYSQL_TYPE_LONG,
+		MYSQL_TYPE_INT24, MYSQL_TYPE_LONGLONG, MYSQL_TYPE_FLOAT, MYSQL_TYPE_DOUBLE:
+		return string(v.([]byte)), nil
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", "''").Replace(string(v.([]byte))) + "'", nil
+}
+
+// setAutocommit switches the autocommit status, turning it on commits the
+// open transaction like mysql.
+func (c *Connection) setAutocommit(value string) error {
+	on := false
+	switch strings.ToLower(sqlparser.Unquote(value)) {
+	case "1", "on", "true", "default":
+		on = true
+	case "0", "off", "false":
+	default:
+		return NewDefaultMySqlError(ER_WRONG_VALUE_FOR_VAR, "autocommit", value)
+	}
+	if on == c.autocommit() {
+		return nil
+	}
+	if !on {
+		c.status &^= SERVER_STATUS_AUTOCOMMIT
+		return nil
+	}
+	c.status |= SERVER_STATUS_AUTOCOMMIT
+	if c.env.Backend != nil {
+		return c.endTransaction("COMMIT")
+	}
+	return nil
+}
+
+func (c *Connection) logSlowQuery(query string, elapsed time.Duration) {
+	if elapsed < c.longQueryTime {
+		return
+	}
+	atomic.AddUint64(&c.env.slowQueries, 1)
+	if c.env.SlowLog == nil {
+		return
+	}
+	e := &slowlog.Entry{
+		Time:         time.Now(),
+		ConnectionId: c.connectionId,
+		User:         c.user,
+		Client:       c.conn.RemoteAddr().String(),
+		DB:           c.db,
+		Shards:       c.stats.shards,
+		QueryTime:    elapsed,
+		BackendTime:  c.stats.backendTime,
+		RowsSent:     c.stats.rowsSent,
+		Query:        query,
+		Fingerprint:  c.fingerprint(query),
+	}
+	if err := c.env.SlowLog.Log(e); err != nil {
+		c.log.Warn("logSlowQuery: write slow log fail: err=%s", err)
+	}
+}
+
+func (c *Connection) logAudit(query string, typ sqlparser.StmtType, start time.Time) {
+	if c.env.Audit == nil {
+		return
+	}
+	class := audit.CLASS_OTHER
+	switch {
+	case typ == sqlparser.STMT_DDL:
+		class = audit.CLASS_DDL
+	case typ.IsDML():
+		class = audit.CLASS_DML
+	case typ == sqlparser.STMT_SELECT:
+		class = audit.CLASS_SELECT
+	}
+	if !c.env.Audit.Match(class, c.user) {
+		return
+	}
+	c.env.Audit.Log(&audit.Event{
+		StartTime:    start,
+		EndTime:      time.Now(),
+		ConnectionId: c.connectionId,
+		User:         c.user,
+		Client:       c.conn.RemoteAddr().String(),
+		DB:           c.db,
+		Attrs:        c.attrs,
+		Class:        class,
+		Query:        query,
+		AffectedRows: c.stats.affectedRows,
+		ErrorCode:    c.stats.errorCode,
+	})
+}
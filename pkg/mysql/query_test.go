@@ -0,0 +1,71 @@
+package mysql
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// runQuery runs the statements on the connection and returns the response.
+func runQuery(t *testing.T, conn *Connection, client net.Conn, queries ...string) []byte {
+	go func() {
+		for _, query := range queries {
+			conn.handleRequestPacket(append([]byte{COM_QUERY}, query...))
+		}
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return buf
+}
+
+func TestSetTransactionPinned(t *testing.T) {
+	backend := &stubBackend{}
+	conn, client := setupBackendConnection(backend)
+	defer client.Close()
+	conn.status &^= SERVER_STATUS_AUTOCOMMIT
+	pinned, err := conn.borrow("n0", "db1_0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	query := "SET TRANSACTION ISOLATION LEVEL READ COMMITTED, READ ONLY"
+	runQuery(t, conn, client, query)
+	if queries := pinned.(*stubConn).queries; len(queries) != 1 || queries[0] != query {
+		t.Fatalf("bad queries: %q, expected the SET TRANSACTION once", queries)
+	}
+	if conn.nextTransaction != query {
+		t.Fatalf("bad result: %q, expected: %q", conn.nextTransaction, query)
+	}
+}
+
+func TestSetResolveValue(t *testing.T) {
+	node := &stubConn{results: map[string]*Result{
+		"SELECT CONCAT(@@sql_mode, ',ANSI')": {ResultSet: &ResultSet{
+			Fields: []*Field{{Name: "x", Type: MYSQL_TYPE_VAR_STRING}},
+			Values: [][]interface{}{{[]byte("STRICT_TRANS_TABLES,ANSI")}},
+		}},
+		"SELECT @@sql_select_limit + 1": {ResultSet: &ResultSet{
+			Fields: []*Field{{Name: "x", Type: MYSQL_TYPE_LONGLONG}},
+			Values: [][]interface{}{{[]byte("11")}},
+		}},
+	}}
+	backend := &stubBackend{conns: []*stubConn{node, node}}
+	conn, client := setupBackendConnection(backend)
+	defer client.Close()
+	runQuery(t, conn, client, "SET sql_mode = CONCAT(@@sql_mode, ',ANSI'), sql_select_limit = @@sql_select_limit + 1", "SET tx_isolation = 'READ-COMMITTED'")
+	expected := map[string]string{
+		"sql_mode":              "'STRICT_TRANS_TABLES,ANSI'",
+		"sql_select_limit":      "11",
+		"transaction_isolation": "'READ-COMMITTED'",
+	}
+	for name, value := range expected {
+		if conn.vars[name] != value {
+			t.Fatalf("bad %s: %q, expected: %q", name, conn.vars[name], value)
+		}
+	}
+	if _, ok := conn.vars["tx_isolation"]; ok || len(backend.put) != 2 {
+		t.Fatalf("bad result: %v %v, expected the connections back in the pool", conn.vars, backend.put)
+	}
+}
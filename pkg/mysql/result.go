@@ -0,0 +1,134 @@
+package mysql
+
+// The responses of the backends are parsed here, so they can be merged
+// and written back to the clients.
+
+import (
+	"encoding/binary"
+)
+
+// Result is the response of a statement, ResultSet is nil for an OK packet.
+type Result struct {
+	Status       uint16
+	AffectedRows uint64
+	InsertId     uint64
+	Warnings     uint16
+	*ResultSet
+
+	// Next is the next result of a multi-resultset response, like the
+	// resultsets of a CALL followed by its OK
+	Next *Result
+}
+
+// HasResultSet reports whether a result of the chain is a resultset.
+func (r *Result) HasResultSet() bool {
+	for ; r != nil; r = r.Next {
+		if r.ResultSet != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseOK parses an OK packet of the 4.1 protocol.
+func ParseOK(payload []byte) (*Result, error) {
+	if len(payload) < 1 || (payload[0] != OK_HEADER && payload[0] != EOF_HEADER) {
+		return nil, ErrMalformPacket
+	}
+	r := &Result{}
+	pos := 1
+	var n int
+	if len(payload) <= pos {
+		return nil, ErrMalformPacket
+	}
+	r.AffectedRows, _, n = DecodeLencInt(payload[pos:])
+	pos += n
+	if len(payload) <= pos {
+		return nil, ErrMalformPacket
+	}
+	r.InsertId, _, n = DecodeLencInt(payload[pos:])
+	pos += n
+	if len(payload) < pos+4 {
+		return nil, ErrMalformPacket
+	}
+	r.Status = binary.LittleEndian.Uint16(payload[pos:])
+	r.Warnings = binary.LittleEndian.Uint16(payload[pos+2:])
+	return r, nil
+}
+
+// ParseEOF returns the warnings and the status flags of an EOF packet.
+func ParseEOF(payload []byte) (warnings uint16, status uint16) {
+	if len(payload) >= 5 {
+		warnings = binary.LittleEndian.Uint16(payload[1:])
+		status = binary.LittleEndian.Uint16(payload[3:])
+	}
+	return
+}
+
+// IsEOF tells the EOF packet from a row starting with a 0xfe length.
+func IsEOF(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == EOF_HEADER && len(payload) < 9
+}
+
+// ParseField parses a ColumnDefinition41.
+func ParseField(payload []byte) (*Field, error) {
+	f := &Field{}
+	pos := 0
+	strs := []*string{nil, &f.Schema, &f.Table, &f.OrgTable, &f.Name, &f.OrgName}
+	for _, s := range strs {
+		if pos >= len(payload) {
+			return nil, ErrMalformPacket
+		}
+		b, _, n, err := DecodeLencString(payload[pos:])
+		if err != nil {
+			return nil, ErrMalformPacket
+		}
+		if s != nil {
+			*s = string(b)
+		}
+		pos += n
+	}
+	// the length of the fixed-length fields, always 0x0c
+	pos++
+	if len(payload) < pos+10 {
+		return nil, ErrMalformPacket
+	}
+	f.Charset = binary.LittleEndian.Uint16(payload[pos:])
+	f.ColumnLength = binary.LittleEndian.Uint32(payload[pos+2:])
+	f.Type = payload[pos+6]
+	f.Flags = binary.LittleEndian.Uint16(payload[pos+7:])
+	f.Decimals = payload[pos+9]
+	// the default value follows the filler in the response of COM_FIELD_LIST
+	if pos += 12; pos < len(payload) {
+		b, isNull, _, err := DecodeLencString(payload[pos:])
+		if err != nil {
+			return nil, ErrMalformPacket
+		}
+		if !isNull {
+			f.DefaultValue = append([]byte{}, b...)
+		}
+	}
+	return f, nil
+}
+
+// ParseRowData parses a row of the text protocol, NULL is returned as nil.
+func ParseRowData(payload []byte, columns int) ([]interface{}, error) {
+	row := make([]interface{}, 0, columns)
+	pos := 0
+	for i := 0; i < columns; i++ {
+		if pos >= len(payload) {
+			return nil, ErrMalformPacket
+		}
+		b, isNull, n, err := DecodeLencString(payload[pos:])
+		if err != nil {
+			return nil, ErrMalformPacket
+		}
+		pos += n
+		if isNull {
+			row = append(row, nil)
+		} else {
+			row = append(row, b)
+		}
+	}
+	return row, nil
+}
@@ -1,8 +1,135 @@
 package mysql
 
+// Text Resultset: https://dev.mysql.com/doc/internals/en/com-query-response.html#packet-ProtocolText::Resultset
+// ColumnDefinition41: https://dev.mysql.com/doc/internals/en/com-query-response.html#packet-Protocol::ColumnDefinition41
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type Field struct {
+	Schema       string
+	Table        string
+	OrgTable     string
+	Name         string
+	OrgName      string
+	Charset      uint16
+	ColumnLength uint32
+	Type         byte
+	Flags        uint16
+	Decimals     byte
+	// DefaultValue is only sent in the response of COM_FIELD_LIST, nil for NULL
+	DefaultValue []byte
+}
+
+func (f *Field) Dump() []byte {
+	payload := make([]byte, 0, 64)
+	payload = append(payload, EncodeLencString([]byte("def"))...) // catalog
+	payload = append(payload, EncodeLencString([]byte(f.Schema))...)
+	payload = append(payload, EncodeLencString([]byte(f.Table))...)
+	payload = append(payload, EncodeLencString([]byte(f.OrgTable))...)
+	payload = append(payload, EncodeLencString([]byte(f.Name))...)
+	payload = append(payload, EncodeLencString([]byte(f.OrgName))...)
+	payload = append(payload, 0x0c) // length of the fixed-length fields
+	payload = append(payload, EncodeUint16(f.Charset)...)
+	payload = append(payload, EncodeUint32(f.ColumnLength)...)
+	payload = append(payload, f.Type)
+	payload = append(payload, EncodeUint16(f.Flags)...)
+	payload = append(payload, f.Decimals)
+	payload = append(payload, 0, 0) // filler
+	return payload
+}
+
+// DumpWithDefault encodes the column definition of the COM_FIELD_LIST response.
+func (f *Field) DumpWithDefault() []byte {
+	payload := f.Dump()
+	if f.DefaultValue == nil {
+		return append(payload, 0xfb) // NULL
+	}
+	return append(payload, EncodeLencString(f.DefaultValue)...)
+}
+
 type ResultSet struct {
-	// Fields
-	// FieldNames
-	// Values
-	// Rows
+	Fields []*Field
+	// Values are nil for NULL
+	Values [][]interface{}
+}
+
+// NewResultSet builds a resultset of the proxy's own data, the column types
+// are taken from the first row.
+func NewResultSet(names []string, values [][]interface{}) *ResultSet {
+	rs := &ResultSet{Values: values}
+	for i, name := range names {
+		f := &Field{Name: name, OrgName: name, Charset: uint16(DEFAULT_COLLATION_ID), Type: MYSQL_TYPE_VAR_STRING, ColumnLength: 1024}
+		if len(values) > 0 && i < len(values[0]) {
+			switch values[0][i].(type) {
+			case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+				f.Type, f.Charset, f.ColumnLength, f.Flags = MYSQL_TYPE_LONGLONG, uint16(BINARY_COLLATION_ID), 20, BINARY_FLAG
+			case float32, float64:
+				f.Type, f.Charset, f.ColumnLength, f.Flags, f.Decimals = MYSQL_TYPE_DOUBLE, uint16(BINARY_COLLATION_ID), 22, BINARY_FLAG, 31
+			}
+		}
+		rs.Fields = append(rs.Fields, f)
+	}
+	return rs
+}
+
+// RowData encodes a row of the text protocol.
+func (rs *ResultSet) RowData(row []interface{}) []byte {
+	payload := make([]byte, 0, 16*len(row))
+	for _, v := range row {
+		if v == nil {
+			payload = append(payload, 0xfb) // NULL
+			continue
+		}
+		payload = append(payload, EncodeLencString(formatValue(v))...)
+	}
+	return payload
+}
+
+func formatValue(v interface{}) []byte {
+	switch x := v.(type) {
+	case []byte:
+		return x
+	case string:
+		return []byte(x)
+	case int:
+		return strconv.AppendInt(nil, int64(x), 10)
+	case int64:
+		return strconv.AppendInt(nil, x, 10)
+	case uint32:
+		return strconv.AppendUint(nil, uint64(x), 10)
+	case uint64:
+		return strconv.AppendUint(nil, x, 10)
+	case float64:
+		return strconv.AppendFloat(nil, x, 'f', -1, 64)
+	case bool:
+		if x {
+			return []byte("1")
+		}
+		return []byte("0")
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+func (c *Connection) writeResultSet(rs *ResultSet) error {
+	if err := c.writePacket(EncodeLencInt(uint64(len(rs.Fields)))); err != nil {
+		return err
+	}
+	for _, f := range rs.Fields {
+		if err := c.writePacket(f.Dump()); err != nil {
+			return err
+		}
+	}
+	if err := c.writeFieldsEOF(); err != nil {
+		return err
+	}
+	for _, row := range rs.Values {
+		if err := c.writePacket(rs.RowData(row)); err != nil {
+			return err
+		}
+		c.stats.rowsSent++
+	}
+	return c.writeEOF(0, c.status)
 }
@@ -0,0 +1,170 @@
+package mysql
+
+// The clients see the logical schemas of the config, each of them maps to
+// a physical database on every node, see router.Schema.
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+// checkDB validates the schema the client asks for, any database is passed
+// through if no schema is configured.
+func (c *Connection) checkDB(db string) error {
+	if db == "" || !c.env.Router.HasSchemas() {
+		return nil
+	}
+	if c.env.Router.Schema(db) == nil {
+		return NewDefaultMySqlError(ER_BAD_DB_ERROR, db)
+	}
+	return nil
+}
+
+// useDB switches the current schema of the session, the backend connections
+// follow it once they are borrowed.
+func (c *Connection) useDB(db string) error {
+	if err := c.checkDB(db); err != nil {
+		return c.writeError(err)
+	}
+	c.db = db
+	c.trackSchema(db)
+	return c.writeOK(c.status, 0, 0)
+}
+
+// https://dev.mysql.com/doc/internals/en/com-init-db.html
+func (c *Connection) handleInitDB(db string) error {
+	return c.useDB(db)
+}
+
+// handleFieldList answers COM_FIELD_LIST from a representative node, the
+// first node of the schema holds a shard of every sharded table and all the
+// other tables. The column definitions are renamed back to the logical
+// schema and table.
+// https://dev.mysql.com/doc/internals/en/com-field-list.html
+func (c *Connection) handleFieldList(body []byte) error {
+	table, wildcard := body, []byte{}
+	if i := bytes.IndexByte(body, 0); i >= 0 {
+		table, wildcard = body[:i], body[i+1:]
+	}
+	if c.env.Backend == nil {
+		return c.writeError(NewMySqlError(ER_UNKNOWN_ERROR, "No backend node is configured"))
+	}
+	if c.db == "" {
+		return c.writeError(NewDefaultMySqlError(ER_NO_DB_ERROR))
+	}
+	schema := c.env.Router.Schema(c.db)
+	conn, err := c.borrow(c.representativeNode())
+	if err != nil {
+		c.releaseBackends()
+		return c.writeError(err)
+	}
+	fields, err := conn.FieldList(string(table), string(wildcard))
+	c.releaseBackends()
+	if err != nil {
+		return c.writeError(err)
+	}
+	for _, f := range fields {
+		if schema != nil {
+			f.Schema = schema.Name
+			if schema.IsSharded(string(table)) {
+				f.Table, f.OrgTable = string(table), string(table)
+			}
+		}
+		if err := c.writePacket(f.DumpWithDefault()); err != nil {
+			return err
+		}
+	}
+	return c.writeEOF(0, c.status)
+}
+
+// representativeNode returns the first node of the current schema and its
+// database, or else the default node.
+func (c *Connection) representativeNode() (string, string) {
+	if schema := c.env.Router.Schema(c.db); schema != nil {
+		return schema.Nodes[0], schema.DB(schema.Nodes[0])
+	}
+	return c.env.Router.DefaultNode(), c.db
+}
+
+func (c *Connection) handleUse(query string) error {
+	s := sqlparser.NewScanner(query)
+	s.Accept("use")
+	t := s.Next()
+	if (t.Type != sqlparser.TOKEN_IDENT && t.Type != sqlparser.TOKEN_QUOTED_IDENT) || !s.EOF() {
+		return c.writeError(NewDefaultMySqlError(ER_PARSE_ERROR, "You have an error in your SQL syntax", query, 1))
+	}
+	return c.useDB(t.Name())
+}
+
+// isSelectDatabase matches `SELECT DATABASE()` and `SELECT SCHEMA()`, the
+// backends would answer with the physical database.
+func isSelectDatabase(query string) bool {
+	s := sqlparser.NewScanner(query)
+	return s.Accept("select") && s.Accept("database", "schema") && s.AcceptPunct("(") && s.AcceptPunct(")") && s.EOF()
+}
+
+func (c *Connection) handleSelectDatabase() error {
+	var db interface{}
+	if c.db != "" {
+		db = c.db
+	}
+	return c.writeResultSet(NewResultSet([]string{"DATABASE()"}, [][]interface{}{{db}}))
+}
+
+// isShowDatabases matches `SHOW {DATABASES | SCHEMAS} [LIKE 'pattern']`.
+func isShowDatabases(query string) (like string, ok bool) {
+	s := sqlparser.NewScanner(query)
+	if !s.Accept("show") || !s.Accept("databases", "schemas") {
+		return "", false
+	}
+	if s.Accept("like") {
+		t := s.Next()
+		if t.Type != sqlparser.TOKEN_STRING {
+			return "", false
+		}
+		like = sqlparser.Unquote(t.Value)
+	}
+	return like, s.EOF()
+}
+
+func (c *Connection) handleShowDatabases(like string) error {
+	values := [][]interface{}{}
+	for _, name := range c.env.Router.Schemas() {
+		if like == "" || matchLike(strings.ToLower(like), strings.ToLower(name)) {
+			values = append(values, []interface{}{name})
+		}
+	}
+	return c.writeResultSet(NewResultSet([]string{"Database"}, values))
+}
+
+// matchLike matches the LIKE pattern with % and _, \ escapes the next character.
+func matchLike(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '%':
+			for i := 0; i <= len(s); i++ {
+				if matchLike(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '_':
+			if len(s) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,51 @@
+package mysql
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFieldList(t *testing.T) {
+	node := &stubConn{fields: []*Field{
+		{Schema: "db1_0", Table: "orders_0", OrgTable: "orders_0", Name: "id", OrgName: "id"},
+		{Schema: "db1_0", Table: "orders_0", OrgTable: "orders_0", Name: "user_id", OrgName: "user_id"},
+	}}
+	backend := &stubBackend{conns: []*stubConn{node}}
+	conn, client := setupBackendConnection(backend)
+	defer client.Close()
+	go func() {
+		conn.handleRequestPacket(append([]byte{COM_FIELD_LIST}, "orders\x00%id"...))
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(node.queries) != 1 || node.queries[0] != "FIELD_LIST orders %id" || node.node != "n0" {
+		t.Fatalf("bad request: %s %q, expected the field list of orders on n0", node.node, node.queries)
+	}
+
+	pio := NewPacketIO(bytes.NewBuffer(buf), nil)
+	for _, name := range []string{"id", "user_id"} {
+		payload, err := pio.ReadPacket()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		f, err := ParseField(payload)
+		if err != nil || f.Schema != "db1" || f.Table != "orders" || f.OrgTable != "orders" || f.Name != name {
+			t.Fatalf("bad field: %+v %v, expected %s of db1.orders", f, err, name)
+		}
+	}
+	// no column count, the list ends with an EOF
+	payload, err := pio.ReadPacket()
+	if err != nil || !IsEOF(payload) {
+		t.Fatalf("bad result: %v %v, expected an EOF", payload, err)
+	}
+	if payload, err := pio.ReadPacket(); err == nil {
+		t.Fatalf("bad result: %v, expected nothing after the EOF", payload)
+	}
+	if len(backend.put) != 1 {
+		t.Fatalf("bad result: %v, expected the connection back in the pool", backend.put)
+	}
+}
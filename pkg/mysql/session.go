@@ -0,0 +1,145 @@
+package mysql
+
+// The connection pools of the clients reuse a session by COM_CHANGE_USER or
+// COM_RESET_CONNECTION, both start over with a clean session.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/log"
+)
+
+// resetSession rolls back the transaction and forgets the state of the
+// session, the current database and the charset of the handshake are kept.
+// The pinned backend connections are released, the pool closes those still
+// in a transaction.
+func (c *Connection) resetSession() {
+	c.status = SERVER_STATUS_AUTOCOMMIT
+	c.beginQuery = ""
+	c.vars = map[string]string{}
+	c.nextTransaction = ""
+	c.stmts = map[uint32]*proxyStmt{}
+	c.stateChanges = nil
+	if c.env.Backend != nil {
+		c.closeBackends()
+	}
+	c.setCollation(c.handshakeCollationId)
+	c.longQueryTime = time.Duration(c.env.Config.SlowLog.LongQueryTime * float64(time.Second))
+	c.stats = queryStats{}
+}
+
+// https://dev.mysql.com/doc/internals/en/com-reset-connection.html
+func (c *Connection) handleResetConnection() error {
+	c.resetSession()
+	return c.writeOK(c.status, 0, 0)
+}
+
+// handleChangeUser authenticates the session again, it is closed if the
+// authentication fails.
+// https://dev.mysql.com/doc/internals/en/com-change-user.html
+func (c *Connection) handleChangeUser(body []byte) error {
+	h, err := c.readChangeUser(body)
+	if err != nil {
+		c.log.Warn("handleChangeUser: readChangeUser fail: err=%s", err)
+		c.writeError(NewDefaultMySqlError(ER_MALFORMED_PACKET))
+		return c.Close()
+	}
+	c.resetSession()
+
+	authData, err := c.readAuthData(h)
+	if err != nil {
+		c.log.Error("handleChangeUser: readAuthData fail: err=%s", err)
+		c.writeError(NewDefaultMySqlError(ER_MALFORMED_PACKET))
+		return c.Close()
+	}
+	user := strings.TrimRight(string(h.user), "\x00")
+	if err := c.authenticate(user, authData); err != nil {
+		c.log.Warn("handleChangeUser: authenticate fail: user=%s err=%s", user, err)
+		c.writeError(err)
+		return c.Close()
+	}
+	if err := c.env.changeUser(c, user); err != nil {
+		c.log.Warn("handleChangeUser: changeUser fail: user=%s err=%s", user, err)
+		c.writeError(err)
+		return c.Close()
+	}
+	db := strings.TrimRight(string(h.db), "\x00")
+	if err := c.checkDB(db); err != nil {
+		c.log.Warn("handleChangeUser: checkDB fail: db=%s err=%s", db, err)
+		c.writeError(err)
+		return c.Close()
+	}
+	c.db = db
+	c.attrs = h.attrs
+	if h.charset != 0 {
+		c.setCollation(h.charset)
+		c.handshakeCollationId = c.collationId
+	}
+	c.log = log.With("conn_id", c.connectionId, "remote", c.conn.RemoteAddr()).With("user", c.user)
+	return c.writeOK(c.status, 0, 0)
+}
+
+// readChangeUser parses the COM_CHANGE_USER packet, the fields after the
+// database are optional.
+func (c *Connection) readChangeUser(body []byte) (*handkshakeResponse, error) {
+	pr := &PacketReader{buf: body, buffer: bytes.NewBuffer(body)}
+	h := &handkshakeResponse{capabilities: c.capabilities, attrs: map[string]string{}}
+	var err error
+	if h.user, err = pr.ReadBytes('\x00'); err != nil {
+		return nil, fmt.Errorf("fail on read h.user: %s", err)
+	}
+	if h.capabilities&CLIENT_SECURE_CONNECTION > 0 {
+		n, err := pr.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("fail on read h.authData: %s", err)
+		}
+		if pr.buffer.Len() < int(n) {
+			return nil, fmt.Errorf("fail on read h.authData: %s", io.ErrUnexpectedEOF)
+		}
+		h.authData = pr.Next(int(n))
+	} else if h.authData, err = pr.ReadBytes('\x00'); err != nil {
+		return nil, fmt.Errorf("fail on read h.authData: %s", err)
+	}
+	if h.db, err = pr.ReadBytes('\x00'); err != nil {
+		return nil, fmt.Errorf("fail on read h.db: %s", err)
+	}
+	charset, err := pr.ReadUint16()
+	if err == io.EOF {
+		return h, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("fail on read h.charset: %s", err)
+	}
+	h.charset = CollationId(charset)
+	if h.capabilities&CLIENT_PLUGIN_AUTH > 0 {
+		if h.authPluginName, err = pr.ReadBytes('\x00'); err == io.EOF {
+			return h, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("fail on read h.authPluginName: %s", err)
+		}
+	}
+	if h.capabilities&CLIENT_CONNECT_ATTRS > 0 {
+		if _, _, err := pr.ReadLencInt(); err == io.EOF {
+			return h, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("fail on read attrs: %s", err)
+		}
+		for {
+			key, err := pr.ReadLencString()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("fail on read attrs key: %s", err)
+			}
+			val, err := pr.ReadLencString()
+			if err != nil {
+				return nil, fmt.Errorf("fail on read attrs val: %s", err)
+			}
+			h.attrs[key] = val
+		}
+	}
+	return h, nil
+}
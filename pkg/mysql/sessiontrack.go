@@ -0,0 +1,106 @@
+package mysql
+
+// With CLIENT_SESSION_TRACK the OK packets carry the changes of the session
+// state, the connectors follow the schema, the variables and the transaction
+// without asking the server.
+// https://dev.mysql.com/doc/refman/5.7/en/session-state-tracking.html
+
+import (
+	"strings"
+
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+// TRACKED_SYSTEM_VARIABLES are reported when they change, like the default
+// session_track_system_variables of mysql
+var TRACKED_SYSTEM_VARIABLES = map[string]struct{}{
+	"autocommit":               struct{}{},
+	"time_zone":                struct{}{},
+	"character_set_client":     struct{}{},
+	"character_set_connection": struct{}{},
+	"character_set_results":    struct{}{},
+}
+
+func (c *Connection) tracksSessionState() bool {
+	return c.capabilities&CLIENT_SESSION_TRACK > 0
+}
+
+func (c *Connection) trackStateChange(typ byte, data []byte) {
+	c.stateChanges = append(c.stateChanges, typ)
+	c.stateChanges = append(c.stateChanges, EncodeLencString(data)...)
+}
+
+// trackSchema reports the new current schema.
+func (c *Connection) trackSchema(db string) {
+	if !c.tracksSessionState() {
+		return
+	}
+	c.trackStateChange(SESSION_TRACK_SCHEMA, EncodeLencString([]byte(db)))
+}
+
+// trackSystemVariable reports the new value of a tracked variable.
+func (c *Connection) trackSystemVariable(name string, value string) {
+	if _, ok := TRACKED_SYSTEM_VARIABLES[name]; !ok || !c.tracksSessionState() {
+		return
+	}
+	data := EncodeLencString([]byte(name))
+	data = append(data, EncodeLencString([]byte(value))...)
+	c.trackStateChange(SESSION_TRACK_SYSTEM_VARIABLES, data)
+}
+
+// trackSet reports the tracked variables changed by a SET, it's called
+// once the SET is applied to the session.
+func (c *Connection) trackSet(e *sqlparser.SetExpr) {
+	if !c.tracksSessionState() {
+		return
+	}
+	value := sqlparser.Unquote(e.Value)
+	switch e.Name {
+	case "autocommit":
+		value = "OFF"
+		if c.autocommit() {
+			value = "ON"
+		}
+		c.trackSystemVariable(e.Name, value)
+	case "names":
+		charset := CollationCharset(Collations[c.collationId])
+		c.trackSystemVariable("character_set_client", charset)
+		c.trackSystemVariable("character_set_connection", charset)
+		c.trackSystemVariable("character_set_results", charset)
+	case "charset":
+		// character_set_connection follows the database, it's unknown here
+		charset := CollationCharset(Collations[c.collationId])
+		c.trackSystemVariable("character_set_client", charset)
+		c.trackSystemVariable("character_set_results", charset)
+	case "character_set_client", "character_set_connection", "character_set_results":
+		value = strings.ToLower(value)
+		if value == "null" {
+			value = ""
+		}
+		if value != "default" {
+			c.trackSystemVariable(e.Name, value)
+		}
+	default:
+		if !strings.EqualFold(value, "default") {
+			c.trackSystemVariable(e.Name, value)
+		}
+	}
+}
+
+// sessionStateInfo takes the state changes for the OK packet with the
+// status, the transaction state is reported once it changes.
+func (c *Connection) sessionStateInfo(status uint16) []byte {
+	if inTrans := status&SERVER_STATUS_IN_TRANS > 0; inTrans != c.trackedInTrans {
+		// the characters tell the transaction from its reads and writes, only
+		// the explicit transaction is known to the proxy
+		state := "________"
+		if inTrans {
+			state = "T_______"
+		}
+		c.trackStateChange(SESSION_TRACK_TRANSACTION_STATE, EncodeLencString([]byte(state)))
+		c.trackedInTrans = inTrans
+	}
+	info := c.stateChanges
+	c.stateChanges = nil
+	return info
+}
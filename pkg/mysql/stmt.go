@@ -0,0 +1,193 @@
+package mysql
+
+// The prepared statements are served for CALL only. The proxy keeps the
+// statement and the types of its parameters, and every execution prepares
+// it again on the node of the CALL, the binary response is relayed like
+// the one of COM_QUERY. Cursors and the long data are not supported.
+// https://dev.mysql.com/doc/internals/en/prepared-statements.html
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+// PreparedStmt is the response of a COM_STMT_PREPARE.
+type PreparedStmt struct {
+	Id       uint32
+	Params   []*Field
+	Columns  []*Field
+	Warnings uint16
+}
+
+// proxyStmt is a statement prepared by the client.
+type proxyStmt struct {
+	id     uint32
+	query  string
+	params int
+	// paramTypes are the types bound by the last execution, the next ones
+	// may leave them out
+	paramTypes []byte
+}
+
+// handleStmtPrepare prepares the CALL on its node for the parameters and
+// the columns of the response, the backend statement is closed right away.
+// https://dev.mysql.com/doc/internals/en/com-stmt-prepare.html
+func (c *Connection) handleStmtPrepare(query string) error {
+	if sqlparser.Preview(query) != sqlparser.STMT_CALL {
+		return c.writeError(NewDefaultMySqlError(ER_UNSUPPORTED_PS))
+	}
+	if c.env.Backend == nil {
+		return c.writeError(NewMySqlError(ER_UNKNOWN_ERROR, "No backend node is configured"))
+	}
+	plan, err := c.env.Router.Route(c.db, query)
+	if err != nil {
+		return c.writeError(err)
+	}
+	conns, err := c.borrowPlan(plan)
+	if err != nil {
+		return c.writeError(err)
+	}
+	defer c.releaseBackends()
+	ps, err := conns[0].Prepare(c.env.Router.Rewrite(query, conns[0].Node()))
+	if err != nil {
+		return c.writeError(err)
+	}
+	conns[0].CloseStmt(ps)
+
+	c.lastStmtId++
+	stmt := &proxyStmt{id: c.lastStmtId, query: query, params: len(ps.Params)}
+	c.stmts[stmt.id] = stmt
+
+	// COM_STMT_PREPARE_OK: https://dev.mysql.com/doc/internals/en/com-stmt-prepare-response.html
+	payload := make([]byte, 0, 12)
+	payload = append(payload, OK_HEADER)
+	payload = append(payload, EncodeUint32(stmt.id)...)
+	payload = append(payload, EncodeUint16(uint16(len(ps.Columns)))...)
+	payload = append(payload, EncodeUint16(uint16(len(ps.Params)))...)
+	payload = append(payload, 0)
+	payload = append(payload, EncodeUint16(ps.Warnings)...)
+	if err := c.writePacket(payload); err != nil {
+		return err
+	}
+	db := ""
+	if plan.Schema != nil {
+		db = plan.Schema.DB(conns[0].Node())
+	}
+	for _, fields := range [][]*Field{ps.Params, ps.Columns} {
+		if len(fields) == 0 {
+			continue
+		}
+		for _, f := range fields {
+			if db != "" && f.Schema == db {
+				f.Schema = plan.Schema.Name
+			}
+			if err := c.writePacket(f.Dump()); err != nil {
+				return err
+			}
+		}
+		if err := c.writeFieldsEOF(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleStmtExecute runs the statement like a COM_QUERY, the parameters
+// are passed on as they are.
+// https://dev.mysql.com/doc/internals/en/com-stmt-execute.html
+func (c *Connection) handleStmtExecute(body []byte) error {
+	if len(body) < 9 {
+		return c.writeError(NewDefaultMySqlError(ER_MALFORMED_PACKET))
+	}
+	id := binary.LittleEndian.Uint32(body)
+	stmt, ok := c.stmts[id]
+	if !ok {
+		return c.writeError(unknownStmt(id, "mysqld_stmt_execute"))
+	}
+	args, err := stmt.bind(body[4:])
+	if err != nil {
+		return c.writeError(NewDefaultMySqlError(ER_MALFORMED_PACKET))
+	}
+	c.setProcess(COM_STMT_EXECUTE, "starting", stmt.query)
+	return c.runQuery(stmt.query, func(query string, typ sqlparser.StmtType) error {
+		if c.env.Backend == nil {
+			return c.writeError(NewMySqlError(ER_UNKNOWN_ERROR, "No backend node is configured"))
+		}
+		plan, err := c.env.Router.Route(c.db, query)
+		if err != nil {
+			return c.writeError(err)
+		}
+		c.stats.shards = plan.Nodes
+		return c.streamPlan(query, plan, c.badSelect(query, true), func(conn BackendConn, query string, w ResultWriter) error {
+			ps, err := conn.Prepare(query)
+			if err != nil {
+				return err
+			}
+			defer conn.CloseStmt(ps)
+			if len(ps.Params) != stmt.params {
+				return NewDefaultMySqlError(ER_NEED_REPREPARE)
+			}
+			return conn.StreamExecute(ps, args, w)
+		})
+	})
+}
+
+// bind returns the arguments of COM_STMT_EXECUTE after the statement id,
+// with the types of the last execution if they are left out. The flags
+// are cleared, no cursor is opened.
+func (stmt *proxyStmt) bind(args []byte) ([]byte, error) {
+	// flags and iteration-count
+	args = append([]byte{0}, args[1:]...)
+	if stmt.params == 0 {
+		return args[:5], nil
+	}
+	pos := 5 + (stmt.params+7)/8
+	if len(args) <= pos {
+		return nil, ErrMalformPacket
+	}
+	if args[pos] == 1 {
+		if len(args) < pos+1+2*stmt.params {
+			return nil, ErrMalformPacket
+		}
+		stmt.paramTypes = append([]byte{}, args[pos+1:pos+1+2*stmt.params]...)
+		return args, nil
+	}
+	if stmt.paramTypes == nil {
+		return nil, ErrMalformPacket
+	}
+	bound := make([]byte, 0, len(args)+len(stmt.paramTypes))
+	bound = append(bound, args[:pos]...)
+	bound = append(bound, 1)
+	bound = append(bound, stmt.paramTypes...)
+	bound = append(bound, args[pos+1:]...)
+	return bound, nil
+}
+
+// https://dev.mysql.com/doc/internals/en/com-stmt-close.html
+func (c *Connection) handleStmtClose(body []byte) error {
+	// never answered, an unknown statement is ignored
+	if len(body) >= 4 {
+		delete(c.stmts, binary.LittleEndian.Uint32(body))
+	}
+	return nil
+}
+
+// handleStmtReset has nothing to reset, the long data is not supported
+// and no cursor is opened.
+// https://dev.mysql.com/doc/internals/en/com-stmt-reset.html
+func (c *Connection) handleStmtReset(body []byte) error {
+	if len(body) < 4 {
+		return c.writeError(NewDefaultMySqlError(ER_MALFORMED_PACKET))
+	}
+	id := binary.LittleEndian.Uint32(body)
+	if _, ok := c.stmts[id]; !ok {
+		return c.writeError(unknownStmt(id, "mysqld_stmt_reset"))
+	}
+	return c.writeOK(c.status, 0, 0)
+}
+
+func unknownStmt(id uint32, command string) error {
+	return NewMySqlError(ER_UNKNOWN_STMT_HANDLER, fmt.Sprintf("Unknown prepared statement handler (%d) given to %s", id, command))
+}
@@ -0,0 +1,132 @@
+package mysql
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStmtCall(t *testing.T) {
+	ps := &PreparedStmt{Id: 7, Params: []*Field{{Name: "?"}}}
+	backend := &stubBackend{conns: []*stubConn{{stmt: ps}, {stmt: ps}, {stmt: ps}}}
+	conn, client := setupBackendConnection(backend)
+	defer client.Close()
+
+	value := []byte{42, 0, 0, 0, 0, 0, 0, 0}
+	// CURSOR_TYPE_READ_ONLY, one iteration, no NULL, the types bound
+	execute := append([]byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 1, 1, 0, 0, 0, 0, 1, MYSQL_TYPE_LONGLONG, 0}, value...)
+	// the types of the last execution
+	executeAgain := append([]byte{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0}, value...)
+	requests := [][]byte{
+		append([]byte{COM_STMT_PREPARE}, "CALL p(?)"...),
+		execute,
+		executeAgain,
+		{COM_STMT_CLOSE, 1, 0, 0, 0},
+		executeAgain,
+	}
+	go func() {
+		for _, payload := range requests {
+			conn.handleRequestPacket(payload)
+		}
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	prepareOK := []byte{OK_HEADER, 1, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0}
+	if !bytes.Contains(buf, prepareOK) || !bytes.Contains(buf, EncodeUint16(ER_UNKNOWN_STMT_HANDLER)) {
+		t.Fatalf("bad result: %q, expected the statement 1 and ER_UNKNOWN_STMT_HANDLER after its close", buf)
+	}
+	if len(backend.got) != 3 {
+		t.Fatalf("bad result: %d connections, expected 3", len(backend.got))
+	}
+	if queries := backend.got[0].queries; len(queries) != 2 || queries[0] != "PREPARE CALL p(?)" || queries[1] != "CLOSE 7" {
+		t.Fatalf("bad queries: %v", queries)
+	}
+	// the cursor is never opened
+	expectedArgs := append([]byte{0, 1, 0, 0, 0, 0, 1, MYSQL_TYPE_LONGLONG, 0}, value...)
+	for _, bc := range backend.got[1:] {
+		if len(bc.args) != 1 || !bytes.Equal(bc.args[0], expectedArgs) {
+			t.Fatalf("bad args: %v, expected: %v", bc.args, expectedArgs)
+		}
+	}
+}
+
+func TestStmtPrepareNotCall(t *testing.T) {
+	backend := &stubBackend{}
+	conn, client := setupBackendConnection(backend)
+	defer client.Close()
+	go func() {
+		conn.handleRequestPacket(append([]byte{COM_STMT_PREPARE}, "SELECT 1"...))
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Contains(buf, EncodeUint16(ER_UNSUPPORTED_PS)) || len(backend.got) != 0 {
+		t.Fatalf("bad result: %q, expected ER_UNSUPPORTED_PS", buf)
+	}
+}
+
+func TestBadSelect(t *testing.T) {
+	resultSet := &Result{ResultSet: &ResultSet{Fields: []*Field{{Name: "col_a"}}}, Status: SERVER_MORE_RESULTS_EXISTS, Next: &Result{}}
+	tests := []struct {
+		capabilities uint32
+		requests     [][]byte
+		results      map[string]*Result
+		code         uint16
+	}{
+		{
+			CLIENT_PS_MULTI_RESULTS,
+			[][]byte{append([]byte{COM_QUERY}, "CALL p()"...)},
+			map[string]*Result{"CALL p()": resultSet},
+			ER_SP_BADSELECT,
+		},
+		// an OK alone is fine
+		{
+			CLIENT_PS_MULTI_RESULTS,
+			[][]byte{append([]byte{COM_QUERY}, "CALL p()"...)},
+			map[string]*Result{},
+			0,
+		},
+		{
+			CLIENT_MULTI_RESULTS,
+			[][]byte{
+				append([]byte{COM_STMT_PREPARE}, "CALL p()"...),
+				{COM_STMT_EXECUTE, 1, 0, 0, 0, 0, 1, 0, 0, 0},
+			},
+			map[string]*Result{"EXECUTE 1": resultSet},
+			ER_SP_BADSELECT,
+		},
+	}
+	for i, tt := range tests {
+		backend := &stubBackend{conns: []*stubConn{{results: tt.results}, {results: tt.results}}}
+		conn, client := setupBackendConnection(backend)
+		conn.capabilities &^= CLIENT_MULTI_RESULTS | CLIENT_PS_MULTI_RESULTS
+		conn.capabilities |= tt.capabilities
+		go func() {
+			for _, payload := range tt.requests {
+				conn.handleRequestPacket(payload)
+			}
+			conn.Close()
+		}()
+		buf, err := ioutil.ReadAll(client)
+		client.Close()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if tt.code == 0 {
+			if bytes.Contains(buf, []byte{ERR_HEADER}) {
+				t.Fatalf("case %d: bad result: %q, expected no error", i, buf)
+			}
+			continue
+		}
+		// nothing of the resultset is written before the error
+		if !bytes.Contains(buf, EncodeUint16(tt.code)) || bytes.Contains(buf, []byte("col_a")) {
+			t.Fatalf("case %d: bad result: %q, expected the error %d", i, buf, tt.code)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package mysql
+
+// The response of a single node is relayed to the client as it is read,
+// the rows are written as they come, with the sequence of the client. The
+// proxy holds no more than a row, and a slow client holds the backend back
+// through the full buffers of the connections.
+
+import (
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/router"
+)
+
+// ResultWriter takes a response streamed by BackendConn.Stream or
+// BackendConn.StreamExecute.
+type ResultWriter interface {
+	// WriteFields starts a resultset
+	WriteFields(fields []*Field) error
+	// WriteRow takes the payload of a row of the text protocol, or of the
+	// binary protocol for StreamExecute, it is only valid during the call
+	WriteRow(payload []byte) error
+	// WriteResult ends a resultset, or takes an OK with a nil ResultSet,
+	// SERVER_MORE_RESULTS_EXISTS in its status tells that more follow
+	WriteResult(r *Result) error
+}
+
+// resultRelay writes a streamed response to the client like writeResults.
+type resultRelay struct {
+	c *Connection
+	// db is the physical database of the node, it is shown as the logical
+	// schema in the column definitions
+	db     string
+	schema string
+	// more is the SERVER_MORE_RESULTS_EXISTS of the statement itself, set
+	// in the middle of a multi-statement
+	more uint16
+	// err is the failure of the writes to the client, the response is
+	// broken then and no ERR follows
+	err error
+	// badSelect fails the first resultset before anything is written, the
+	// ERR is sent in place of the response
+	badSelect error
+}
+
+func (r *resultRelay) WriteFields(fields []*Field) error {
+	if r.badSelect != nil {
+		return r.badSelect
+	}
+	c := r.c
+	c.setProcessState("sending data")
+	if err := c.writePacket(EncodeLencInt(uint64(len(fields)))); err != nil {
+		return r.fail(err)
+	}
+	for _, f := range fields {
+		if r.db != "" && f.Schema == r.db {
+			f.Schema = r.schema
+		}
+		if err := c.writePacket(f.Dump()); err != nil {
+			return r.fail(err)
+		}
+	}
+	return r.fail(c.writeFieldsEOF())
+}
+
+func (r *resultRelay) WriteRow(payload []byte) error {
+	if err := r.c.writePacket(payload); err != nil {
+		return r.fail(err)
+	}
+	r.c.stats.rowsSent++
+	return nil
+}
+
+func (r *resultRelay) WriteResult(result *Result) error {
+	c := r.c
+	c.status &^= SERVER_MORE_RESULTS_EXISTS | SERVER_PS_OUT_PARAMS
+	c.status |= result.Status&(SERVER_MORE_RESULTS_EXISTS|SERVER_PS_OUT_PARAMS) | r.more
+	if result.ResultSet != nil {
+		return r.fail(c.writeEOF(result.Warnings, c.status))
+	}
+	return r.fail(c.writeOK(c.status, result.AffectedRows, result.InsertId))
+}
+
+func (r *resultRelay) fail(err error) error {
+	if err != nil {
+		r.err = err
+	}
+	return err
+}
+
+// streamQuery runs the statement on the single node of the plan and relays
+// its response as it is read.
+func (c *Connection) streamQuery(query string, plan *router.Plan) error {
+	return c.streamPlan(query, plan, c.badSelect(query, false), func(conn BackendConn, query string, w ResultWriter) error {
+		return conn.Stream(query, w)
+	})
+}
+
+// streamPlan borrows the single node of the plan and relays what run
+// streams of the statement rewritten for the node. badSelect refuses the
+// resultsets, see Connection.badSelect. The rows are written during the
+// statement, so its timeout counts the time of a slow client too.
+func (c *Connection) streamPlan(query string, plan *router.Plan, badSelect error, run func(conn BackendConn, query string, w ResultWriter) error) error {
+	relay := &resultRelay{c: c, more: c.status & SERVER_MORE_RESULTS_EXISTS, badSelect: badSelect}
+	if plan.Schema != nil {
+		if db := plan.Schema.DB(plan.Nodes[0]); db != plan.Schema.Name {
+			relay.db, relay.schema = db, plan.Schema.Name
+		}
+	}
+	defer func() {
+		c.status = c.status&^(SERVER_MORE_RESULTS_EXISTS|SERVER_PS_OUT_PARAMS) | relay.more
+	}()
+
+	c.setProcessState("executing")
+	start := time.Now()
+	err := c.withTimeout(query, c.maxExecutionTime(query), func() error {
+		conns, err := c.borrowPlan(plan)
+		if err != nil {
+			return err
+		}
+		c.setRunning(conns)
+		defer func() {
+			c.setRunning(nil)
+			c.releaseBackends()
+		}()
+		return run(conns[0], c.env.Router.Rewrite(query, conns[0].Node()), relay)
+	})
+	// the time of the backend includes the time of the client here
+	c.stats.backendTime = time.Since(start)
+	if relay.err != nil {
+		return relay.err
+	}
+	if err != nil {
+		c.log.Debug("streamPlan: node %s fail: err=%s", plan.Nodes[0], err)
+		return c.writeError(err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package mysql
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestResultRelay(t *testing.T) {
+	conn, client := setupConnnection()
+	defer client.Close()
+	relay := &resultRelay{c: conn, db: "db1_0", schema: "db1"}
+	row := append(EncodeLencString([]byte("x")), 0xfb)
+	go func() {
+		relay.WriteFields([]*Field{{Schema: "db1_0", Table: "t", Name: "a"}, {Schema: "db1_0", Table: "t", Name: "b"}})
+		relay.WriteRow(row)
+		relay.WriteResult(&Result{ResultSet: &ResultSet{}, Warnings: 1})
+		conn.Close()
+	}()
+	buf, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// the sequence is checked by ReadPacket
+	pio := NewPacketIO(bytes.NewBuffer(buf), nil)
+	payloads := [][]byte{}
+	for i := 0; i < 6; i++ {
+		payload, err := pio.ReadPacket()
+		if err != nil {
+			t.Fatalf("packet %d: err on ReadPacket: %s", i, err)
+		}
+		payloads = append(payloads, append([]byte{}, payload...))
+	}
+	if !bytes.Equal(payloads[0], []byte{2}) {
+		t.Fatalf("bad column count: %v", payloads[0])
+	}
+	for _, payload := range payloads[1:3] {
+		f, err := ParseField(payload)
+		if err != nil || f.Schema != "db1" || f.Table != "t" {
+			t.Fatalf("bad field: %+v %v, expected the schema db1", f, err)
+		}
+	}
+	if !IsEOF(payloads[3]) || !bytes.Equal(payloads[4], row) {
+		t.Fatalf("bad result: %v %v, expected the EOF and the row: %v", payloads[3], payloads[4], row)
+	}
+	if warnings, status := ParseEOF(payloads[5]); warnings != 1 || status != SERVER_STATUS_AUTOCOMMIT {
+		t.Fatalf("bad EOF: %v", payloads[5])
+	}
+	if conn.stats.rowsSent != 1 || relay.err != nil {
+		t.Fatalf("bad result: %d %v", conn.stats.rowsSent, relay.err)
+	}
+}
@@ -2,6 +2,7 @@ package mysql
 
 import (
 	"crypto/rand"
+	"crypto/sha1"
 	"io"
 )
 
@@ -132,3 +133,32 @@ func GenerateRandBuf(n int) []byte {
 	rand.Read(buf)
 	return buf
 }
+
+// GenerateSalt returns printable random bytes, some clients stop reading
+// the auth-plugin-data at a NUL byte.
+func GenerateSalt(n int) []byte {
+	buf := GenerateRandBuf(n)
+	for i, b := range buf {
+		buf[i] = '!' + b%('~'-'!'+1)
+	}
+	return buf
+}
+
+// ScramblePassword computes the mysql_native_password auth response:
+// SHA1(password) XOR SHA1(salt + SHA1(SHA1(password)))
+func ScramblePassword(salt []byte, password []byte) []byte {
+	if len(password) == 0 {
+		return nil
+	}
+	stage1 := sha1.Sum(password)
+	stage2 := sha1.Sum(stage1[:])
+
+	h := sha1.New()
+	h.Write(salt)
+	h.Write(stage2[:])
+	scramble := h.Sum(nil)
+	for i := range scramble {
+		scramble[i] ^= stage1[i]
+	}
+	return scramble
+}
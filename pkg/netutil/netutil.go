@@ -0,0 +1,99 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseIPNet parses an IP or a CIDR, a single IP is a network of itself.
+func ParseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		return ipnet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %s", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func ParseIPNets(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		ipnet, err := ParseIPNet(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// ContainsIP reports whether the host is in any of the networks.
+func ContainsIP(nets []*net.IPNet, host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostPattern is a host in mysql's account syntax, it is either a CIDR
+// or a pattern with the % and _ wildcards, like 10.0.% or 192.168.1._
+type HostPattern struct {
+	pattern string
+	ipnet   *net.IPNet
+}
+
+func ParseHostPattern(s string) (*HostPattern, error) {
+	p := &HostPattern{pattern: s}
+	if strings.Contains(s, "/") {
+		ipnet, err := ParseIPNet(s)
+		if err != nil {
+			return nil, err
+		}
+		p.ipnet = ipnet
+	}
+	return p, nil
+}
+
+func (p *HostPattern) Match(host string) bool {
+	if p.ipnet != nil {
+		return ContainsIP([]*net.IPNet{p.ipnet}, host)
+	}
+	return matchWildcard(p.pattern, host)
+}
+
+func (p *HostPattern) String() string {
+	return p.pattern
+}
+
+// matchWildcard matches the % (any string) and _ (any char) wildcards.
+func matchWildcard(pattern string, s string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+	switch pattern[0] {
+	case '%':
+		for i := 0; i <= len(s); i++ {
+			if matchWildcard(pattern[1:], s[i:]) {
+				return true
+			}
+		}
+		return false
+	case '_':
+		return s != "" && matchWildcard(pattern[1:], s[1:])
+	}
+	return s != "" && pattern[0] == s[0] && matchWildcard(pattern[1:], s[1:])
+}
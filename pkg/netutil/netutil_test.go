@@ -0,0 +1,31 @@
+package netutil
+
+import (
+	"testing"
+)
+
+func TestHostPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		host    string
+		match   bool
+	}{
+		{"%", "10.0.0.1", true},
+		{"10.0.%", "10.0.3.1", true},
+		{"10.0.%", "10.1.3.1", false},
+		{"192.168.1._", "192.168.1.7", true},
+		{"192.168.1._", "192.168.1.17", false},
+		{"127.0.0.1", "127.0.0.1", true},
+		{"10.0.0.0/8", "10.20.30.40", true},
+		{"10.0.0.0/8", "11.20.30.40", false},
+	}
+	for _, c := range cases {
+		p, err := ParseHostPattern(c.pattern)
+		if err != nil {
+			t.Fatalf("ParseHostPattern %s err: %s", c.pattern, err)
+		}
+		if p.Match(c.host) != c.match {
+			t.Fatalf("bad match of %s against %s, expected: %v", c.host, c.pattern, c.match)
+		}
+	}
+}
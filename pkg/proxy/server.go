@@ -4,24 +4,40 @@ import (
 	"net"
 	"runtime"
 
+	"github.com/Fleurer/hardshard/pkg/backend"
+	"github.com/Fleurer/hardshard/pkg/config"
+	"github.com/Fleurer/hardshard/pkg/log"
 	"github.com/Fleurer/hardshard/pkg/mysql"
-	"github.com/siddontang/go-log/log"
 )
 
 type Server struct {
 	addr     string
 	listener net.Listener
+	env      *mysql.Env
 
 	isRunning bool
 }
 
-func NewServer(addr string) (*Server, error) {
+func NewServer(cfg *config.Config) (*Server, error) {
 	s := &Server{}
-	s.addr = addr
+	s.addr = cfg.Addr
 
 	var err error
-	s.listener, err = net.Listen("tcp", addr)
+	var cluster mysql.Backend
+	if len(cfg.Nodes) > 0 {
+		cluster = backend.NewCluster(cfg.Nodes)
+	}
+	s.env, err = mysql.NewEnv(cfg, cluster)
+	if err != nil {
+		if cluster != nil {
+			cluster.Close()
+		}
+		return nil, err
+	}
+
+	s.listener, err = net.Listen("tcp", s.addr)
 	if err != nil {
+		s.env.Close()
 		return nil, err
 	}
 
@@ -50,10 +66,17 @@ func (s *Server) Close() {
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	s.env.Close()
 }
 
 func (s *Server) handleConn(conn net.Conn) {
-	myconn := mysql.NewConnection(conn)
+	myconn := mysql.NewConnection(conn, s.env)
+
+	if err := s.env.Admit(myconn); err != nil {
+		log.Warn("reject %s: %s", conn.RemoteAddr(), err)
+		myconn.Reject(err)
+		return
+	}
 
 	defer func() {
 		if err := recover(); err != nil {
@@ -63,6 +86,7 @@ func (s *Server) handleConn(conn net.Conn) {
 		}
 
 		myconn.Close()
+		s.env.Release(myconn)
 	}()
 
 	myconn.Run()
@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/config"
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+const (
+	// MODE_REJECT fails the statement at once when the bucket is empty
+	MODE_REJECT = "reject"
+	// MODE_WAIT queues the statement until a token is available, up to max_wait
+	MODE_WAIT = "wait"
+
+	// ANY_USER gives every user a bucket of its own
+	ANY_USER = "*"
+)
+
+// Bucket is a token bucket refilled at rate tokens per second.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate float64, burst float64) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Reserve takes a token and returns how long the caller has to wait before
+// using it, nothing is taken if the wait would be longer than maxWait.
+func (b *Bucket) Reserve(now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		return wait, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// Cancel gives back a token taken by Reserve.
+func (b *Bucket) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens++; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+type Rule struct {
+	Name        string
+	user        string
+	fingerprint string
+	rate        float64
+	burst       float64
+	maxWait     time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+}
+
+// QPS is the refill rate of the rule's buckets.
+func (r *Rule) QPS() float64 {
+	return r.rate
+}
+
+func (r *Rule) match(user string, fingerprint string) bool {
+	if r.user != "" && r.user != ANY_USER && r.user != user {
+		return false
+	}
+	return r.fingerprint == "" || r.fingerprint == fingerprint
+}
+
+// bucket returns the bucket of the user if the rule is for every user,
+// otherwise the rule has a single bucket.
+func (r *Rule) bucket(user string) *Bucket {
+	key := ""
+	if r.user == ANY_USER {
+		key = user
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.buckets[key]
+	if !ok {
+		b = NewBucket(r.rate, r.burst)
+		r.buckets[key] = b
+	}
+	return b
+}
+
+type Limiter struct {
+	rules []*Rule
+	// hasFingerprints tells whether the callers need to compute the fingerprints
+	hasFingerprints bool
+}
+
+func New(cfgs []config.RateLimitConfig) (*Limiter, error) {
+	l := &Limiter{}
+	for i, rc := range cfgs {
+		if rc.QPS <= 0 {
+			return nil, fmt.Errorf("rate limit #%d %s: qps must be positive", i, rc.Name)
+		}
+		r := &Rule{
+			Name:    rc.Name,
+			user:    rc.User,
+			rate:    rc.QPS,
+			burst:   rc.Burst,
+			buckets: map[string]*Bucket{},
+		}
+		if rc.Fingerprint != "" {
+			r.fingerprint = sqlparser.Fingerprint(rc.Fingerprint)
+			l.hasFingerprints = true
+		}
+		switch rc.Mode {
+		case MODE_REJECT, "":
+		case MODE_WAIT:
+			r.maxWait = time.Duration(rc.MaxWait) * time.Millisecond
+		default:
+			return nil, fmt.Errorf("rate limit #%d %s: unknown mode %s", i, rc.Name, rc.Mode)
+		}
+		l.rules = append(l.rules, r)
+	}
+	return l, nil
+}
+
+func (l *Limiter) Empty() bool {
+	return len(l.rules) == 0
+}
+
+func (l *Limiter) HasFingerprints() bool {
+	return l.hasFingerprints
+}
+
+// Acquire takes a token from every matched rule, it sleeps if a rule asks to
+// wait, and returns the rule that rejects the statement if there is one. A
+// rejected statement takes nothing, the tokens of the other rules are given
+// back.
+func (l *Limiter) Acquire(user string, fingerprint string) *Rule {
+	now := time.Now()
+	var wait time.Duration
+	var reserved []*Bucket
+	for _, r := range l.rules {
+		if !r.match(user, fingerprint) {
+			continue
+		}
+		b := r.bucket(user)
+		w, ok := b.Reserve(now, r.maxWait)
+		if !ok {
+			for _, b := range reserved {
+				b.Cancel()
+			}
+			return r
+		}
+		reserved = append(reserved, b)
+		if w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return nil
+}
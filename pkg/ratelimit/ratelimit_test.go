@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/config"
+)
+
+func TestBucket(t *testing.T) {
+	b := NewBucket(10, 2)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if w, ok := b.Reserve(now, 0); !ok || w != 0 {
+			t.Fatalf("burst token %d: wait %v, ok %v", i, w, ok)
+		}
+	}
+	if _, ok := b.Reserve(now, 0); ok {
+		t.Fatalf("expected the bucket to be empty")
+	}
+	if w, ok := b.Reserve(now, time.Second); !ok || w != 100*time.Millisecond {
+		t.Fatalf("bad wait: %v, ok %v", w, ok)
+	}
+	// the reserved token is paid back after 100ms
+	if w, ok := b.Reserve(now.Add(150*time.Millisecond), time.Second); !ok || w != 50*time.Millisecond {
+		t.Fatalf("bad wait: %v, ok %v", w, ok)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l, err := New([]config.RateLimitConfig{
+		{Name: "per-user", User: ANY_USER, QPS: 1, Burst: 1},
+		{Name: "hot-query", Fingerprint: "SELECT * FROM t WHERE id = 1", QPS: 1, Burst: 1},
+	})
+	if err != nil {
+		t.Fatalf("New err: %s", err)
+	}
+	if r := l.Acquire("a", "select 1"); r != nil {
+		t.Fatalf("unexpected reject by %s", r.Name)
+	}
+	if r := l.Acquire("a", "select 1"); r == nil || r.Name != "per-user" {
+		t.Fatalf("expected reject by per-user, got %v", r)
+	}
+	if r := l.Acquire("b", "select * from t where id = ?"); r != nil {
+		t.Fatalf("unexpected reject by %s", r.Name)
+	}
+	if r := l.Acquire("c", "select * from t where id = ?"); r == nil || r.Name != "hot-query" {
+		t.Fatalf("expected reject by hot-query, got %v", r)
+	}
+	// the rejected statement gave its token back to per-user
+	if r := l.Acquire("c", "select 1"); r != nil {
+		t.Fatalf("unexpected reject by %s", r.Name)
+	}
+}
@@ -0,0 +1,109 @@
+package rotatefile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Writer appends to a file and rotates it once it grows beyond maxSize bytes,
+// the rotated files are named path.1, path.2, ... with path.1 the newest.
+type Writer struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func New(path string, maxSize int64, maxBackups int) (*Writer, error) {
+	w := &Writer{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *Writer) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = st.Size()
+	return nil
+}
+
+// rotate moves the file to the backups and opens a new one. The file is
+// reopened as it is if it can't be moved, the writes after go on in it.
+func (w *Writer) rotate() error {
+	err := w.file.Close()
+	w.file = nil
+	if err == nil {
+		err = w.shift()
+	}
+	if e := w.open(); e != nil {
+		return e
+	}
+	return err
+}
+
+// shift renames the file to path.1 and the backups one up, or truncates
+// it without backups.
+func (w *Writer) shift() error {
+	if w.maxBackups > 0 {
+		os.Remove(w.backupName(w.maxBackups))
+		for i := w.maxBackups - 1; i > 0; i-- {
+			os.Rename(w.backupName(i), w.backupName(i+1))
+		}
+		return os.Rename(w.path, w.backupName(1))
+	}
+	return os.Truncate(w.path, 0)
+}
+
+func (w *Writer) backupName(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
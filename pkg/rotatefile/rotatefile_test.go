@@ -0,0 +1,43 @@
+package rotatefile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotatefile")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.log")
+	w, err := New(path, 8, 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte("0123456\n")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// a.log can't be renamed onto a directory which is not empty
+	if err := os.MkdirAll(filepath.Join(path+".1", "x"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := w.Write([]byte("rotate\n")); err == nil {
+		t.Fatalf("expected the error of the rotation")
+	}
+	os.RemoveAll(path + ".1")
+	// the writes go on once the file can be rotated again
+	if _, err := w.Write([]byte("rotate\n")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for name, expected := range map[string]string{path: "rotate\n", path + ".1": "0123456\n"} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil || string(data) != expected {
+			t.Fatalf("bad %s: %q %v, expected: %q", name, data, err, expected)
+		}
+	}
+}
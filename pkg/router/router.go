@@ -0,0 +1,262 @@
+package router
+
+// The router picks the backend nodes of a statement. A sharded table is
+// spread over all the nodes of its schema by the hash of the sharding key,
+// the statements that do not pin the key go to all of them. The other
+// tables live on the first node of the schema.
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/Fleurer/hardshard/pkg/config"
+	"github.com/Fleurer/hardshard/pkg/sqlparser"
+)
+
+type Schema struct {
+	Name  string
+	Nodes []string
+	// physical databases by node
+	dbs map[string]string
+	// sharding keys by table name, lower cased
+	keys map[string]string
+	// nodes of the stored procedures by name, lower cased
+	procedures map[string]string
+}
+
+// Plan is where a statement goes.
+type Plan struct {
+	// Schema is nil if the statement does not touch a configured schema
+	Schema *Schema
+	Nodes  []string
+}
+
+type Router struct {
+	nodes   []string
+	schemas map[string]*Schema
+	names   []string
+	// renamed is set if any physical database differs from its schema name
+	renamed bool
+}
+
+func New(nodes []config.NodeConfig, schemas []config.SchemaConfig) (*Router, error) {
+	r := &Router{schemas: map[string]*Schema{}}
+	known := map[string]bool{}
+	for _, n := range nodes {
+		if known[n.Name] {
+			return nil, fmt.Errorf("router: duplicated node %s", n.Name)
+		}
+		known[n.Name] = true
+		r.nodes = append(r.nodes, n.Name)
+	}
+	for _, sc := range schemas {
+		s := &Schema{Name: sc.Name, Nodes: sc.Nodes, dbs: map[string]string{}, keys: map[string]string{}, procedures: map[string]string{}}
+		if len(s.Nodes) == 0 {
+			s.Nodes = r.nodes
+		}
+		inSchema := map[string]bool{}
+		for _, n := range s.Nodes {
+			if !known[n] {
+				return nil, fmt.Errorf("router: schema %s: unknown node %s", sc.Name, n)
+			}
+			inSchema[n] = true
+			s.dbs[n] = sc.Name
+		}
+		for n, db := range sc.DBs {
+			if !inSchema[n] {
+				return nil, fmt.Errorf("router: schema %s: database of node %s which is not in the schema", sc.Name, n)
+			}
+			s.dbs[n] = db
+			if db != sc.Name {
+				r.renamed = true
+			}
+		}
+		for _, t := range sc.Tables {
+			s.keys[strings.ToLower(t.Name)] = t.Key
+		}
+		for p, n := range sc.Procedures {
+			if !inSchema[n] {
+				return nil, fmt.Errorf("router: schema %s: procedure %s on node %s which is not in the schema", sc.Name, p, n)
+			}
+			s.procedures[strings.ToLower(p)] = n
+		}
+		if _, ok := r.schemas[sc.Name]; ok {
+			return nil, fmt.Errorf("router: duplicated schema %s", sc.Name)
+		}
+		r.schemas[sc.Name] = s
+		r.names = append(r.names, sc.Name)
+	}
+	return r, nil
+}
+
+func (r *Router) Schema(name string) *Schema {
+	return r.schemas[name]
+}
+
+// Schemas returns the names of the configured schemas in order.
+func (r *Router) Schemas() []string {
+	return r.names
+}
+
+// HasSchemas tells whether the clients are restricted to the configured schemas.
+func (r *Router) HasSchemas() bool {
+	return len(r.names) > 0
+}
+
+// Rewrite renames the schemas qualifying the tables to the physical
+// databases on the node.
+func (r *Router) Rewrite(query string, node string) string {
+	if !r.renamed {
+		return query
+	}
+	return sqlparser.RenameSchemas(query, func(name string) (string, bool) {
+		s, ok := r.schemas[name]
+		if !ok {
+			return "", false
+		}
+		db, ok := s.dbs[node]
+		return db, ok
+	})
+}
+
+// DefaultNode is the node of the statements out of any configured schema.
+func (r *Router) DefaultNode() string {
+	if len(r.nodes) == 0 {
+		return ""
+	}
+	return r.nodes[0]
+}
+
+// DB returns the physical database of the schema on the node.
+func (s *Schema) DB(node string) string {
+	if db, ok := s.dbs[node]; ok {
+		return db
+	}
+	return s.Name
+}
+
+// IsSharded reports whether the table is spread over the nodes.
+func (s *Schema) IsSharded(table string) bool {
+	_, ok := s.keys[strings.ToLower(table)]
+	return ok
+}
+
+// Key returns the sharding key of the table.
+func (s *Schema) Key(table string) (string, bool) {
+	key, ok := s.keys[strings.ToLower(table)]
+	return key, ok
+}
+
+// Shard returns the node holding the row of the sharding key value.
+func (s *Schema) Shard(value string) string {
+	var h uint64
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if n < 0 {
+			n = -n
+		}
+		h = uint64(n)
+	} else {
+		h = uint64(crc32.ChecksumIEEE([]byte(value)))
+	}
+	return s.Nodes[h%uint64(len(s.Nodes))]
+}
+
+// Route plans the statement run in the database db.
+func (r *Router) Route(db string, query string) (*Plan, error) {
+	info := sqlparser.Analyze(query)
+	if info.Type == sqlparser.STMT_CALL {
+		return r.routeCall(db, query)
+	}
+	schema := r.schemas[db]
+	for _, t := range info.Tables {
+		if t.Schema != "" {
+			if s, ok := r.schemas[t.Schema]; ok {
+				schema = s
+				break
+			}
+		}
+	}
+	if schema == nil {
+		if len(r.nodes) == 0 {
+			return nil, fmt.Errorf("router: no backend node")
+		}
+		return &Plan{Nodes: r.nodes[:1]}, nil
+	}
+
+	plan := &Plan{Schema: schema, Nodes: schema.Nodes[:1]}
+	for _, t := range info.Tables {
+		key, ok := schema.keys[strings.ToLower(t.Name)]
+		if !ok || (t.Schema != "" && t.Schema != schema.Name) {
+			continue
+		}
+		values, ok := sqlparser.KeyValues(query, key)
+		if !ok {
+			if info.Type == sqlparser.STMT_INSERT || info.Type == sqlparser.STMT_REPLACE {
+				return nil, fmt.Errorf("router: the sharding key %s of table %s is required", key, t.Name)
+			}
+			plan.Nodes = schema.Nodes
+			return plan, nil
+		}
+		plan.Nodes = schema.shards(values)
+		if len(plan.Nodes) > 1 && (info.Type == sqlparser.STMT_INSERT || info.Type == sqlparser.STMT_REPLACE) {
+			return nil, fmt.Errorf("router: the rows of table %s span %d shards", t.Name, len(plan.Nodes))
+		}
+		return plan, nil
+	}
+	return plan, nil
+}
+
+// routeCall sends the CALL to a single node: the one of the NODE hint, or
+// else the one of the procedure in the config, or else the first node.
+func (r *Router) routeCall(db string, query string) (*Plan, error) {
+	// a broken CALL goes to the first node, which reports the syntax error
+	proc, _ := sqlparser.ParseCall(query)
+	schema := r.schemas[db]
+	if s, ok := r.schemas[proc.Schema]; ok {
+		schema = s
+	}
+	plan := &Plan{Schema: schema, Nodes: r.nodes}
+	if schema != nil {
+		plan.Nodes = schema.Nodes
+	}
+	if len(plan.Nodes) == 0 {
+		return nil, fmt.Errorf("router: no backend node")
+	}
+	if h, ok := sqlparser.FindHint(sqlparser.ParseHints(query), "node"); ok && len(h.Args) == 1 {
+		for _, n := range plan.Nodes {
+			if n == h.Args[0] {
+				plan.Nodes = []string{n}
+				return plan, nil
+			}
+		}
+		if schema != nil {
+			return nil, fmt.Errorf("router: schema %s is not on node %s of the hint", schema.Name, h.Args[0])
+		}
+		return nil, fmt.Errorf("router: unknown node %s of the hint", h.Args[0])
+	}
+	if schema != nil {
+		if n, ok := schema.procedures[strings.ToLower(proc.Name)]; ok {
+			plan.Nodes = []string{n}
+			return plan, nil
+		}
+	}
+	plan.Nodes = plan.Nodes[:1]
+	return plan, nil
+}
+
+// shards returns the distinct nodes of the values in the order of the schema.
+func (s *Schema) shards(values []string) []string {
+	hit := map[string]bool{}
+	for _, v := range values {
+		hit[s.Shard(v)] = true
+	}
+	nodes := make([]string, 0, len(hit))
+	for _, n := range s.Nodes {
+		if hit[n] {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,109 @@
+package router
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Fleurer/hardshard/pkg/config"
+)
+
+func TestRoute(t *testing.T) {
+	nodes := []config.NodeConfig{{Name: "n0"}, {Name: "n1"}, {Name: "n2"}}
+	schemas := []config.SchemaConfig{
+		{Name: "db1", Tables: []config.TableConfig{{Name: "orders", Key: "user_id"}}},
+	}
+	r, err := New(nodes, schemas)
+	if err != nil {
+		t.Fatalf("New err: %s", err)
+	}
+	cases := []struct {
+		db    string
+		query string
+		nodes []string
+	}{
+		{"db1", "SELECT * FROM orders WHERE user_id = 4", []string{"n1"}},
+		{"db1", "SELECT * FROM orders WHERE user_id IN (3, 4, 6)", []string{"n0", "n1"}},
+		{"db1", "SELECT * FROM orders", []string{"n0", "n1", "n2"}},
+		{"db1", "INSERT INTO orders (user_id, x) VALUES (5, 1)", []string{"n2"}},
+		{"db1", "SELECT * FROM users", []string{"n0"}},
+		{"", "SELECT * FROM db1.orders WHERE user_id = 2", []string{"n2"}},
+		{"other", "SELECT 1", []string{"n0"}},
+	}
+	for _, c := range cases {
+		plan, err := r.Route(c.db, c.query)
+		if err != nil {
+			t.Fatalf("Route %q err: %s", c.query, err)
+		}
+		if !reflect.DeepEqual(plan.Nodes, c.nodes) {
+			t.Fatalf("bad result of %q: %v, expected: %v", c.query, plan.Nodes, c.nodes)
+		}
+	}
+	if _, err := r.Route("db1", "INSERT INTO orders (user_id) VALUES (1), (2)"); err == nil {
+		t.Fatalf("expected an error for the rows across shards")
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	nodes := []config.NodeConfig{{Name: "n0"}, {Name: "n1"}}
+	schemas := []config.SchemaConfig{
+		{Name: "db1", DBs: map[string]string{"n0": "db1_0", "n1": "db1_1"}},
+		{Name: "db2"},
+	}
+	r, err := New(nodes, schemas)
+	if err != nil {
+		t.Fatalf("New err: %s", err)
+	}
+	query := "SELECT db1.t.a, o.b FROM db1.t JOIN `db1`.o ON o.x = 'db1.t' JOIN db2.u"
+	expected := "SELECT `db1_1`.t.a, o.b FROM `db1_1`.t JOIN `db1_1`.o ON o.x = 'db1.t' JOIN db2.u"
+	if got := r.Rewrite(query, "n1"); got != expected {
+		t.Fatalf("bad result: %s, expected: %s", got, expected)
+	}
+	// the alias db1 and its qualifiers are not the schema
+	query = "SELECT db1.a, db1.t.* FROM t AS db1, db1.t2 x JOIN db1 ON db1.id = x.id WHERE db1.b IN (SELECT c FROM db1.u)"
+	expected = "SELECT db1.a, `db1_0`.t.* FROM t AS db1, `db1_0`.t2 x JOIN db1 ON db1.id = x.id WHERE db1.b IN (SELECT c FROM `db1_0`.u)"
+	if got := r.Rewrite(query, "n0"); got != expected {
+		t.Fatalf("bad result: %s, expected: %s", got, expected)
+	}
+	if db := r.Schema("db1").DB("n0"); db != "db1_0" {
+		t.Fatalf("bad db: %s", db)
+	}
+}
+
+func TestRouteCall(t *testing.T) {
+	nodes := []config.NodeConfig{{Name: "n0"}, {Name: "n1"}, {Name: "n2"}}
+	schemas := []config.SchemaConfig{
+		{Name: "db1", Nodes: []string{"n1", "n2"}, Procedures: map[string]string{"Archive": "n2"}},
+	}
+	r, err := New(nodes, schemas)
+	if err != nil {
+		t.Fatalf("New err: %s", err)
+	}
+	cases := []struct {
+		db    string
+		query string
+		nodes []string
+	}{
+		{"db1", "CALL report(1)", []string{"n1"}},
+		{"db1", "CALL archive()", []string{"n2"}},
+		{"db1", "CALL /*+ NODE(n1) */ archive()", []string{"n1"}},
+		{"", "CALL db1.archive", []string{"n2"}},
+		{"", "CALL /*+ NODE('n2') */ p()", []string{"n2"}},
+		{"", "CALL p()", []string{"n0"}},
+	}
+	for _, c := range cases {
+		plan, err := r.Route(c.db, c.query)
+		if err != nil {
+			t.Fatalf("Route %q err: %s", c.query, err)
+		}
+		if !reflect.DeepEqual(plan.Nodes, c.nodes) {
+			t.Fatalf("bad result of %q: %v, expected: %v", c.query, plan.Nodes, c.nodes)
+		}
+	}
+	if _, err := r.Route("db1", "CALL /*+ NODE(n0) */ p()"); err == nil {
+		t.Fatalf("expected an error for the node out of the schema")
+	}
+	schemas[0].Procedures = map[string]string{"p": "n0"}
+	if _, err := New(nodes, schemas); err == nil {
+		t.Fatalf("expected an error for the procedure out of the schema")
+	}
+}
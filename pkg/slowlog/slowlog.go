@@ -0,0 +1,77 @@
+package slowlog
+
+// The entries are written in the mysql slow query log format, so the usual
+// tools (mysqldumpslow, pt-query-digest) can aggregate them, the proxy
+// specific attributes are added as extra `# Key: value` lines:
+//
+//   # Time: 2018-08-01T10:00:00.123456Z
+//   # User@Host: root[root] @ 127.0.0.1:52718  Id: 10001
+//   # Schema: db1  Shards: node1.t_0001,node2.t_0002
+//   # Query_time: 1.203411  Backend_time: 1.200125  Proxy_time: 0.003286  Rows_sent: 12
+//   # Fingerprint: select * from t where id in (?+)
+//   select * from t where id in (1, 2, 3);
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Fleurer/hardshard/pkg/rotatefile"
+)
+
+type Entry struct {
+	Time         time.Time
+	ConnectionId uint32
+	User         string
+	Client       string
+	DB           string
+	Shards       []string
+	QueryTime    time.Duration
+	BackendTime  time.Duration
+	RowsSent     uint64
+	Query        string
+	Fingerprint  string
+}
+
+type Logger struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+func New(w io.WriteCloser) *Logger {
+	return &Logger{w: w}
+}
+
+func Open(path string, maxSize int64, maxBackups int) (*Logger, error) {
+	w, err := rotatefile.New(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return New(w), nil
+}
+
+func (l *Logger) Log(e *Entry) error {
+	buf := bytes.NewBuffer(make([]byte, 0, 256+len(e.Query)))
+	fmt.Fprintf(buf, "# Time: %s\n", e.Time.UTC().Format("2006-01-02T15:04:05.000000Z"))
+	fmt.Fprintf(buf, "# User@Host: %s[%s] @ %s  Id: %d\n", e.User, e.User, e.Client, e.ConnectionId)
+	fmt.Fprintf(buf, "# Schema: %s  Shards: %s\n", e.DB, strings.Join(e.Shards, ","))
+	fmt.Fprintf(buf, "# Query_time: %.6f  Backend_time: %.6f  Proxy_time: %.6f  Rows_sent: %d\n",
+		e.QueryTime.Seconds(), e.BackendTime.Seconds(), (e.QueryTime - e.BackendTime).Seconds(), e.RowsSent)
+	fmt.Fprintf(buf, "# Fingerprint: %s\n", e.Fingerprint)
+	buf.WriteString(strings.TrimRight(e.Query, "; \t\r\n"))
+	buf.WriteString(";\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(buf.Bytes())
+	return err
+}
+
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
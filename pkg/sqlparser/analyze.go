@@ -0,0 +1,210 @@
+package sqlparser
+
+import (
+	"strings"
+)
+
+type TableName struct {
+	// Schema is empty if the table is not qualified
+	Schema string
+	Name   string
+}
+
+// Info is a shallow analysis of a statement, enough for the rules that
+// look at the shape of a query without understanding its expressions.
+type Info struct {
+	Type   StmtType
+	Tables []TableName
+	// HasWhere and HasLimit only look at the outermost query
+	HasWhere bool
+	HasLimit bool
+	// Merge is the first clause of the outermost query that needs the rows
+	// of all the shards at once, like COUNT or ORDER BY, empty if none
+	Merge string
+}
+
+// mergeKeywords shape the result out of all the rows of the query.
+var mergeKeywords = map[string]string{
+	"distinct": "DISTINCT", "distinctrow": "DISTINCT", "group": "GROUP BY", "having": "HAVING",
+	"order": "ORDER BY", "limit": "LIMIT",
+}
+
+// aggregates are the aggregate functions, https://dev.mysql.com/doc/refman/8.0/en/aggregate-functions.html
+var aggregates = map[string]bool{
+	"avg": true, "bit_and": true, "bit_or": true, "bit_xor": true, "count": true, "group_concat": true,
+	"json_arrayagg": true, "json_objectagg": true, "max": true, "min": true, "std": true, "stddev": true,
+	"stddev_pop": true, "stddev_samp": true, "sum": true, "var_pop": true, "var_samp": true, "variance": true,
+}
+
+// tableKeywords are followed by a table reference.
+var tableKeywords = map[string]bool{
+	"from":     true,
+	"join":     true,
+	"into":     true,
+	"update":   true,
+	"table":    true,
+	"truncate": true,
+}
+
+func Analyze(sql string) *Info {
+	info := &Info{Type: Preview(sql)}
+	tokens := StripComments(Tokenize(sql))
+	depth := 0
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.IsPunct("("):
+			depth++
+		case t.IsPunct(")"):
+			depth--
+		case t.Type != TOKEN_IDENT:
+		case depth == 0 && t.Is("where"):
+			info.HasWhere = true
+		case depth == 0 && t.Is("limit"):
+			info.HasLimit = true
+			if info.Merge == "" {
+				info.Merge = "LIMIT"
+			}
+		case depth == 0 && info.Merge == "" && mergeKeywords[strings.ToLower(t.Value)] != "":
+			info.Merge = mergeKeywords[strings.ToLower(t.Value)]
+		case depth == 0 && info.Merge == "" && aggregates[strings.ToLower(t.Value)] && i+1 < len(tokens) && tokens[i+1].IsPunct("("):
+			info.Merge = strings.ToUpper(t.Value)
+		case tableKeywords[strings.ToLower(t.Value)]:
+			i = readTableList(tokens, i+1, &info.Tables) - 1
+		}
+	}
+	return info
+}
+
+// readTableList reads `t1 [AS] a1, db.t2 a2, ...` and returns the index after it.
+func readTableList(tokens []Token, i int, tables *[]TableName) int {
+	return scanTableList(tokens, i, func(tn TableName, start int) {
+		*tables = append(*tables, tn)
+	})
+}
+
+// scanTableList calls visit with the names of a table list and the index
+// of their first token.
+func scanTableList(tokens []Token, i int, visit func(tn TableName, start int)) int {
+	for i < len(tokens) && tableModifiers[strings.ToLower(tokens[i].Value)] && tokens[i].Type == TOKEN_IDENT {
+		i++
+	}
+	for i < len(tokens) {
+		tn, n := readTableName(tokens, i)
+		if n == i {
+			return i
+		}
+		start := n - 1
+		if tn.Schema != "" {
+			start = n - 3
+		}
+		visit(tn, start)
+		i = n
+		// skip the alias
+		if i < len(tokens) && tokens[i].Is("as") {
+			i++
+		}
+		if i < len(tokens) && (tokens[i].Type == TOKEN_QUOTED_IDENT || (tokens[i].Type == TOKEN_IDENT && !isReserved(tokens[i].Value))) {
+			i++
+		}
+		if i < len(tokens) && tokens[i].IsPunct(",") {
+			i++
+			continue
+		}
+		return i
+	}
+	return i
+}
+
+func readTableName(tokens []Token, i int) (TableName, int) {
+	if i < len(tokens) && tokens[i].Is("table") {
+		i++
+	}
+	if i >= len(tokens) || !isName(tokens[i]) {
+		return TableName{}, i
+	}
+	tn := TableName{Name: tokens[i].Name()}
+	if i+2 < len(tokens) && tokens[i+1].IsPunct(".") && isName(tokens[i+2]) {
+		tn.Schema = tn.Name
+		tn.Name = tokens[i+2].Name()
+		return tn, i + 3
+	}
+	return tn, i + 1
+}
+
+func isName(t Token) bool {
+	return t.Type == TOKEN_QUOTED_IDENT || (t.Type == TOKEN_IDENT && !isReserved(t.Value))
+}
+
+// tableModifiers may stand between the keyword and the table names.
+var tableModifiers = map[string]bool{
+	"low_priority": true, "high_priority": true, "delayed": true, "quick": true, "ignore": true,
+	"if": true, "not": true, "exists": true,
+}
+
+// reserved words that may follow a table reference, they are never aliases.
+var reservedWords = map[string]bool{
+	"select": true, "where": true, "set": true, "values": true, "value": true, "on": true, "using": true,
+	"join": true, "inner": true, "left": true, "right": true, "cross": true, "natural": true, "straight_join": true,
+	"group": true, "order": true, "limit": true, "having": true, "union": true, "for": true, "lock": true,
+	"partition": true, "use": true, "ignore": true, "force": true, "into": true, "from": true, "window": true,
+	"duplicate": true, "as": true, "table": true, "procedure": true, "high_priority": true, "low_priority": true,
+	"delayed": true, "quick": true, "default": true, "if": true, "exists": true,
+}
+
+func isReserved(word string) bool {
+	return reservedWords[strings.ToLower(word)]
+}
+
+// schemaKeywords are followed by the table references of RenameSchemas.
+var schemaKeywords = map[string]bool{
+	"from": true, "join": true, "into": true, "update": true, "table": true, "truncate": true,
+	"tables": true, "describe": true, "desc": true, "call": true,
+}
+
+// RenameSchemas replaces the schema names qualifying the tables, rename
+// returns false for the names to keep. A name is a schema in schema.table
+// of a table reference and in schema.table.column, a table alias or a
+// column qualifier of the same name is kept. The rest of the text is
+// untouched.
+func RenameSchemas(sql string, rename func(string) (string, bool)) string {
+	tokens := StripComments(Tokenize(sql))
+	var schemas []Token
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.Type == TOKEN_IDENT && schemaKeywords[strings.ToLower(t.Value)]:
+			i = scanTableList(tokens, i+1, func(tn TableName, start int) {
+				if tn.Schema != "" {
+					schemas = append(schemas, tokens[start])
+				}
+			}) - 1
+		case isColumnName(tokens, i) && (i == 0 || !tokens[i-1].IsPunct(".")):
+			schemas = append(schemas, t)
+			i += 4
+		}
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, t := range schemas {
+		name, ok := rename(t.Name())
+		if !ok || name == t.Name() {
+			continue
+		}
+		b.WriteString(sql[last:t.Pos])
+		b.WriteString("`" + strings.Replace(name, "`", "``", -1) + "`")
+		last = t.End
+	}
+	if last == 0 {
+		return sql
+	}
+	b.WriteString(sql[last:])
+	return b.String()
+}
+
+// isColumnName matches schema.table.column or schema.table.* at i.
+func isColumnName(tokens []Token, i int) bool {
+	return i+4 < len(tokens) && isName(tokens[i]) && tokens[i+1].IsPunct(".") && isName(tokens[i+2]) &&
+		tokens[i+3].IsPunct(".") && (isName(tokens[i+4]) || tokens[i+4].IsPunct("*"))
+}
@@ -0,0 +1,15 @@
+package sqlparser
+
+// ParseCall returns the stored procedure of `CALL [db.]sp_name[([parameter[, ...]])]`.
+// https://dev.mysql.com/doc/refman/5.7/en/call.html
+func ParseCall(sql string) (TableName, error) {
+	tokens := StripComments(Tokenize(sql))
+	if len(tokens) == 0 || !tokens[0].Is("call") {
+		return TableName{}, ErrSyntax
+	}
+	proc, n := readTableName(tokens, 1)
+	if n == 1 {
+		return TableName{}, ErrSyntax
+	}
+	return proc, nil
+}
@@ -0,0 +1,115 @@
+package sqlparser
+
+import (
+	"strings"
+)
+
+// Fingerprint normalizes the statement so that queries differing only in
+// their literals aggregate together, roughly the same rules as pt-query-digest:
+//   - comments are stripped and whitespaces are collapsed
+//   - keywords and identifiers are lower cased
+//   - strings and numbers are replaced by ?
+//   - IN (?, ?, ?) becomes IN (?+), and multi-row VALUES keep only the first row
+func Fingerprint(sql string) string {
+	words := make([]string, 0, 16)
+	spaces := make([]bool, 0, 16)
+	for _, t := range StripComments(Tokenize(sql)) {
+		w := t.Value
+		switch t.Type {
+		case TOKEN_STRING, TOKEN_NUMBER, TOKEN_PLACEHOLDER:
+			w = "?"
+		case TOKEN_IDENT, TOKEN_VARIABLE:
+			w = strings.ToLower(w)
+		}
+		words = append(words, w)
+		spaces = append(spaces, t.Space)
+	}
+	if len(words) > 0 && words[len(words)-1] == ";" {
+		words = words[:len(words)-1]
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		if w == "(" {
+			// (?, ?, ?) -> (?+)
+			if end := placeholderList(words, i); end > 0 {
+				writeWord(&b, "(?+)", spaces[i])
+				i = end
+				continue
+			}
+		}
+		if w == "values" || w == "value" {
+			writeWord(&b, w, spaces[i])
+			i = collapseRows(&b, words, spaces, i+1) - 1
+			continue
+		}
+		writeWord(&b, w, spaces[i])
+	}
+	return b.String()
+}
+
+func writeWord(b *strings.Builder, w string, space bool) {
+	if space && b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+	b.WriteString(w)
+}
+
+// placeholderList returns the index of the closing paren if words[start:]
+// looks like (?, ?, ...) with at least two items, or 0 otherwise.
+func placeholderList(words []string, start int) int {
+	n := 0
+	for i := start + 1; i < len(words); i++ {
+		switch {
+		case words[i] == "?" && (i == start+1 || words[i-1] == ","):
+			n++
+		case words[i] == "," && words[i-1] == "?":
+		case words[i] == ")" && words[i-1] == "?" && n > 1:
+			return i
+		default:
+			return 0
+		}
+	}
+	return 0
+}
+
+// collapseRows writes the first row of a VALUES list and skips the others,
+// it returns the index of the first word after the rows.
+func collapseRows(b *strings.Builder, words []string, spaces []bool, i int) int {
+	first := true
+	for i < len(words) && words[i] == "(" {
+		depth := 0
+		j := i
+		for ; j < len(words); j++ {
+			if words[j] == "(" {
+				depth++
+			} else if words[j] == ")" {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+		if first {
+			for k := i; k <= j && k < len(words); k++ {
+				if k == i && words[k] == "(" {
+					if end := placeholderList(words, k); end > 0 {
+						writeWord(b, "(?+)", spaces[k])
+						k = end
+						continue
+					}
+				}
+				writeWord(b, words[k], spaces[k])
+			}
+			first = false
+		}
+		i = j + 1
+		if i < len(words) && words[i] == "," && i+1 < len(words) && words[i+1] == "(" {
+			i++
+			continue
+		}
+		break
+	}
+	return i
+}
@@ -0,0 +1,52 @@
+package sqlparser
+
+import (
+	"strings"
+)
+
+// Hint is an optimizer hint like `/*+ MAX_EXECUTION_TIME(1000) */`, the proxy
+// reads the hints it understands and leaves the rest to the backends.
+// https://dev.mysql.com/doc/refman/5.7/en/optimizer-hints.html
+type Hint struct {
+	// Name is lower cased
+	Name string
+	Args []string
+}
+
+// ParseHints returns the hints in all the `/*+ ... */` comments of the statement.
+func ParseHints(sql string) []Hint {
+	hints := []Hint{}
+	for _, t := range Tokenize(sql) {
+		if t.Type != TOKEN_COMMENT || !strings.HasPrefix(t.Value, "/*+") {
+			continue
+		}
+		body := strings.TrimSuffix(t.Value[3:], "*/")
+		s := NewScanner(body)
+		for !s.EOF() {
+			name := s.Next()
+			if name.Type != TOKEN_IDENT {
+				continue
+			}
+			h := Hint{Name: strings.ToLower(name.Value)}
+			if s.AcceptPunct("(") {
+				for !s.EOF() && !s.AcceptPunct(")") {
+					if arg := s.Next(); !arg.IsPunct(",") {
+						h.Args = append(h.Args, Unquote(arg.Value))
+					}
+				}
+			}
+			hints = append(hints, h)
+		}
+	}
+	return hints
+}
+
+// FindHint returns the first hint of the name.
+func FindHint(hints []Hint, name string) (Hint, bool) {
+	for _, h := range hints {
+		if h.Name == name {
+			return h, true
+		}
+	}
+	return Hint{}, false
+}
@@ -0,0 +1,28 @@
+package sqlparser
+
+import (
+	"strconv"
+)
+
+// ParseKill parses `KILL [CONNECTION | QUERY] processlist_id`, query is true
+// if only the statement of the connection is to be killed.
+// https://dev.mysql.com/doc/refman/5.7/en/kill.html
+func ParseKill(sql string) (id uint64, query bool, err error) {
+	s := NewScanner(sql)
+	if !s.Accept("kill") {
+		return 0, false, ErrSyntax
+	}
+	if s.Accept("query") {
+		query = true
+	} else {
+		s.Accept("connection")
+	}
+	t := s.Next()
+	if t.Type != TOKEN_NUMBER || !s.EOF() {
+		return 0, false, ErrSyntax
+	}
+	if id, err = strconv.ParseUint(t.Value, 10, 32); err != nil {
+		return 0, false, ErrSyntax
+	}
+	return id, query, nil
+}
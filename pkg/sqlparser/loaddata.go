@@ -0,0 +1,154 @@
+package sqlparser
+
+import (
+	"strconv"
+)
+
+// LoadData is a LOAD DATA statement, the options of the FIELDS and LINES
+// clauses are unquoted, and take the defaults of mysql if they are missing.
+type LoadData struct {
+	Local bool
+	File  string
+	Table TableName
+
+	FieldsTerminatedBy string
+	FieldsEnclosedBy   string
+	FieldsEscapedBy    string
+	LinesStartingBy    string
+	LinesTerminatedBy  string
+	IgnoreLines        int
+
+	// Columns is the column list, the user variables keep their @. It is
+	// empty if the file holds all the columns of the table in order.
+	Columns []string
+}
+
+// ParseLoadData parses `LOAD DATA [LOW_PRIORITY | CONCURRENT] [LOCAL] INFILE
+// 'file' [REPLACE | IGNORE] INTO TABLE tbl [PARTITION (...)] [CHARACTER SET
+// charset] [{FIELDS | COLUMNS} ...] [LINES ...] [IGNORE n {LINES | ROWS}]
+// [(col, ...)] [SET ...]`, the SET clause is not looked into.
+// https://dev.mysql.com/doc/refman/5.7/en/load-data.html
+func ParseLoadData(sql string) (*LoadData, error) {
+	s := NewScanner(sql)
+	if !s.Accept("load") || !s.Accept("data") {
+		return nil, ErrSyntax
+	}
+	ld := &LoadData{FieldsTerminatedBy: "\t", FieldsEscapedBy: "\\", LinesTerminatedBy: "\n"}
+	s.Accept("low_priority", "concurrent")
+	ld.Local = s.Accept("local")
+	if !s.Accept("infile") || s.Peek().Type != TOKEN_STRING {
+		return nil, ErrSyntax
+	}
+	ld.File = Unquote(s.Next().Value)
+	s.Accept("replace", "ignore")
+	if !s.Accept("into") || !s.Peek().Is("table") {
+		return nil, ErrSyntax
+	}
+	var n int
+	if ld.Table, n = readTableName(s.tokens, s.pos); n == s.pos+1 {
+		return nil, ErrSyntax
+	}
+	s.pos = n
+	if s.Accept("partition") {
+		if !skipParens(s) {
+			return nil, ErrSyntax
+		}
+	}
+	if s.Accept("character", "charset") {
+		s.Accept("set")
+		s.Next()
+	}
+	if s.Accept("fields", "columns") {
+		for {
+			var ok bool
+			switch {
+			case s.Accept("terminated"):
+				ok = readOption(s, &ld.FieldsTerminatedBy)
+			case s.Accept("optionally"):
+				ok = s.Accept("enclosed") && readOption(s, &ld.FieldsEnclosedBy)
+			case s.Accept("enclosed"):
+				ok = readOption(s, &ld.FieldsEnclosedBy)
+			case s.Accept("escaped"):
+				ok = readOption(s, &ld.FieldsEscapedBy)
+			default:
+				ok = false
+			}
+			if !ok {
+				break
+			}
+		}
+	}
+	if s.Accept("lines") {
+		for {
+			var ok bool
+			switch {
+			case s.Accept("starting"):
+				ok = readOption(s, &ld.LinesStartingBy)
+			case s.Accept("terminated"):
+				ok = readOption(s, &ld.LinesTerminatedBy)
+			}
+			if !ok {
+				break
+			}
+		}
+	}
+	if s.Accept("ignore") {
+		t := s.Next()
+		lines, err := strconv.Atoi(t.Value)
+		if t.Type != TOKEN_NUMBER || err != nil || !s.Accept("lines", "rows") {
+			return nil, ErrSyntax
+		}
+		ld.IgnoreLines = lines
+	}
+	if s.AcceptPunct("(") {
+		for {
+			t := s.Next()
+			switch t.Type {
+			case TOKEN_IDENT, TOKEN_QUOTED_IDENT:
+				ld.Columns = append(ld.Columns, t.Name())
+			case TOKEN_VARIABLE:
+				ld.Columns = append(ld.Columns, t.Value)
+			default:
+				return nil, ErrSyntax
+			}
+			if s.AcceptPunct(")") {
+				break
+			}
+			if !s.AcceptPunct(",") {
+				return nil, ErrSyntax
+			}
+		}
+	}
+	if !s.EOF() && !s.Peek().Is("set") {
+		return nil, ErrSyntax
+	}
+	return ld, nil
+}
+
+// readOption reads the `BY 'string'` of a FIELDS or LINES option.
+func readOption(s *Scanner, option *string) bool {
+	if !s.Accept("by") || s.Peek().Type != TOKEN_STRING {
+		return false
+	}
+	*option = Unquote(s.Next().Value)
+	return true
+}
+
+// skipParens skips a parenthesized list, the nested parens included.
+func skipParens(s *Scanner) bool {
+	if !s.AcceptPunct("(") {
+		return false
+	}
+	for depth := 1; depth > 0; {
+		if s.EOF() {
+			return false
+		}
+		t := s.Next()
+		if t.IsPunct("(") {
+			depth++
+		} else if t.IsPunct(")") {
+			depth--
+		}
+	}
+	return true
+}
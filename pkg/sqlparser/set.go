@@ -0,0 +1,151 @@
+package sqlparser
+
+import (
+	"strings"
+)
+
+const (
+	SCOPE_SESSION = "session"
+	SCOPE_GLOBAL  = "global"
+	SCOPE_USER    = "user"
+	// SCOPE_TRANSACTION is `SET TRANSACTION` without a scope, it only
+	// applies to the next transaction
+	SCOPE_TRANSACTION = "transaction"
+)
+
+// SetExpr is an assignment in a SET statement.
+type SetExpr struct {
+	Scope string
+	// Name is lower cased with the @@scope. prefix stripped
+	Name string
+	// Value is the raw text of the expression
+	Value string
+}
+
+// ParseSet parses `SET [GLOBAL|SESSION] var = expr [, var = expr] ...`,
+// `SET NAMES charset [COLLATE collation]` is the variable "names",
+// `SET {CHARACTER SET | CHARSET} charset` is the variable "charset", and
+// `SET [GLOBAL|SESSION] TRANSACTION characteristic, ...` is parsed into the
+// variables transaction_isolation and transaction_read_only.
+// https://dev.mysql.com/doc/refman/5.7/en/set-variable.html
+func ParseSet(sql string) ([]*SetExpr, error) {
+	s := NewScanner(sql)
+	if !s.Accept("set") {
+		return nil, ErrSyntax
+	}
+	exprs := []*SetExpr{}
+	for {
+		e := &SetExpr{Scope: SCOPE_SESSION}
+		scoped := true
+		if s.Accept("global", "persist") {
+			e.Scope = SCOPE_GLOBAL
+		} else {
+			scoped = s.Accept("session", "local")
+		}
+
+		t := s.Next()
+		switch t.Type {
+		case TOKEN_IDENT, TOKEN_QUOTED_IDENT:
+			e.Name = strings.ToLower(t.Name())
+		case TOKEN_VARIABLE:
+			e.Scope, e.Name = splitVariable(t.Value, e.Scope)
+		default:
+			return nil, ErrSyntax
+		}
+		switch {
+		case t.Is("transaction") && len(exprs) == 0:
+			if !scoped {
+				e.Scope = SCOPE_TRANSACTION
+			}
+			return parseTransaction(s, e.Scope)
+		case t.Is("names") && !s.Peek().IsPunct("="):
+			// the value goes on with the COLLATE clause
+		case (t.Is("character") && s.Accept("set")) || (t.Is("charset") && !s.Peek().IsPunct("=")):
+			e.Name = "charset"
+		case e.Name == "" || !s.AcceptPunct("=", ":="):
+			return nil, ErrSyntax
+		}
+		e.Value = s.Expr()
+		if e.Value == "" {
+			return nil, ErrSyntax
+		}
+		exprs = append(exprs, e)
+
+		if s.EOF() {
+			return exprs, nil
+		}
+		if !s.AcceptPunct(",") {
+			return nil, ErrSyntax
+		}
+	}
+}
+
+// parseTransaction parses the characteristics of SET TRANSACTION:
+//
+//	ISOLATION LEVEL {REPEATABLE READ | READ COMMITTED | READ UNCOMMITTED | SERIALIZABLE}
+//	| READ WRITE | READ ONLY
+//
+// https://dev.mysql.com/doc/refman/5.7/en/set-transaction.html
+func parseTransaction(s *Scanner, scope string) ([]*SetExpr, error) {
+	exprs := []*SetExpr{}
+	for {
+		switch {
+		case s.Accept("isolation"):
+			if !s.Accept("level") {
+				return nil, ErrSyntax
+			}
+			level := ""
+			switch {
+			case s.Accept("repeatable") && s.Accept("read"):
+				level = "REPEATABLE-READ"
+			case s.Accept("serializable"):
+				level = "SERIALIZABLE"
+			case s.Accept("read"):
+				if s.Accept("committed") {
+					level = "READ-COMMITTED"
+				} else if s.Accept("uncommitted") {
+					level = "READ-UNCOMMITTED"
+				}
+			}
+			if level == "" {
+				return nil, ErrSyntax
+			}
+			exprs = append(exprs, &SetExpr{Scope: scope, Name: "transaction_isolation", Value: "'" + level + "'"})
+		case s.Accept("read"):
+			value := ""
+			if s.Accept("only") {
+				value = "ON"
+			} else if s.Accept("write") {
+				value = "OFF"
+			} else {
+				return nil, ErrSyntax
+			}
+			exprs = append(exprs, &SetExpr{Scope: scope, Name: "transaction_read_only", Value: value})
+		default:
+			return nil, ErrSyntax
+		}
+		if s.EOF() {
+			return exprs, nil
+		}
+		if !s.AcceptPunct(",") {
+			return nil, ErrSyntax
+		}
+	}
+}
+
+// splitVariable splits @@session.name into its scope and lower cased name.
+func splitVariable(v string, scope string) (string, string) {
+	if !strings.HasPrefix(v, "@@") {
+		return SCOPE_USER, Unquote(v[1:])
+	}
+	name := strings.ToLower(v[2:])
+	switch {
+	case strings.HasPrefix(name, "global."):
+		return SCOPE_GLOBAL, name[len("global."):]
+	case strings.HasPrefix(name, "session."):
+		return SCOPE_SESSION, name[len("session."):]
+	case strings.HasPrefix(name, "local."):
+		return SCOPE_SESSION, name[len("local."):]
+	}
+	return scope, name
+}
@@ -0,0 +1,175 @@
+package sqlparser
+
+import (
+	"strings"
+)
+
+// KeyValues returns the values the statement pins the column to, from the
+// rows of INSERT / REPLACE, or from the `col = v` and `col IN (v, ...)`
+// conditions at the top level of WHERE. ok is false if the column may take
+// any value, e.g. it is missing, compared with an expression, or the WHERE
+// has a top-level OR.
+func KeyValues(sql string, column string) (values []string, ok bool) {
+	tokens := StripComments(Tokenize(sql))
+	switch Preview(sql) {
+	case STMT_INSERT, STMT_REPLACE:
+		return insertKeyValues(tokens, column)
+	case STMT_SELECT, STMT_UPDATE, STMT_DELETE:
+		return whereKeyValues(tokens, column)
+	}
+	return nil, false
+}
+
+func insertKeyValues(tokens []Token, column string) ([]string, bool) {
+	i := 0
+	for i < len(tokens) && !tokens[i].IsPunct("(") {
+		if tokens[i].Is("values") || tokens[i].Is("value") || tokens[i].Is("select") || tokens[i].Is("set") {
+			// without a column list the position of the key is unknown
+			return nil, false
+		}
+		i++
+	}
+	// the column list
+	index, n := -1, 0
+	for i++; i < len(tokens) && !tokens[i].IsPunct(")"); i++ {
+		if tokens[i].IsPunct(",") {
+			n++
+		} else if isName(tokens[i]) && strings.EqualFold(tokens[i].Name(), column) {
+			index = n
+		}
+	}
+	if index < 0 || i+1 >= len(tokens) || !(tokens[i+1].Is("values") || tokens[i+1].Is("value")) {
+		return nil, false
+	}
+	values := []string{}
+	for i += 2; i < len(tokens) && tokens[i].IsPunct("("); {
+		row, next := readRow(tokens, i)
+		if index >= len(row) || !isLiteral(row[index]) {
+			return nil, false
+		}
+		values = append(values, Unquote(row[index].Value))
+		i = next
+		if i < len(tokens) && tokens[i].IsPunct(",") {
+			i++
+		}
+	}
+	return values, len(values) > 0
+}
+
+// readRow reads `(v1, v2, ...)` at i, a value of several tokens is returned
+// as a TOKEN_PUNCT so it never passes for a literal.
+func readRow(tokens []Token, i int) ([]Token, int) {
+	row := []Token{}
+	depth, start := 0, i+1
+	for ; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.IsPunct("("):
+			depth++
+		case t.IsPunct(")") || (depth == 1 && t.IsPunct(",")):
+			if depth == 1 {
+				if i-start == 1 {
+					row = append(row, tokens[start])
+				} else {
+					row = append(row, Token{Type: TOKEN_PUNCT})
+				}
+				start = i + 1
+			}
+			if t.IsPunct(")") {
+				depth--
+				if depth == 0 {
+					return row, i + 1
+				}
+			}
+		}
+	}
+	return row, i
+}
+
+func whereKeyValues(tokens []Token, column string) ([]string, bool) {
+	depth := 0
+	i := 0
+	for ; i < len(tokens); i++ {
+		if tokens[i].IsPunct("(") {
+			depth++
+		} else if tokens[i].IsPunct(")") {
+			depth--
+		} else if depth == 0 && tokens[i].Is("where") {
+			break
+		}
+	}
+	var values []string
+	found := false
+	for i++; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.IsPunct("("):
+			depth++
+			continue
+		case t.IsPunct(")"):
+			depth--
+			continue
+		case depth != 0:
+			continue
+		case t.Is("or") || t.IsPunct("||"):
+			return nil, false
+		case t.Is("group") || t.Is("order") || t.Is("limit") || t.Is("for") || t.Is("lock"):
+			return values, found
+		}
+		if found || !isColumn(tokens, i, column) {
+			continue
+		}
+		// the column is at i, maybe qualified as t.col starting at j
+		j := i
+		if j >= 2 && tokens[j-1].IsPunct(".") {
+			j -= 2
+		}
+		switch {
+		case isCondStart(tokens, j) && i+2 < len(tokens) && tokens[i+1].IsPunct("=") && isLiteral(tokens[i+2]) && isCondEnd(tokens, i+3):
+			values, found = []string{Unquote(tokens[i+2].Value)}, true
+		case isCondStart(tokens, j) && i+2 < len(tokens) && tokens[i+1].Is("in") && tokens[i+2].IsPunct("("):
+			row, next := readRow(tokens, i+2)
+			found = len(row) > 0 && isCondEnd(tokens, next)
+			for _, v := range row {
+				if !isLiteral(v) {
+					found = false
+					break
+				}
+				values = append(values, Unquote(v.Value))
+			}
+			if !found {
+				values = nil
+			}
+		case j >= 2 && tokens[j-1].IsPunct("=") && isLiteral(tokens[j-2]) && isCondStart(tokens, j-2) && isCondEnd(tokens, i+1):
+			values, found = []string{Unquote(tokens[j-2].Value)}, true
+		}
+	}
+	return values, found
+}
+
+// isCondStart reports whether a condition of the top-level AND starts at i.
+func isCondStart(tokens []Token, i int) bool {
+	p := tokens[i-1]
+	return p.Is("where") || p.Is("and") || p.IsPunct("&&")
+}
+
+// isCondEnd reports whether a condition of the top-level AND ends before i.
+func isCondEnd(tokens []Token, i int) bool {
+	if i >= len(tokens) {
+		return true
+	}
+	t := tokens[i]
+	return t.Is("and") || t.IsPunct("&&") || t.IsPunct(";") || t.Is("group") || t.Is("order") || t.Is("limit") || t.Is("for") || t.Is("lock")
+}
+
+func isColumn(tokens []Token, i int, column string) bool {
+	if !isName(tokens[i]) || !strings.EqualFold(tokens[i].Name(), column) {
+		return false
+	}
+	// t.col is fine, but col.x is not the column
+	return i+1 >= len(tokens) || !tokens[i+1].IsPunct(".")
+}
+
+func isLiteral(t Token) bool {
+	return t.Type == TOKEN_STRING || t.Type == TOKEN_NUMBER
+}
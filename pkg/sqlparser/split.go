@@ -0,0 +1,72 @@
+package sqlparser
+
+import (
+	"strings"
+)
+
+// Split splits a multi-statement query on the semicolons outside of the
+// quotes and the comments, the empty statements are dropped. The body of
+// CREATE PROCEDURE and the like is kept whole, its BEGIN ... END blocks may
+// hold semicolons.
+// https://dev.mysql.com/doc/refman/5.7/en/c-api-multiple-queries.html
+func Split(sql string) []string {
+	tokens := Tokenize(sql)
+	stmts := make([]string, 0, 2)
+	// the current statement starts at start, first is its leading keyword
+	// and empty is true until a token other than the comments
+	start := 0
+	first := ""
+	empty := true
+	depth := 0
+	var prev Token
+	for i, t := range tokens {
+		if t.Type == TOKEN_COMMENT {
+			continue
+		}
+		after := prev
+		prev = t
+		if t.IsPunct(";") && depth == 0 {
+			if !empty {
+				stmts = append(stmts, strings.TrimSpace(sql[start:t.Pos]))
+			}
+			start, first, empty = t.End, "", true
+			continue
+		}
+		empty = false
+		if first == "" && t.Type == TOKEN_IDENT {
+			first = strings.ToLower(t.Value)
+		}
+		if first != "create" || t.Type != TOKEN_IDENT {
+			continue
+		}
+		// END IF, END LOOP and the like close their own blocks, while
+		// CASE ... END and CASE ... END CASE close a CASE
+		switch {
+		case t.Is("begin") || (t.Is("case") && !after.Is("end")):
+			depth++
+		case t.Is("end") && depth > 0 && !nextIs(tokens, i, "if", "loop", "while", "repeat"):
+			depth--
+		}
+	}
+	if !empty {
+		stmts = append(stmts, strings.TrimSpace(sql[start:]))
+	}
+	return stmts
+}
+
+// nextIs reports whether the token after tokens[i] is one of the keywords,
+// the comments are skipped.
+func nextIs(tokens []Token, i int, keywords ...string) bool {
+	for _, t := range tokens[i+1:] {
+		if t.Type == TOKEN_COMMENT {
+			continue
+		}
+		for _, k := range keywords {
+			if t.Is(k) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
@@ -0,0 +1,285 @@
+package sqlparser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens := Tokenize("SELECT `a``b`, 'it''s', @@session.x, .5, t.id -- c\n/* d */?")
+	expected := []TokenType{
+		TOKEN_IDENT, TOKEN_QUOTED_IDENT, TOKEN_PUNCT, TOKEN_STRING, TOKEN_PUNCT, TOKEN_VARIABLE, TOKEN_PUNCT,
+		TOKEN_NUMBER, TOKEN_PUNCT, TOKEN_IDENT, TOKEN_PUNCT, TOKEN_IDENT, TOKEN_COMMENT, TOKEN_COMMENT, TOKEN_PLACEHOLDER,
+	}
+	types := []TokenType{}
+	for _, tk := range tokens {
+		types = append(types, tk.Type)
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("bad token types: %v, expected: %v", types, expected)
+	}
+	if tokens[1].Name() != "a`b" {
+		t.Fatalf("bad quoted ident: %s", tokens[1].Name())
+	}
+	if Unquote(tokens[3].Value) != "it's" {
+		t.Fatalf("bad string: %s", Unquote(tokens[3].Value))
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM t WHERE id = 1":                       "select * from t where id = ?",
+		"select  *\n from t /* hint */ where name='abc' ;":   "select * from t where name=?",
+		"SELECT a FROM t WHERE id IN (1, 2, 3) AND b IN (4)": "select a from t where id in (?+) and b in (?)",
+		"INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y')":     "insert into t (a, b) values (?+)",
+		"insert into t values(1,now()),(2,now()) on dup":     "insert into t values(?,now()) on dup",
+		"UPDATE t SET a = -1.5e3, b = 0xff WHERE `Id` = 3.0": "update t set a = -?, b = ? where `Id` = ?",
+	}
+	for sql, expected := range cases {
+		if fp := Fingerprint(sql); fp != expected {
+			t.Fatalf("bad fingerprint for %q: %q, expected: %q", sql, fp, expected)
+		}
+	}
+}
+
+func TestPreview(t *testing.T) {
+	cases := map[string]StmtType{
+		"/* x */ SELECT 1":    STMT_SELECT,
+		"(select 1) union 2":  STMT_SELECT,
+		"start transaction":   STMT_BEGIN,
+		"Insert into t":       STMT_INSERT,
+		"set autocommit = 1":  STMT_SET,
+		"explain select 1":    STMT_OTHER,
+		"":                    STMT_OTHER,
+		"delete from t where": STMT_DELETE,
+		"TRUNCATE TABLE t":    STMT_DDL,
+		"CALL p(1)":           STMT_CALL,
+	}
+	for sql, expected := range cases {
+		if typ := Preview(sql); typ != expected {
+			t.Fatalf("bad type for %q: %s, expected: %s", sql, typ, expected)
+		}
+	}
+}
+
+func TestParseSet(t *testing.T) {
+	exprs, err := ParseSet("SET SESSION long_query_time = 0.5, @@global.sql_mode='', @a := (1, 2), @@Autocommit=ON;")
+	if err != nil {
+		t.Fatalf("ParseSet err: %s", err)
+	}
+	expected := []*SetExpr{
+		{Scope: SCOPE_SESSION, Name: "long_query_time", Value: "0.5"},
+		{Scope: SCOPE_GLOBAL, Name: "sql_mode", Value: "''"},
+		{Scope: SCOPE_USER, Name: "a", Value: "(1, 2)"},
+		{Scope: SCOPE_SESSION, Name: "autocommit", Value: "ON"},
+	}
+	if !reflect.DeepEqual(exprs, expected) {
+		t.Fatalf("bad result: %+v, expected: %+v", exprs, expected)
+	}
+
+	if _, err := ParseSet("SET x"); err != ErrSyntax {
+		t.Fatalf("expected ErrSyntax, got: %v", err)
+	}
+
+	exprs, err = ParseSet("SET NAMES utf8mb4 COLLATE utf8mb4_bin, time_zone = '+08:00'")
+	if err != nil {
+		t.Fatalf("ParseSet err: %s", err)
+	}
+	expected = []*SetExpr{
+		{Scope: SCOPE_SESSION, Name: "names", Value: "utf8mb4 COLLATE utf8mb4_bin"},
+		{Scope: SCOPE_SESSION, Name: "time_zone", Value: "'+08:00'"},
+	}
+	if !reflect.DeepEqual(exprs, expected) {
+		t.Fatalf("bad result: %+v, expected: %+v", exprs, expected)
+	}
+
+	exprs, err = ParseSet("SET TRANSACTION ISOLATION LEVEL READ COMMITTED, READ ONLY")
+	if err != nil {
+		t.Fatalf("ParseSet err: %s", err)
+	}
+	expected = []*SetExpr{
+		{Scope: SCOPE_TRANSACTION, Name: "transaction_isolation", Value: "'READ-COMMITTED'"},
+		{Scope: SCOPE_TRANSACTION, Name: "transaction_read_only", Value: "ON"},
+	}
+	if !reflect.DeepEqual(exprs, expected) {
+		t.Fatalf("bad result: %+v, expected: %+v", exprs, expected)
+	}
+	exprs, err = ParseSet("SET CHARACTER SET 'gbk', CHARSET DEFAULT")
+	if err != nil || len(exprs) != 2 || exprs[0].Name != "charset" || exprs[0].Value != "'gbk'" || exprs[1].Name != "charset" || exprs[1].Value != "DEFAULT" {
+		t.Fatalf("bad result: %+v, err: %v", exprs, err)
+	}
+	exprs, err = ParseSet("set session transaction isolation level serializable")
+	if err != nil || len(exprs) != 1 || exprs[0].Scope != SCOPE_SESSION || exprs[0].Value != "'SERIALIZABLE'" {
+		t.Fatalf("bad result: %+v, err: %v", exprs, err)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	info := Analyze("SELECT a FROM db1.t1 AS x JOIN `t2` y ON x.id = y.id WHERE x.id IN (SELECT id FROM t3 LIMIT 1)")
+	expected := []TableName{{Schema: "db1", Name: "t1"}, {Name: "t2"}, {Name: "t3"}}
+	if !reflect.DeepEqual(info.Tables, expected) {
+		t.Fatalf("bad tables: %v, expected: %v", info.Tables, expected)
+	}
+	if !info.HasWhere || info.HasLimit {
+		t.Fatalf("bad where/limit: %+v", info)
+	}
+
+	info = Analyze("delete low_priority from t1, t2")
+	if info.Type != STMT_DELETE || info.HasWhere || len(info.Tables) != 2 {
+		t.Fatalf("bad info: %+v", info)
+	}
+	info = Analyze("DROP TABLE IF EXISTS t1")
+	if len(info.Tables) != 1 || info.Tables[0].Name != "t1" {
+		t.Fatalf("bad info: %+v", info)
+	}
+
+	merges := []struct {
+		sql   string
+		merge string
+	}{
+		{"SELECT * FROM t WHERE id IN (SELECT max(id) FROM t2 GROUP BY a)", ""},
+		{"SELECT count(*) FROM t", "COUNT"},
+		{"SELECT a, Sum (b) FROM t", "SUM"},
+		{"SELECT sum FROM t", ""},
+		{"SELECT DISTINCT a FROM t", "DISTINCT"},
+		{"SELECT a FROM t GROUP BY a", "GROUP BY"},
+		{"SELECT a FROM t ORDER BY a LIMIT 1", "ORDER BY"},
+		{"SELECT a FROM t LIMIT 10", "LIMIT"},
+	}
+	for _, c := range merges {
+		if info := Analyze(c.sql); info.Merge != c.merge {
+			t.Fatalf("%s: bad merge: %q, expected: %q", c.sql, info.Merge, c.merge)
+		}
+	}
+}
+
+func TestKeyValues(t *testing.T) {
+	cases := []struct {
+		sql    string
+		values []string
+		ok     bool
+	}{
+		{"SELECT * FROM orders WHERE user_id = 10 AND status = 'x'", []string{"10"}, true},
+		{"select * from orders o where 'a' = o.user_id limit 1", []string{"a"}, true},
+		{"DELETE FROM orders WHERE user_id IN (1, 2, '3')", []string{"1", "2", "3"}, true},
+		{"UPDATE orders SET a = 1 WHERE user_id = 1 OR id = 2", nil, false},
+		{"SELECT * FROM orders WHERE (user_id = 1 OR id = 2)", nil, false},
+		{"SELECT * FROM orders WHERE user_id = id + 1", nil, false},
+		{"SELECT * FROM orders WHERE user_id = 1 + id", nil, false},
+		{"SELECT * FROM orders WHERE id - user_id = 1", nil, false},
+		{"INSERT INTO orders (id, user_id) VALUES (1, 100), (2, 'u1')", []string{"100", "u1"}, true},
+		{"INSERT INTO orders (id, user_id) VALUES (1, 100 + 1)", nil, false},
+		{"INSERT INTO orders VALUES (1, 100)", nil, false},
+	}
+	for _, c := range cases {
+		values, ok := KeyValues(c.sql, "user_id")
+		if ok != c.ok || !reflect.DeepEqual(values, c.values) {
+			t.Fatalf("bad result of %q: %v %v, expected: %v %v", c.sql, values, ok, c.values, c.ok)
+		}
+	}
+}
+
+func TestParseHints(t *testing.T) {
+	hints := ParseHints("SELECT /*+ MAX_EXECUTION_TIME(1000) NODE('node1') */ * FROM t /* not a hint */")
+	expected := []Hint{{Name: "max_execution_time", Args: []string{"1000"}}, {Name: "node", Args: []string{"node1"}}}
+	if !reflect.DeepEqual(hints, expected) {
+		t.Fatalf("bad result: %v, expected: %v", hints, expected)
+	}
+}
+
+func TestParseKill(t *testing.T) {
+	cases := []struct {
+		sql   string
+		id    uint64
+		query bool
+	}{
+		{"KILL 10001", 10001, false},
+		{"kill connection 10001;", 10001, false},
+		{"KILL /* x */ QUERY 42", 42, true},
+	}
+	for _, c := range cases {
+		id, query, err := ParseKill(c.sql)
+		if err != nil || id != c.id || query != c.query {
+			t.Fatalf("bad result of %q: %d %v %v, expected: %d %v", c.sql, id, query, err, c.id, c.query)
+		}
+	}
+	for _, sql := range []string{"KILL", "KILL QUERY x", "KILL 1 2", "KILL -1"} {
+		if _, _, err := ParseKill(sql); err != ErrSyntax {
+			t.Fatalf("expected ErrSyntax of %q, got: %v", sql, err)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		sql      string
+		expected []string
+	}{
+		{"SELECT 1", []string{"SELECT 1"}},
+		{"SELECT 1;", []string{"SELECT 1"}},
+		{"SELECT 1; SELECT 2 ;\n", []string{"SELECT 1", "SELECT 2"}},
+		{"SELECT ';'; SELECT `a;b` FROM t -- x;y\n; SELECT \"\\\";\"", []string{"SELECT ';'", "SELECT `a;b` FROM t -- x;y", "SELECT \"\\\";\""}},
+		{"SELECT 1 /* ; */;; -- done", []string{"SELECT 1 /* ; */"}},
+		{"BEGIN; UPDATE t SET a = 1; COMMIT", []string{"BEGIN", "UPDATE t SET a = 1", "COMMIT"}},
+		{
+			"CREATE PROCEDURE p() BEGIN IF 1 THEN SELECT 1; END IF; CASE WHEN 1 THEN SELECT 2; END CASE; END; CALL p()",
+			[]string{"CREATE PROCEDURE p() BEGIN IF 1 THEN SELECT 1; END IF; CASE WHEN 1 THEN SELECT 2; END CASE; END", "CALL p()"},
+		},
+	}
+	for _, c := range cases {
+		stmts := Split(c.sql)
+		if !reflect.DeepEqual(stmts, c.expected) {
+			t.Fatalf("bad result of %q: %q, expected: %q", c.sql, stmts, c.expected)
+		}
+	}
+}
+
+func TestParseCall(t *testing.T) {
+	cases := map[string]TableName{
+		"CALL p":                        {Name: "p"},
+		"call /*+ NODE(n1) */ P(1, @x)": {Name: "P"},
+		"CALL `db1`.p();":               {Schema: "db1", Name: "p"},
+	}
+	for sql, expected := range cases {
+		proc, err := ParseCall(sql)
+		if err != nil || proc != expected {
+			t.Fatalf("bad result of %q: %v %v, expected: %v", sql, proc, err, expected)
+		}
+	}
+	for _, sql := range []string{"CALL", "SELECT p()"} {
+		if _, err := ParseCall(sql); err != ErrSyntax {
+			t.Fatalf("expected ErrSyntax of %q, got: %v", sql, err)
+		}
+	}
+}
+
+func TestParseLoadData(t *testing.T) {
+	sql := "LOAD DATA LOCAL INFILE '/tmp/o.csv' REPLACE INTO TABLE db1.`orders` CHARACTER SET utf8mb4 " +
+		"FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '\"' LINES STARTING BY '>' TERMINATED BY '\\r\\n' " +
+		"IGNORE 1 LINES (id, @skip, user_id) SET amount = 0"
+	expected := &LoadData{
+		Local:              true,
+		File:               "/tmp/o.csv",
+		Table:              TableName{Schema: "db1", Name: "orders"},
+		FieldsTerminatedBy: ",",
+		FieldsEnclosedBy:   "\"",
+		FieldsEscapedBy:    "\\",
+		LinesStartingBy:    ">",
+		LinesTerminatedBy:  "\r\n",
+		IgnoreLines:        1,
+		Columns:            []string{"id", "@skip", "user_id"},
+	}
+	ld, err := ParseLoadData(sql)
+	if err != nil || !reflect.DeepEqual(ld, expected) {
+		t.Fatalf("bad result: %+v %v, expected: %+v", ld, err, expected)
+	}
+	ld, err = ParseLoadData("load data infile 'x' into table t")
+	if err != nil || ld.Local || ld.Table.Name != "t" || ld.FieldsTerminatedBy != "\t" || ld.LinesTerminatedBy != "\n" {
+		t.Fatalf("bad result: %+v %v", ld, err)
+	}
+	for _, sql := range []string{"LOAD DATA LOCAL INFILE x INTO TABLE t", "LOAD DATA INFILE 'x' INTO t", "LOAD DATA INFILE 'x' INTO TABLE t (a b)"} {
+		if _, err := ParseLoadData(sql); err != ErrSyntax {
+			t.Fatalf("expected ErrSyntax of %q, got: %v", sql, err)
+		}
+	}
+}
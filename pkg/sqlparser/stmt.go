@@ -0,0 +1,203 @@
+package sqlparser
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrSyntax = errors.New("sqlparser: syntax not supported")
+
+type StmtType int
+
+const (
+	STMT_OTHER StmtType = iota
+	STMT_SELECT
+	STMT_INSERT
+	STMT_REPLACE
+	STMT_UPDATE
+	STMT_DELETE
+	STMT_SET
+	STMT_USE
+	STMT_SHOW
+	STMT_BEGIN
+	STMT_COMMIT
+	STMT_ROLLBACK
+	STMT_DDL
+	STMT_KILL
+	STMT_ADMIN
+	STMT_CALL
+	STMT_LOAD
+)
+
+var stmtTypeNames = map[StmtType]string{
+	STMT_OTHER:    "OTHER",
+	STMT_SELECT:   "SELECT",
+	STMT_INSERT:   "INSERT",
+	STMT_REPLACE:  "REPLACE",
+	STMT_UPDATE:   "UPDATE",
+	STMT_DELETE:   "DELETE",
+	STMT_SET:      "SET",
+	STMT_USE:      "USE",
+	STMT_SHOW:     "SHOW",
+	STMT_BEGIN:    "BEGIN",
+	STMT_COMMIT:   "COMMIT",
+	STMT_ROLLBACK: "ROLLBACK",
+	STMT_DDL:      "DDL",
+	STMT_KILL:     "KILL",
+	STMT_ADMIN:    "ADMIN",
+	STMT_CALL:     "CALL",
+	STMT_LOAD:     "LOAD",
+}
+
+func (t StmtType) String() string {
+	return stmtTypeNames[t]
+}
+
+// IsDML reports whether the statement modifies rows.
+func (t StmtType) IsDML() bool {
+	return t == STMT_INSERT || t == STMT_REPLACE || t == STMT_UPDATE || t == STMT_DELETE || t == STMT_LOAD
+}
+
+var stmtKeywords = map[string]StmtType{
+	"select":   STMT_SELECT,
+	"with":     STMT_SELECT,
+	"insert":   STMT_INSERT,
+	"replace":  STMT_REPLACE,
+	"update":   STMT_UPDATE,
+	"delete":   STMT_DELETE,
+	"set":      STMT_SET,
+	"use":      STMT_USE,
+	"show":     STMT_SHOW,
+	"begin":    STMT_BEGIN,
+	"commit":   STMT_COMMIT,
+	"rollback": STMT_ROLLBACK,
+	"create":   STMT_DDL,
+	"alter":    STMT_DDL,
+	"drop":     STMT_DDL,
+	"truncate": STMT_DDL,
+	"rename":   STMT_DDL,
+	"kill":     STMT_KILL,
+	"admin":    STMT_ADMIN,
+	"call":     STMT_CALL,
+	"load":     STMT_LOAD,
+}
+
+// Preview classifies the statement by its leading keyword.
+func Preview(sql string) StmtType {
+	first := FirstKeyword(sql)
+	if first == "start" {
+		s := NewScanner(sql)
+		s.Next()
+		if s.Accept("transaction") {
+			return STMT_BEGIN
+		}
+	}
+	if t, ok := stmtKeywords[first]; ok {
+		return t
+	}
+	return STMT_OTHER
+}
+
+// FirstKeyword returns the lower cased leading keyword of the statement.
+func FirstKeyword(sql string) string {
+	for _, t := range Tokenize(sql) {
+		if t.Type == TOKEN_IDENT {
+			return strings.ToLower(t.Value)
+		}
+		if t.Type != TOKEN_COMMENT && !t.IsPunct("(") {
+			return ""
+		}
+	}
+	return ""
+}
+
+// Scanner walks over the tokens of a statement with the comments skipped.
+type Scanner struct {
+	sql    string
+	tokens []Token
+	pos    int
+}
+
+func NewScanner(sql string) *Scanner {
+	return &Scanner{
+		sql:    sql,
+		tokens: StripComments(Tokenize(sql)),
+	}
+}
+
+func (s *Scanner) EOF() bool {
+	return s.pos >= len(s.tokens) || (s.pos == len(s.tokens)-1 && s.tokens[s.pos].IsPunct(";"))
+}
+
+func (s *Scanner) Peek() Token {
+	if s.EOF() {
+		return Token{Type: TOKEN_PUNCT, Pos: len(s.sql), End: len(s.sql)}
+	}
+	return s.tokens[s.pos]
+}
+
+func (s *Scanner) Next() Token {
+	t := s.Peek()
+	if !s.EOF() {
+		s.pos++
+	}
+	return t
+}
+
+// Accept consumes the next token if it is one of the keywords.
+func (s *Scanner) Accept(keywords ...string) bool {
+	t := s.Peek()
+	for _, k := range keywords {
+		if t.Is(k) {
+			s.pos++
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptPunct consumes the next token if it is one of the punctuations.
+func (s *Scanner) AcceptPunct(puncts ...string) bool {
+	t := s.Peek()
+	for _, p := range puncts {
+		if t.IsPunct(p) {
+			s.pos++
+			return true
+		}
+	}
+	return false
+}
+
+// Expr consumes the tokens until a top-level comma or the end of the statement,
+// and returns the raw text between them.
+func (s *Scanner) Expr() string {
+	start := s.Peek().Pos
+	end := start
+	depth := 0
+	for !s.EOF() {
+		t := s.Peek()
+		if depth == 0 && t.IsPunct(",") {
+			break
+		}
+		if t.IsPunct("(") {
+			depth++
+		} else if t.IsPunct(")") {
+			depth--
+		}
+		end = t.End
+		s.pos++
+	}
+	return s.sql[start:end]
+}
+
+// Rest returns the remaining text of the statement.
+func (s *Scanner) Rest() string {
+	if s.EOF() {
+		return ""
+	}
+	end := s.tokens[len(s.tokens)-1].End
+	if s.tokens[len(s.tokens)-1].IsPunct(";") {
+		end = s.tokens[len(s.tokens)-1].Pos
+	}
+	return strings.TrimSpace(s.sql[s.Peek().Pos:end])
+}
@@ -0,0 +1,264 @@
+package sqlparser
+
+// A small SQL tokenizer, it does not build an AST, but it is good enough to
+// classify statements, fingerprint them and pick out the few clauses the
+// proxy cares about.
+// Lexical structure: https://dev.mysql.com/doc/refman/5.7/en/lexical-structure.html
+
+import (
+	"strings"
+)
+
+type TokenType int
+
+const (
+	TOKEN_IDENT        TokenType = iota // keywords and bare identifiers
+	TOKEN_QUOTED_IDENT                  // `identifier`
+	TOKEN_STRING                        // 'string', "string", x'0a', b'01'
+	TOKEN_NUMBER                        // 1, 1.5, 1e10, 0xff
+	TOKEN_VARIABLE                      // @user_var, @@system_var
+	TOKEN_PLACEHOLDER                   // ?
+	TOKEN_COMMENT                       // -- comment, # comment, /* comment */
+	TOKEN_PUNCT                         // operators and punctuations
+)
+
+type Token struct {
+	Type  TokenType
+	Value string
+	// Pos and End are the byte offsets of the token in the sql text
+	Pos int
+	End int
+	// Space is true if the token is preceded by whitespace or comments
+	Space bool
+}
+
+// Is reports whether the token is the given keyword, case insensitive.
+func (t Token) Is(keyword string) bool {
+	return t.Type == TOKEN_IDENT && strings.EqualFold(t.Value, keyword)
+}
+
+// IsPunct reports whether the token is the given operator or punctuation.
+func (t Token) IsPunct(p string) bool {
+	return t.Type == TOKEN_PUNCT && t.Value == p
+}
+
+// Name returns the identifier with the backquotes stripped.
+func (t Token) Name() string {
+	if t.Type == TOKEN_QUOTED_IDENT {
+		return strings.Replace(t.Value[1:len(t.Value)-1], "``", "`", -1)
+	}
+	return t.Value
+}
+
+var multiCharPuncts = []string{"<=>", "->>", "<=", ">=", "<>", "!=", ":=", "||", "&&", "<<", ">>", "->"}
+
+// Tokenize splits the sql into tokens, comments are kept as TOKEN_COMMENT.
+// It never fails, an unterminated quote simply runs to the end of the text.
+func Tokenize(sql string) []Token {
+	tokens := make([]Token, 0, 16)
+	space := false
+	i := 0
+	for i < len(sql) {
+		c := sql[i]
+		if isSpace(c) {
+			space = true
+			i++
+			continue
+		}
+
+		start := i
+		typ := TOKEN_PUNCT
+		switch {
+		case c == '#' || (c == '-' && strings.HasPrefix(sql[i:], "--") && (i+2 == len(sql) || isSpace(sql[i+2]))):
+			typ = TOKEN_COMMENT
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			typ = TOKEN_COMMENT
+			if end := strings.Index(sql[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(sql)
+			}
+		case c == '\'' || c == '"':
+			typ = TOKEN_STRING
+			i = scanQuoted(sql, i)
+		case c == '`':
+			typ = TOKEN_QUOTED_IDENT
+			i = scanQuoted(sql, i)
+		case (c == 'x' || c == 'X' || c == 'b' || c == 'B') && i+1 < len(sql) && sql[i+1] == '\'':
+			typ = TOKEN_STRING
+			i = scanQuoted(sql, i+1)
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1]) && !afterName(tokens, space)):
+			typ = TOKEN_NUMBER
+			i = scanNumber(sql, i)
+		case c == '@':
+			typ = TOKEN_VARIABLE
+			i++
+			if i < len(sql) && sql[i] == '@' {
+				i++
+			}
+			if i < len(sql) && (sql[i] == '\'' || sql[i] == '"' || sql[i] == '`') {
+				i = scanQuoted(sql, i)
+			}
+			for i < len(sql) && (isIdentChar(sql[i]) || sql[i] == '.') {
+				i++
+			}
+		case c == '?':
+			typ = TOKEN_PLACEHOLDER
+			i++
+		case isIdentChar(c):
+			typ = TOKEN_IDENT
+			for i < len(sql) && isIdentChar(sql[i]) {
+				i++
+			}
+		default:
+			i++
+			for _, p := range multiCharPuncts {
+				if strings.HasPrefix(sql[start:], p) {
+					i = start + len(p)
+					break
+				}
+			}
+		}
+
+		if typ == TOKEN_COMMENT {
+			space = true
+		}
+		tokens = append(tokens, Token{Type: typ, Value: sql[start:i], Pos: start, End: i, Space: space})
+		if typ != TOKEN_COMMENT {
+			space = false
+		}
+	}
+	return tokens
+}
+
+// StripComments drops the comment tokens.
+func StripComments(tokens []Token) []Token {
+	r := make([]Token, 0, len(tokens))
+	for _, t := range tokens {
+		if t.Type != TOKEN_COMMENT {
+			r = append(r, t)
+		}
+	}
+	return r
+}
+
+// Unquote returns the content of a string literal, other tokens are returned as is.
+func Unquote(v string) string {
+	if len(v) < 2 {
+		return v
+	}
+	q := v[0]
+	if (q != '\'' && q != '"' && q != '`') || v[len(v)-1] != q {
+		return v
+	}
+	v = v[1 : len(v)-1]
+	if q == '`' {
+		return strings.Replace(v, "``", "`", -1)
+	}
+	buf := make([]byte, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c == '\\' && i+1 < len(v) {
+			i++
+			switch v[i] {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'r':
+				c = '\r'
+			case '0':
+				c = 0
+			case 'Z':
+				c = 26
+			default:
+				c = v[i]
+			}
+		} else if c == q && i+1 < len(v) && v[i+1] == q {
+			i++
+		}
+		buf = append(buf, c)
+	}
+	return string(buf)
+}
+
+// scanQuoted returns the offset after the closing quote, both backslash
+// escapes and doubled quotes are understood.
+func scanQuoted(sql string, i int) int {
+	q := sql[i]
+	i++
+	for i < len(sql) {
+		c := sql[i]
+		if c == '\\' && q != '`' {
+			i += 2
+			continue
+		}
+		if c == q {
+			if i+1 < len(sql) && sql[i+1] == q {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return len(sql)
+}
+
+func scanNumber(sql string, i int) int {
+	if strings.HasPrefix(sql[i:], "0x") || strings.HasPrefix(sql[i:], "0X") {
+		i += 2
+		for i < len(sql) && isHexDigit(sql[i]) {
+			i++
+		}
+		return i
+	}
+	for i < len(sql) && (isDigit(sql[i]) || sql[i] == '.') {
+		i++
+	}
+	if i < len(sql) && (sql[i] == 'e' || sql[i] == 'E') {
+		j := i + 1
+		if j < len(sql) && (sql[j] == '+' || sql[j] == '-') {
+			j++
+		}
+		if j < len(sql) && isDigit(sql[j]) {
+			i = j
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+		}
+	}
+	// identifiers like 1abc are legal in mysql
+	for i < len(sql) && isIdentChar(sql[i]) {
+		i++
+	}
+	return i
+}
+
+// afterName tells a qualifier dot (t.1col) from a leading decimal point (.5).
+func afterName(tokens []Token, space bool) bool {
+	if space || len(tokens) == 0 {
+		return false
+	}
+	last := tokens[len(tokens)-1]
+	return last.Type == TOKEN_IDENT || last.Type == TOKEN_QUOTED_IDENT || last.IsPunct(")")
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}